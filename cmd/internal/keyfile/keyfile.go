@@ -0,0 +1,83 @@
+// Package keyfile loads the identity and pre-shared keys used by the
+// secure channel tools.
+package keyfile
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/kisom/go-schannel/schannel"
+)
+
+// Zero wipes the first n bytes of in, or all of it if n is zero.
+func Zero(in []byte, n int) {
+	if in == nil {
+		return
+	}
+
+	stop := n
+	if stop > len(in) || stop == 0 {
+		stop = len(in)
+	}
+
+	for i := 0; i < stop; i++ {
+		in[i] ^= in[i]
+	}
+}
+
+// LoadID reads the private signature key from privName and the peer's
+// public verification key from pubName. Either name may be empty, in
+// which case the corresponding key is nil.
+func LoadID(privName, pubName string) (priv *[64]byte, pub *[32]byte, err error) {
+	if pubName != "" {
+		pub = new([32]byte)
+		if err = readKey(pubName, pub[:]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if privName != "" {
+		priv = new([64]byte)
+		if err = readKey(privName, priv[:]); err != nil {
+			Zero(priv[:], 0)
+			return nil, nil, err
+		}
+	}
+
+	return priv, pub, nil
+}
+
+// LoadPSK reads a pre-shared key from pskName, returning it with the
+// given identity. If pskName is empty, no key is used, and it is an
+// error to give an identity.
+func LoadPSK(pskName, identity string) (*schannel.PSK, error) {
+	if pskName == "" {
+		if identity != "" {
+			return nil, errors.New("a PSK identity requires a pre-shared key (-p)")
+		}
+		return nil, nil
+	}
+
+	psk := &schannel.PSK{
+		Identity: []byte(identity),
+		Key:      new([schannel.PSKSize]byte),
+	}
+	if err := readKey(pskName, psk.Key[:]); err != nil {
+		Zero(psk.Key[:], 0)
+		return nil, err
+	}
+	return psk, nil
+}
+
+// readKey fills key from the start of the named file.
+func readKey(name string, key []byte) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.ReadFull(f, key)
+	return err
+}
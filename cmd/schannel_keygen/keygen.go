@@ -11,6 +11,7 @@ import (
 
 	"github.com/agl/ed25519"
 	"github.com/kisom/die"
+	"github.com/kisom/go-schannel/schannel"
 )
 
 func usage() {
@@ -24,9 +25,55 @@ Usage:
 
 		These files will be in the binary form that can be
 		directly loaded into the schannel_dial and schannel_listen
-		functions.
+		functions. The fingerprint of each new public key is
+		printed once it has been written.
 
-`, progName, progName)
+	%s fingerprint files...
+		Print the fingerprint of each identity key file. Either
+		the public (.pub) or private (.key) file may be given.
+
+`, progName, progName, progName)
+}
+
+// printFingerprint displays the fingerprint and randomart for an
+// identity public key.
+func printFingerprint(name string, pub *[schannel.IdentityPublicSize]byte) {
+	fpr := schannel.NewFingerprint(pub)
+	fmt.Printf("%s: %s\n", name, fpr)
+	fmt.Print(fpr.Randomart())
+}
+
+// loadPublic reads the identity public key from either a public or a
+// private key file; the public key is stored as the last half of an
+// Ed25519 private key.
+func loadPublic(path string) (*[schannel.IdentityPublicSize]byte, error) {
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var pub [schannel.IdentityPublicSize]byte
+	switch len(in) {
+	case schannel.IdentityPublicSize:
+		copy(pub[:], in)
+	case schannel.IdentityPrivateSize:
+		copy(pub[:], in[schannel.IdentityPrivateSize-schannel.IdentityPublicSize:])
+	default:
+		return nil, fmt.Errorf("%s is not an identity key (%d bytes)", path, len(in))
+	}
+
+	for i := range in {
+		in[i] = 0
+	}
+	return &pub, nil
+}
+
+func fingerprint(paths []string) {
+	for _, path := range paths {
+		pub, err := loadPublic(path)
+		die.If(err)
+		printFingerprint(path, pub)
+	}
 }
 
 func main() {
@@ -43,6 +90,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	if flag.Arg(0) == "fingerprint" {
+		if flag.NArg() == 1 {
+			usage()
+			os.Exit(1)
+		}
+		fingerprint(flag.Args()[1:])
+		return
+	}
+
 	for _, baseName := range flag.Args() {
 		pubFileName := fmt.Sprintf("%s.pub", baseName)
 		privFileName := fmt.Sprintf("%s.key", baseName)
@@ -55,5 +111,7 @@ func main() {
 
 		err = ioutil.WriteFile(privFileName, priv[:], 0600)
 		die.If(err)
+
+		printFingerprint(pubFileName, pub)
 	}
 }
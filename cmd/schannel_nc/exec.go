@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os/exec"
+
+	"github.com/kisom/go-schannel/schannel"
+)
+
+const (
+	// stderrMessage carries the standard error of a command run
+	// with -e.
+	stderrMessage = schannel.ApplicationMessage + 1
+
+	// exitMessage carries the exit status of a command run with
+	// -e, as a big-endian 32-bit integer. It is the last message
+	// sent before the shutdown.
+	exitMessage = schannel.ApplicationMessage + 2
+
+	// exitNotStarted is reported when the command could not be
+	// started, as shells do.
+	exitNotStarted = 127
+)
+
+// channelWriter sends each write over the secure channel as a message
+// of the given type.
+type channelWriter struct {
+	sch *schannel.SChannel
+	t   schannel.MessageType
+}
+
+func (w channelWriter) Write(p []byte) (int, error) {
+	var ok bool
+	if w.t == schannel.NormalMessage {
+		ok = w.sch.Send(p)
+	} else {
+		ok = w.sch.SendType(w.t, p)
+	}
+
+	if !ok {
+		return 0, errors.New("failed to send message")
+	}
+	return len(p), nil
+}
+
+// feed writes the peer's messages to the command's standard input
+// until the peer's input ends, closing it afterwards. If the peer
+// shuts the channel down or it fails, the command is killed and feed
+// returns false.
+func feed(sch *schannel.SChannel, stdin io.WriteCloser, kill func()) bool {
+	defer stdin.Close()
+	for {
+		m, ok := sch.ReceiveLarge()
+		if !ok {
+			log.Print("receive failed")
+			kill()
+			return false
+		}
+
+		switch m.Type {
+		case schannel.ShutdownMessage:
+			reason, _ := m.Reason()
+			log.Printf("peer is shutting down: %v", reason)
+			kill()
+			return false
+		case eofMessage:
+			return true
+		case schannel.NormalMessage:
+			// Once the command has exited, its input is
+			// discarded.
+			stdin.Write(m.Contents)
+		default:
+			log.Printf("unknown message type received: %d", m.Type)
+		}
+	}
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+func (discard) Close() error                { return nil }
+
+// execute runs the command with its standard input, output and error
+// connected to the secure channel. Once the command has exited, its
+// exit status is sent to the peer; when the peer's input has ended, the
+// channel is shut down.
+func execute(sch *schannel.SChannel, argv []string) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = channelWriter{sch, schannel.NormalMessage}
+	cmd.Stderr = channelWriter{sch, stderrMessage}
+	cmd.WaitDelay = shutdownTimeout
+
+	var stdin io.WriteCloser = discard{}
+	kill := func() {}
+
+	pipe, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+
+	if err == nil {
+		log.Printf("started %s (pid %d)", argv[0], cmd.Process.Pid)
+		stdin = pipe
+		kill = func() { cmd.Process.Kill() }
+	} else {
+		log.Printf("failed to start %s: %v", argv[0], err)
+	}
+
+	fed := make(chan bool, 1)
+	go func() {
+		fed <- feed(sch, stdin, kill)
+	}()
+
+	status := exitNotStarted
+	if err == nil {
+		cmd.Wait()
+		status = cmd.ProcessState.ExitCode()
+	}
+	log.Printf("%s exited with status %d", argv[0], status)
+
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], uint32(int32(status)))
+	if !sch.SendType(exitMessage, p[:]) {
+		log.Print("failed to send the exit status")
+	}
+
+	// The peer stops sending once it has the exit status.
+	if !<-fed {
+		return
+	}
+
+	if _, ok := sch.Shutdown(schannel.ShutdownNormal, "", shutdownTimeout); !ok {
+		log.Print("peer did not acknowledge the shutdown")
+	}
+}
+
+// exitStatus decodes the exit status sent by the peer.
+func exitStatus(p []byte) int {
+	if len(p) != 4 {
+		return 1
+	}
+	return int(int32(binary.BigEndian.Uint32(p)))
+}
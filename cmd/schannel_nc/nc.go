@@ -2,21 +2,44 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/kisom/die"
+	"github.com/kisom/go-schannel/cmd/internal/keyfile"
 	"github.com/kisom/go-schannel/schannel"
+	"github.com/kisom/go-schannel/schannel/metrics"
 )
 
+// shutdownTimeout is how long the sender waits for the listener to
+// acknowledge the end of the session.
+const shutdownTimeout = 5 * time.Second
+
+// eofMessage tells the peer that no more data will be sent in
+// bidirectional mode, like half-closing a TCP connection.
+const eofMessage = schannel.ApplicationMessage
+
 var (
-	idPriv *[64]byte
-	idPub  *[32]byte
+	idPriv        *[64]byte
+	idPub         *[32]byte
+	psk           *schannel.PSK
+	logger        *slog.Logger
+	bidirectional bool
+	command       []string
+
+	// remoteStatus is the exit status of the peer's command, which
+	// becomes this program's exit status.
+	remoteStatus int
 )
 
 func usage() {
@@ -24,55 +47,80 @@ func usage() {
 	fmt.Fprintf(os.Stderr, `%s version 1.0
 Usage:
 
-%s  [-hk] [-s signer] [-v verifier] host port
-%s [-hkl] [-s signer] [-v verifier] port
+%s  [-bdhk] [-e command] [-i identity] [-m address] [-p psk] [-s signer] [-v verifier] host port
+%s [-bdhkl] [-e command] [-i identity] [-m address] [-p psk] [-s signer] [-v verifier] port
+        -b              bidirectional mode: both sides send standard input and
+                        write what they receive to standard output. Both
+                        sides must use this option.
+        -d              log secure channel events, such as the key
+                        exchange and rejected messages, to standard error
+        -e command      run command once the secure channel is established,
+                        connecting its standard input, output and error to
+                        the channel; also --exec. This requires -v, and the
+                        peer must use -b.
         -h              print this usage message and exit
+        -i identity     specify the identity hint for the pre-shared key
         -k              force the program to keep listening after the client
                         disconnects. This must be used with -l.
         -l              listen for an incoming connection
+        -m address      serve metrics over HTTP on address, in the Prometheus
+                        format at /metrics and through expvar at /debug/vars
+        -p psk          specify the path to a 32-byte pre-shared key
         -s signer       specify the path to a signature key
-        -v verifier     specify the path to a verification key
+        -v verifier     specify the path to a verification key; this is
+                        required with -e
+
+By default, the dialer sends standard input and the listener writes it to
+standard output. In bidirectional mode, each side tells the other when its
+standard input ends, and the session is shut down once both have finished.
+
+With -e, the command's output is sent to the peer, whose standard input is
+fed to the command. Its standard error is written to the peer's standard
+error, and its exit status is sent to the peer, which exits with the same
+status. The command is run directly rather than by a shell, with arguments
+split on white space. Because this gives the peer control of a program, the
+peer must be verified with -v.
 
 If a signature key is specified, it will be used to sign the key exchange. If a
 verification key is specified, it will be used to verify the signature on the
-key exchange.
+key exchange, and its fingerprint will be shown once the secure channel has
+been established. If a pre-shared key is specified, it will be mixed into the
+session keys; both sides must use the same key and identity. This may be used
+with or without signature keys.
 `, progName, progName, progName)
 }
 
-func zero(in []byte, n int) {
-	if in == nil {
+// showPeer logs which identity key, if any, was used to verify the
+// peer during the key exchange.
+func showPeer() {
+	if idPub == nil {
+		log.Print("peer identity was not verified")
 		return
 	}
 
-	stop := n
-	if stop > len(in) || stop == 0 {
-		stop = len(in)
-	}
-
-	for i := 0; i < stop; i++ {
-		in[i] ^= in[i]
-	}
+	fpr := schannel.NewFingerprint(idPub)
+	log.Printf("verified peer identity %s", fpr)
+	fmt.Fprint(os.Stderr, fpr.Randomart())
 }
 
-func loadID(privName, pubName string) {
-	if pubName != "" {
-		pubFile, err := os.Open(pubName)
-		die.If(err)
-		defer pubFile.Close()
-
-		idPub = new([32]byte)
-		_, err = io.ReadFull(pubFile, idPub[:])
-		die.If(err)
-	}
-
-	if privName != "" {
-		privFile, err := os.Open(privName)
-		die.If(err)
-		defer privFile.Close()
+// serveMetrics serves the secure channel metrics over HTTP in the
+// background.
+func serveMetrics(addr string) {
+	http.Handle("/metrics", metrics.Handler())
+	go func() {
+		log.Printf("serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Printf("metrics server failed: %v", err)
+		}
+	}()
+}
 
-		idPriv = new([64]byte)
-		_, err = io.ReadFull(privFile, idPriv[:])
-		die.If(err)
+func config() *schannel.Config {
+	return &schannel.Config{
+		Signer: idPriv,
+		Peer:   idPub,
+		PSK:    psk,
+		Logger: logger,
 	}
 }
 
@@ -97,16 +145,29 @@ func listener(stayOpen bool, port string) {
 
 func newChannel(conn net.Conn) {
 	defer conn.Close()
-	sch, ok := schannel.Listen(conn, idPriv, idPub)
-	if !ok {
-		log.Printf("failed to establish secure channel")
+	sch, err := schannel.ListenConfig(conn, config())
+	if err != nil {
+		log.Printf("failed to establish secure channel: %v", err)
 		return
 	}
 
-	var stop bool
 	log.Printf("secure channel established")
+	showPeer()
+	if command != nil {
+		execute(sch, command)
+		sch.Zero()
+		return
+	}
+
+	if bidirectional {
+		duplex(sch, false)
+		sch.Zero()
+		return
+	}
+
+	var stop bool
 	for {
-		m, ok := sch.Receive()
+		m, ok := sch.ReceiveLarge()
 		if !ok {
 			log.Printf("receive failed")
 			break
@@ -114,7 +175,12 @@ func newChannel(conn net.Conn) {
 
 		switch m.Type {
 		case schannel.ShutdownMessage:
-			log.Printf("peer is shutting down")
+			reason, text := m.Reason()
+			if text != "" {
+				log.Printf("peer is shutting down: %v: %s", reason, text)
+			} else {
+				log.Printf("peer is shutting down: %v", reason)
+			}
 			stop = true
 			break
 		case schannel.KEXMessage:
@@ -145,11 +211,24 @@ func sender(host string) {
 	die.If(err)
 	defer conn.Close()
 
-	sch, ok := schannel.Dial(conn, idPriv, idPub)
-	if !ok {
-		die.With("failed to set up secure channel")
+	sch, err := schannel.DialConfig(conn, config())
+	if err != nil {
+		die.With("failed to set up secure channel: %v", err)
 	}
 	fmt.Println("secure channel established")
+	showPeer()
+
+	if command != nil {
+		execute(sch, command)
+		sch.Zero()
+		return
+	}
+
+	if bidirectional {
+		duplex(sch, true)
+		sch.Zero()
+		return
+	}
 
 	if !sch.Rekey() {
 		die.With("rekey failed")
@@ -171,8 +250,8 @@ func sender(host string) {
 
 	sctr := sch.SCtr()
 	sdata := sch.SData
-	if !sch.Close() {
-		die.With("failed to shutdown channel properly")
+	if _, ok := sch.Shutdown(schannel.ShutdownNormal, "", shutdownTimeout); !ok {
+		fmt.Println("peer did not acknowledge the shutdown")
 	}
 	fmt.Println("Secure channel tore down")
 	fmt.Printf("\t%d messages totalling %d bytes sent\n",
@@ -181,12 +260,138 @@ func sender(host string) {
 	return
 }
 
+// copyIn sends standard input over the secure channel until it ends,
+// then tells the peer that no more data will follow.
+func copyIn(sch *schannel.SChannel) error {
+	p := make([]byte, 8192)
+	defer keyfile.Zero(p, 0)
+
+	for {
+		n, err := os.Stdin.Read(p)
+		if n > 0 && !sch.Send(p[:n]) {
+			return errors.New("failed to send message")
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if !sch.SendType(eofMessage, []byte{0}) {
+		return errors.New("failed to send end of input")
+	}
+	return nil
+}
+
+// copyOut writes the messages received from the peer to standard
+// output until the peer's input ends or its command exits. It returns
+// true if the peer shut the channel down instead, and the exit status
+// if the peer ran a command.
+func copyOut(sch *schannel.SChannel) (bool, *int, error) {
+	for {
+		m, ok := sch.ReceiveLarge()
+		if !ok {
+			return false, nil, errors.New("receive failed")
+		}
+
+		switch m.Type {
+		case schannel.ShutdownMessage:
+			reason, _ := m.Reason()
+			log.Printf("peer is shutting down: %v", reason)
+			return true, nil, nil
+		case eofMessage:
+			return false, nil, nil
+		case exitMessage:
+			status := exitStatus(m.Contents)
+			return false, &status, nil
+		case schannel.NormalMessage:
+			os.Stdout.Write(m.Contents)
+		case stderrMessage:
+			os.Stderr.Write(m.Contents)
+		default:
+			log.Printf("unknown message type received: %d", m.Type)
+		}
+	}
+}
+
+// duplex copies standard input to the peer and the peer's messages to
+// standard output at the same time. Once both sides have run out of
+// input, the dialer shuts the channel down and the listener waits for
+// it to do so.
+func duplex(sch *schannel.SChannel, dialer bool) {
+	sent := make(chan error, 1)
+	go func() {
+		sent <- copyIn(sch)
+	}()
+
+	// The counters are reset when the channel is shut down.
+	report := func() {
+		log.Printf("sent %d messages with %d bytes, received %d messages with %d bytes",
+			sch.SCtr(), sch.SData, sch.RCtr(), sch.RData)
+	}
+
+	shutdown, status, err := copyOut(sch)
+	if err != nil {
+		log.Print(err)
+		return
+	} else if shutdown {
+		report()
+		return
+	}
+
+	if status != nil {
+		// The peer's command has exited, so the rest of the
+		// input is not needed; the peer shuts the channel down.
+		log.Printf("remote command exited with status %d", *status)
+		report()
+		remoteStatus = *status
+		sch.SendType(eofMessage, []byte{0})
+		waitShutdown(sch)
+		return
+	}
+
+	// The peer has finished sending; wait for this side to finish
+	// too.
+	if err = <-sent; err != nil {
+		log.Print(err)
+		return
+	}
+	report()
+
+	if dialer {
+		if _, ok := sch.Shutdown(schannel.ShutdownNormal, "", shutdownTimeout); !ok {
+			log.Print("peer did not acknowledge the shutdown")
+		}
+		return
+	}
+	waitShutdown(sch)
+}
+
+// waitShutdown discards messages until the peer shuts the channel down.
+func waitShutdown(sch *schannel.SChannel) {
+	for {
+		m, ok := sch.Receive()
+		if !ok || m.Type == schannel.ShutdownMessage {
+			return
+		}
+	}
+}
+
 func main() {
-	var pubFile, privFile string
-	var help, listen, stayOpen bool
+	var pubFile, privFile, pskFile, pskIdentity, metricsAddr, execCommand string
+	var debug, help, listen, stayOpen bool
+	flag.BoolVar(&bidirectional, "b", false, "send and receive in both directions")
+	flag.BoolVar(&debug, "d", false, "log secure channel events")
+	flag.StringVar(&execCommand, "e", "", "command to run on connection")
+	flag.StringVar(&execCommand, "exec", "", "command to run on connection")
 	flag.BoolVar(&help, "h", false, "display a short usage message")
+	flag.StringVar(&pskIdentity, "i", "", "identity hint for the pre-shared key")
 	flag.BoolVar(&stayOpen, "k", false, "keep listening after client disconnects")
 	flag.BoolVar(&listen, "l", false, "listen for incoming connections")
+	flag.StringVar(&metricsAddr, "m", "", "address to serve metrics on")
+	flag.StringVar(&pskFile, "p", "", "path to pre-shared key")
 	flag.StringVar(&privFile, "s", "", "path to signature key")
 	flag.StringVar(&pubFile, "v", "", "path to verification key")
 	flag.Parse()
@@ -196,10 +401,44 @@ func main() {
 		os.Exit(1)
 	}
 
-	loadID(privFile, pubFile)
+	if execCommand != "" {
+		command = strings.Fields(execCommand)
+		if len(command) == 0 {
+			die.With("no command was given to -e")
+		} else if pubFile == "" {
+			die.With("running a command (-e) requires the peer to be verified (-v)")
+		}
+	}
+
+	if debug {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		}))
+	}
+
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
+	}
+
+	// This runs after the keys have been zeroised below.
+	defer func() {
+		if remoteStatus != 0 {
+			os.Exit(remoteStatus)
+		}
+	}()
+
+	var err error
+	idPriv, idPub, err = keyfile.LoadID(privFile, pubFile)
+	die.If(err)
+	psk, err = keyfile.LoadPSK(pskFile, pskIdentity)
+	die.If(err)
 	defer func() {
 		if idPriv != nil {
-			zero(idPriv[:], 0)
+			keyfile.Zero(idPriv[:], 0)
+		}
+
+		if psk != nil {
+			keyfile.Zero(psk.Key[:], 0)
 		}
 	}()
 
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kisom/go-schannel/schannel"
+)
+
+const (
+	// minBackoff is how long the dialer waits before its first
+	// attempt to reconnect; the wait doubles with each failure up
+	// to maxBackoff. A session that lasted longer than maxBackoff
+	// resets the wait.
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// A tunnel keeps a session open to the listener, reconnecting when it
+// is lost, and carries its forwards over the session.
+type tunnel struct {
+	addr   string
+	cfg    *schannel.Config
+	local  forwardList
+	remote forwardList
+
+	mu      sync.Mutex
+	session *schannel.Session
+}
+
+func (t *tunnel) setSession(session *schannel.Session) {
+	t.mu.Lock()
+	t.session = session
+	t.mu.Unlock()
+}
+
+// current returns the session to the listener, or nil while the
+// tunnel is reconnecting.
+func (t *tunnel) current() *schannel.Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.session
+}
+
+// run keeps the session open until ctx is done, waiting between
+// attempts to reconnect with exponential backoff and jitter.
+func (t *tunnel) run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := t.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("session to %s lost: %v", t.addr, err)
+
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+
+		wait := backoff/2 + rand.N(backoff/2)
+		log.Printf("reconnecting in %v", wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// connect sets up a session with the listener, requests the remote
+// forwards, and serves the connections the listener forwards until
+// the session ends.
+func (t *tunnel) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: handshakeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sch, err := schannel.DialConfig(conn, t.cfg)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	session := schannel.NewSession(sch)
+	defer session.Close()
+	log.Printf("session to %s established", t.addr)
+
+	t.setSession(session)
+	defer t.setSession(nil)
+
+	for _, fwd := range t.remote {
+		go t.requestRemote(session, fwd)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-session.Done():
+		}
+	}()
+
+	for {
+		st, err := session.AcceptStream()
+		if err != nil {
+			return err
+		}
+		go t.serveForwarded(st)
+	}
+}
+
+// requestRemote asks the listener to bind a remote forward, which
+// lasts as long as the session.
+func (t *tunnel) requestRemote(session *schannel.Session, fwd *forward) {
+	st, err := session.OpenStream()
+	if err != nil {
+		return
+	}
+
+	addr, err := sendRequest(st, &request{Kind: requestListen, Addr: fwd.bind})
+	if err != nil {
+		log.Printf("remote forward %s refused: %v", fwd, err)
+		return
+	}
+
+	log.Printf("remote forward %s listening on %s", fwd, addr)
+	io.Copy(io.Discard, st)
+	st.Close()
+}
+
+// remoteForward returns the remote forward bound on addr.
+func (t *tunnel) remoteForward(addr string) *forward {
+	for _, fwd := range t.remote {
+		if fwd.bind == addr {
+			return fwd
+		}
+	}
+	return nil
+}
+
+// serveForwarded connects a connection forwarded by the listener to
+// its remote forward's target.
+func (t *tunnel) serveForwarded(st *schannel.Stream) {
+	req, err := readRequest(st)
+	if err != nil || req.Kind != requestForwarded {
+		st.Close()
+		return
+	}
+
+	fwd := t.remoteForward(req.Addr)
+	if fwd == nil {
+		writeReply(st, replyDenied, "")
+		st.Close()
+		return
+	}
+
+	source, err := net.ResolveTCPAddr("tcp", req.Source)
+	if err != nil || !fwd.permitted(source) {
+		log.Printf("remote forward %s: connection from %s denied", fwd, req.Source)
+		writeReply(st, replyDenied, "")
+		st.Close()
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", fwd.target, requestTimeout)
+	if err != nil {
+		log.Printf("remote forward %s: %v", fwd, err)
+		writeReply(st, replyFailed, "")
+		st.Close()
+		return
+	}
+
+	if err = writeReply(st, replyOK, ""); err != nil {
+		conn.Close()
+		st.Close()
+		return
+	}
+	splice(st, conn)
+}
+
+// serveLocal accepts connections on a local forward's port and
+// carries them to the listener.
+func (t *tunnel) serveLocal(ln net.Listener, fwd *forward) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("local forward %s: %v", fwd, err)
+			continue
+		}
+		go t.forwardLocal(conn, fwd)
+	}
+}
+
+func (t *tunnel) forwardLocal(conn net.Conn, fwd *forward) {
+	if !fwd.permitted(conn.RemoteAddr()) {
+		log.Printf("local forward %s: connection from %s denied", fwd, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	session := t.current()
+	if session == nil {
+		log.Printf("local forward %s: no session to %s", fwd, t.addr)
+		conn.Close()
+		return
+	}
+
+	st, err := session.OpenStream()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if _, err = sendRequest(st, &request{Kind: requestConnect, Addr: fwd.target}); err != nil {
+		log.Printf("local forward %s: %v", fwd, err)
+		conn.Close()
+		return
+	}
+	splice(conn, st)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// defaultBind is the address forwarded ports are bound to when the
+// forward does not name one, so that they are not exposed to the
+// network by accident.
+const defaultBind = "localhost"
+
+// A forward is a port forwarded through the tunnel: connections to
+// bind are carried to the peer, which connects them to target. For a
+// local forward, bind is on this side and target on the listener's;
+// for a remote forward, it is the other way around.
+type forward struct {
+	bind   string
+	target string
+
+	// allow, if not empty, lists the networks that may connect to
+	// the forwarded port.
+	allow []*net.IPNet
+}
+
+func (fwd *forward) String() string {
+	return fwd.bind + " -> " + fwd.target
+}
+
+// permitted returns true if a connection from addr may use the
+// forward.
+func (fwd *forward) permitted(addr net.Addr) bool {
+	if len(fwd.allow) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range fwd.allow {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForward parses a forward in the form
+// [bind:]port:host:hostport[@network,...], where each network is an
+// IP address or a CIDR block. IPv6 addresses are written in brackets.
+func parseForward(spec string) (*forward, error) {
+	fwd := &forward{}
+
+	addrs, allow, restricted := strings.Cut(spec, "@")
+	if restricted {
+		for _, s := range strings.Split(allow, ",") {
+			network, err := parseNetwork(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid forward %s: %v", spec, err)
+			}
+			fwd.allow = append(fwd.allow, network)
+		}
+	}
+
+	fields := splitAddrs(addrs)
+	switch len(fields) {
+	case 3:
+		fwd.bind = net.JoinHostPort(defaultBind, fields[0])
+	case 4:
+		fwd.bind = net.JoinHostPort(fields[0], fields[1])
+		fields = fields[1:]
+	default:
+		return nil, fmt.Errorf("invalid forward %s", spec)
+	}
+	fwd.target = net.JoinHostPort(fields[1], fields[2])
+
+	for _, s := range []string{fields[0], fields[2]} {
+		if s == "" || strings.Trim(s, "0123456789") != "" {
+			return nil, fmt.Errorf("invalid port %q in forward %s", s, spec)
+		}
+	}
+	return fwd, nil
+}
+
+// splitAddrs splits a forward on colons outside of brackets, removing
+// the brackets.
+func splitAddrs(s string) []string {
+	var fields []string
+	var field strings.Builder
+	var bracketed bool
+	for _, c := range s {
+		switch {
+		case c == '[' && !bracketed:
+			bracketed = true
+		case c == ']' && bracketed:
+			bracketed = false
+		case c == ':' && !bracketed:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(c)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// parseNetwork parses an IP address or CIDR block.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+
+	bits := 8 * net.IPv4len
+	if ip.To4() == nil {
+		bits = 8 * net.IPv6len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// A permit allows the peer to use a host and port on the listener,
+// either to connect to or to bind a remote forward on. Either may be
+// "*" to match anything.
+type permit struct {
+	host string
+	port string
+}
+
+func parsePermit(s string) (permit, error) {
+	if s == "*" {
+		return permit{"*", "*"}, nil
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return permit{}, err
+	} else if port == "" {
+		return permit{}, errors.New("permit " + s + " has no port")
+	}
+
+	// A bare port binds the default address, as in a forward.
+	if host == "" {
+		host = defaultBind
+	}
+	return permit{host, port}, nil
+}
+
+func (p permit) matches(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if p.host != "*" && !strings.EqualFold(p.host, host) {
+		return false
+	}
+	return p.port == "*" || p.port == port
+}
+
+// A permitList holds the permits given on the command line; it
+// implements flag.Value.
+type permitList []permit
+
+func (pl *permitList) String() string {
+	var s []string
+	for _, p := range *pl {
+		s = append(s, net.JoinHostPort(p.host, p.port))
+	}
+	return strings.Join(s, ",")
+}
+
+func (pl *permitList) Set(s string) error {
+	p, err := parsePermit(s)
+	if err != nil {
+		return err
+	}
+	*pl = append(*pl, p)
+	return nil
+}
+
+// allows returns true if any of the permits matches addr. An empty
+// list allows nothing.
+func (pl permitList) allows(addr string) bool {
+	for _, p := range pl {
+		if p.matches(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// A forwardList holds the forwards given on the command line; it
+// implements flag.Value.
+type forwardList []*forward
+
+func (fl *forwardList) String() string {
+	var s []string
+	for _, fwd := range *fl {
+		s = append(s, fwd.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (fl *forwardList) Set(s string) error {
+	fwd, err := parseForward(s)
+	if err != nil {
+		return err
+	}
+	*fl = append(*fl, fwd)
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec   string
+		bind   string
+		target string
+		allow  []string
+	}{
+		{"8080:example.com:80", "localhost:8080", "example.com:80", nil},
+		{"0.0.0.0:8080:example.com:80", "0.0.0.0:8080", "example.com:80", nil},
+		{"[::1]:8080:[2001:db8::1]:80", "[::1]:8080", "[2001:db8::1]:80", nil},
+		{"8080:[::1]:80", "localhost:8080", "[::1]:80", nil},
+		{
+			"8080:example.com:80@10.0.0.0/8,192.168.1.5",
+			"localhost:8080", "example.com:80",
+			[]string{"10.0.0.0/8", "192.168.1.5/32"},
+		},
+		{
+			"[::]:8080:example.com:80@fd00::/8,::1",
+			"[::]:8080", "example.com:80",
+			[]string{"fd00::/8", "::1/128"},
+		},
+	}
+
+	for _, tt := range tests {
+		fwd, err := parseForward(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+
+		if fwd.bind != tt.bind {
+			t.Errorf("%s: expected bind %s, have %s", tt.spec, tt.bind, fwd.bind)
+		}
+		if fwd.target != tt.target {
+			t.Errorf("%s: expected target %s, have %s", tt.spec, tt.target, fwd.target)
+		}
+
+		if len(fwd.allow) != len(tt.allow) {
+			t.Errorf("%s: expected %d networks, have %d", tt.spec, len(tt.allow), len(fwd.allow))
+			continue
+		}
+		for i, network := range fwd.allow {
+			if network.String() != tt.allow[i] {
+				t.Errorf("%s: expected network %s, have %s", tt.spec, tt.allow[i], network)
+			}
+		}
+	}
+}
+
+func TestParseForwardInvalid(t *testing.T) {
+	specs := []string{
+		"",
+		"8080",
+		"8080:example.com",
+		"a:b:c:d:e",
+		":example.com:80",
+		"8080:example.com:",
+		"http:example.com:80",
+		"8080:example.com:http",
+		"8080:example.com:-80",
+		"localhost::example.com:80",
+		"8080:example.com:80@",
+		"8080:example.com:80@example.com",
+		"8080:example.com:80@10.0.0.0/33",
+		"8080:example.com:80@10.0.0.0/8,",
+	}
+
+	for _, spec := range specs {
+		if fwd, err := parseForward(spec); err == nil {
+			t.Errorf("%q: expected an error, have %s", spec, fwd)
+		}
+	}
+}
+
+func TestForwardPermitted(t *testing.T) {
+	open, err := parseForward("8080:example.com:80")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	restricted, err := parseForward("8080:example.com:80@10.0.0.0/8,192.168.1.5,fd00::/8")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		fwd  *forward
+		addr net.Addr
+		want bool
+	}{
+		{open, &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1234}, true},
+		{open, &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1234}, true},
+		{restricted, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, true},
+		{restricted, &net.TCPAddr{IP: net.ParseIP("192.168.1.5"), Port: 1234}, true},
+		{restricted, &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 1234}, true},
+		{restricted, &net.TCPAddr{IP: net.ParseIP("192.168.1.6"), Port: 1234}, false},
+		{restricted, &net.TCPAddr{IP: net.ParseIP("11.0.0.1"), Port: 1234}, false},
+		{restricted, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234}, false},
+		{restricted, &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, false},
+	}
+
+	for _, tt := range tests {
+		if have := tt.fwd.permitted(tt.addr); have != tt.want {
+			t.Errorf("%s from %s: expected %v, have %v", tt.fwd, tt.addr, tt.want, have)
+		}
+	}
+}
+
+func TestParsePermit(t *testing.T) {
+	tests := []struct {
+		s    string
+		want permit
+	}{
+		{"*", permit{"*", "*"}},
+		{"localhost:22", permit{"localhost", "22"}},
+		{":22", permit{defaultBind, "22"}},
+		{"[::1]:22", permit{"::1", "22"}},
+		{"*:22", permit{"*", "22"}},
+		{"example.com:*", permit{"example.com", "*"}},
+	}
+
+	for _, tt := range tests {
+		p, err := parsePermit(tt.s)
+		if err != nil {
+			t.Errorf("%s: %v", tt.s, err)
+		} else if p != tt.want {
+			t.Errorf("%s: expected %v, have %v", tt.s, tt.want, p)
+		}
+	}
+
+	for _, s := range []string{"", "localhost", "localhost:", "::1:22"} {
+		if p, err := parsePermit(s); err == nil {
+			t.Errorf("%q: expected an error, have %v", s, p)
+		}
+	}
+}
+
+func TestPermitList(t *testing.T) {
+	var pl permitList
+	if pl.allows("localhost:22") {
+		t.Fatal("an empty permit list should allow nothing")
+	}
+
+	for _, s := range []string{"localhost:22", "*:8080", "[::1]:*"} {
+		if err := pl.Set(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"localhost:22", true},
+		{"LocalHost:22", true},
+		{"localhost:23", false},
+		{"127.0.0.1:22", false},
+		{"example.com:8080", true},
+		{"example.com:8081", false},
+		{"[::1]:443", true},
+		{"[::2]:443", false},
+		{"localhost", false},
+	}
+
+	for _, tt := range tests {
+		if have := pl.allows(tt.addr); have != tt.want {
+			t.Errorf("%s: expected %v, have %v", tt.addr, tt.want, have)
+		}
+	}
+
+	var all permitList
+	all.Set("*")
+	for _, addr := range []string{"localhost:22", "[::1]:443", "example.com:8080"} {
+		if !all.allows(addr) {
+			t.Errorf("%s: \"*\" should allow everything", addr)
+		}
+	}
+}
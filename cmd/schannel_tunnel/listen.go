@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+
+	"github.com/kisom/go-schannel/schannel"
+)
+
+var (
+	// openPermits lists the addresses the dialer may connect to
+	// through a local forward.
+	openPermits permitList
+
+	// listenPermits lists the addresses the dialer may bind for a
+	// remote forward.
+	listenPermits permitList
+)
+
+// peerName returns the address of the peer at the other end of the
+// secure channel, for logging.
+func peerName(sch *schannel.SChannel) string {
+	if conn, ok := sch.Channel.(net.Conn); ok {
+		return conn.RemoteAddr().String()
+	}
+	return "peer"
+}
+
+// serveSession serves the requests the dialer makes over its session
+// until the session ends; it is the Handler for the listener's Server.
+func serveSession(sch *schannel.SChannel) {
+	peer := peerName(sch)
+	session := schannel.NewSession(sch)
+	defer session.Close()
+
+	log.Printf("%s: session established", peer)
+	for {
+		st, err := session.AcceptStream()
+		if err != nil {
+			break
+		}
+		go serveStream(session, st, peer)
+	}
+	log.Printf("%s: session closed", peer)
+}
+
+func serveStream(session *schannel.Session, st *schannel.Stream, peer string) {
+	req, err := readRequest(st)
+	if err != nil {
+		log.Printf("%s: invalid request: %v", peer, err)
+		st.Close()
+		return
+	}
+
+	switch req.Kind {
+	case requestConnect:
+		serveConnect(st, req, peer)
+	case requestListen:
+		serveListen(session, st, req, peer)
+	default:
+		// Only the listener sends forwarded connections.
+		writeReply(st, replyDenied, "")
+		st.Close()
+	}
+}
+
+// serveConnect connects a local forward's stream to its target.
+func serveConnect(st *schannel.Stream, req *request, peer string) {
+	if !openPermits.allows(req.Addr) {
+		log.Printf("%s: connection to %s denied", peer, req.Addr)
+		writeReply(st, replyDenied, "")
+		st.Close()
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", req.Addr, requestTimeout)
+	if err != nil {
+		log.Printf("%s: connection to %s failed: %v", peer, req.Addr, err)
+		writeReply(st, replyFailed, "")
+		st.Close()
+		return
+	}
+
+	if err = writeReply(st, replyOK, ""); err != nil {
+		conn.Close()
+		st.Close()
+		return
+	}
+	splice(st, conn)
+}
+
+// serveListen binds the address for a remote forward, and carries
+// each connection to it back to the dialer on a new stream. The
+// forward lasts until the dialer closes the request's stream or the
+// session ends.
+func serveListen(session *schannel.Session, st *schannel.Stream, req *request, peer string) {
+	if !listenPermits.allows(req.Addr) {
+		log.Printf("%s: remote forward on %s denied", peer, req.Addr)
+		writeReply(st, replyDenied, "")
+		st.Close()
+		return
+	}
+
+	ln, err := net.Listen("tcp", req.Addr)
+	if err != nil {
+		log.Printf("%s: remote forward on %s failed: %v", peer, req.Addr, err)
+		writeReply(st, replyFailed, "")
+		st.Close()
+		return
+	}
+
+	if err = writeReply(st, replyOK, ln.Addr().String()); err != nil {
+		ln.Close()
+		st.Close()
+		return
+	}
+
+	log.Printf("%s: remote forward listening on %s", peer, ln.Addr())
+	go func() {
+		io.Copy(io.Discard, st)
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		go forwardRemote(session, conn, req.Addr, peer)
+	}
+
+	st.Close()
+	log.Printf("%s: remote forward on %s closed", peer, ln.Addr())
+}
+
+// forwardRemote carries a connection to a remote forward to the
+// dialer, which connects it to the forward's target.
+func forwardRemote(session *schannel.Session, conn net.Conn, bind, peer string) {
+	st, err := session.OpenStream()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	_, err = sendRequest(st, &request{
+		Kind:   requestForwarded,
+		Addr:   bind,
+		Source: conn.RemoteAddr().String(),
+	})
+	if err != nil {
+		log.Printf("%s: forwarded connection from %s refused: %v",
+			peer, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	splice(st, conn)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Each stream in the session begins with a request from the side that
+// opened it, which the other side answers with a reply before any data
+// is carried.
+const (
+	// requestConnect asks the listener to connect the stream to an
+	// address, for a local forward.
+	requestConnect uint8 = iota + 1
+
+	// requestListen asks the listener to bind an address for a
+	// remote forward. The stream carries no data; the listener
+	// stops listening when it is closed.
+	requestListen
+
+	// requestForwarded is sent by the listener when a connection
+	// arrives on a remote forward, naming the forward and the
+	// address the connection came from.
+	requestForwarded
+)
+
+const (
+	replyOK uint8 = iota
+	replyDenied
+	replyFailed
+)
+
+// requestTimeout limits how long either side waits for a request or a
+// reply, and how long the listener waits to connect to an address.
+const requestTimeout = 10 * time.Second
+
+var (
+	errRequest = errors.New("invalid request")
+	errDenied  = errors.New("administratively prohibited")
+	errFailed  = errors.New("connection failed")
+)
+
+// A request names a stream's purpose. Addr is the address to connect
+// to or to bind; for a forwarded connection, it is the forward's bind
+// address, and Source is where the connection came from.
+type request struct {
+	Kind   uint8
+	Addr   string
+	Source string
+}
+
+// writeString writes s with a one-byte length prefix.
+func writeString(w io.Writer, s string) error {
+	if len(s) > 255 {
+		return errRequest
+	}
+
+	if _, err := w.Write([]byte{uint8(len(s))}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+
+	p := make([]byte, n[0])
+	if _, err := io.ReadFull(r, p); err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+func writeRequest(conn net.Conn, req *request) error {
+	if _, err := conn.Write([]byte{req.Kind}); err != nil {
+		return err
+	}
+
+	if err := writeString(conn, req.Addr); err != nil {
+		return err
+	}
+
+	if req.Kind == requestForwarded {
+		return writeString(conn, req.Source)
+	}
+	return nil
+}
+
+func readRequest(conn net.Conn) (*request, error) {
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var kind [1]byte
+	if _, err := io.ReadFull(conn, kind[:]); err != nil {
+		return nil, err
+	}
+
+	req := &request{Kind: kind[0]}
+	switch req.Kind {
+	case requestConnect, requestListen, requestForwarded:
+	default:
+		return nil, errRequest
+	}
+
+	var err error
+	if req.Addr, err = readString(conn); err != nil {
+		return nil, err
+	}
+
+	if req.Kind == requestForwarded {
+		if req.Source, err = readString(conn); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// writeReply answers a request. On success, msg may carry an address,
+// such as the one bound for a remote forward.
+func writeReply(conn net.Conn, status uint8, msg string) error {
+	if _, err := conn.Write([]byte{status}); err != nil {
+		return err
+	}
+	return writeString(conn, msg)
+}
+
+// readReply waits for the answer to a request, returning an error if
+// the request was refused.
+func readReply(conn net.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return "", err
+	}
+
+	msg, err := readString(conn)
+	if err != nil {
+		return "", err
+	}
+
+	switch status[0] {
+	case replyOK:
+		return msg, nil
+	case replyDenied:
+		return "", errDenied
+	default:
+		return "", errFailed
+	}
+}
+
+// sendRequest sends req on a newly opened stream and waits for the
+// reply; the stream is closed if the request fails.
+func sendRequest(conn net.Conn, req *request) (string, error) {
+	if err := writeRequest(conn, req); err != nil {
+		conn.Close()
+		return "", err
+	}
+
+	msg, err := readReply(conn)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	return msg, nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies data between two connections in both directions until
+// both have finished, passing on half-closes, then closes both.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			// The other direction cannot complete either.
+			a.Close()
+			b.Close()
+			return
+		}
+
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+}
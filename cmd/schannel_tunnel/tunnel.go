@@ -0,0 +1,235 @@
+// schannel_tunnel forwards TCP ports over a secure channel, in the
+// manner of ssh -L and -R.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kisom/die"
+	"github.com/kisom/go-schannel/cmd/internal/keyfile"
+	"github.com/kisom/go-schannel/schannel"
+)
+
+const (
+	// keepaliveInterval is how often each side pings the other, so
+	// that a lost session is noticed and the dialer reconnects.
+	keepaliveInterval = 15 * time.Second
+
+	// shutdownTimeout is how long the listener waits for sessions
+	// to end when it is interrupted.
+	shutdownTimeout = 5 * time.Second
+
+	// handshakeTimeout limits how long connecting to the peer and
+	// the key exchange may take.
+	handshakeTimeout = 30 * time.Second
+)
+
+var (
+	idPriv *[64]byte
+	idPub  *[32]byte
+	psk    *schannel.PSK
+	logger *slog.Logger
+)
+
+func usage() {
+	progName := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, `%s version 1.0
+Usage:
+
+%s  [-dh] [-L forward] [-R forward] [-i identity] [-p psk] [-s signer] [-v verifier] host port
+%s [-dhl] [-a host:port] [-A [bind:]port] [-i identity] [-p psk] [-s signer] [-v verifier] port
+        -A [bind:]port  allow the dialer to bind a remote forward on this
+                        address; may be repeated
+        -a host:port    allow the dialer to connect to this address
+                        through a local forward; may be repeated
+        -d              log secure channel events, such as the key
+                        exchange and rejected messages, to standard error
+        -h              print this usage message and exit
+        -i identity     specify the identity hint for the pre-shared key
+        -L forward      forward a port on this side to an address reached
+                        by the listener; may be repeated
+        -l              listen for incoming tunnels
+        -p psk          specify the path to a 32-byte pre-shared key
+        -R forward      forward a port on the listener to an address
+                        reached by this side; may be repeated
+        -s signer       specify the path to a signature key
+        -v verifier     specify the path to a verification key
+
+A forward is written as [bind:]port:host:hostport[@network,...]. Connections
+to bind:port are carried over the secure channel and connected to
+host:hostport on the other side. If no bind address is given, the forward
+is bound to localhost. The networks, written as IP addresses or CIDR
+blocks, limit which addresses may connect to the forwarded port; by
+default, any address may. IPv6 addresses are written in brackets.
+
+The dialer keeps a single session open to the listener, carrying every
+forward, and reconnects with exponential backoff when it is lost. Local
+forwards stay bound while the dialer is reconnecting, but connections to
+them are closed until the session is back; remote forwards are requested
+again once the session is back.
+
+The listener refuses every forward it has not been told to allow with -a
+or -A. Either part of an allowed address may be "*" to match anything, and
+addresses are compared as written, so "localhost" does not allow
+"127.0.0.1".
+
+The peer must be authenticated, either with a verification key or a
+pre-shared key. If a signature key is specified, it will be used to sign the
+key exchange. If a verification key is specified, it will be used to verify
+the signature on the key exchange. If a pre-shared key is specified, it will
+be mixed into the session keys; both sides must use the same key and
+identity.
+`, progName, progName, progName)
+}
+
+func config() *schannel.Config {
+	return &schannel.Config{
+		Signer:            idPriv,
+		Peer:              idPub,
+		PSK:               psk,
+		KeepaliveInterval: keepaliveInterval,
+		Logger:            logger,
+	}
+}
+
+// listen serves tunnels on port until ctx is done.
+func listen(ctx context.Context, port string) {
+	ln, err := net.Listen("tcp", ":"+port)
+	die.If(err)
+
+	srv := &schannel.Server{
+		Handler:          schannel.ServeFunc(serveSession),
+		Config:           config(),
+		HandshakeTimeout: handshakeTimeout,
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if srv.Shutdown(shutdownCtx) != nil {
+			srv.Close()
+		}
+	}()
+
+	log.Printf("listening on %s", ln.Addr())
+	if err = srv.Serve(ln); err != schannel.ErrServerClosed {
+		log.Print(err)
+		return
+	}
+	<-stopped
+}
+
+// dial binds the local forwards, then keeps a session open to host
+// until ctx is done.
+func dial(ctx context.Context, host string, local, remote forwardList) {
+	t := &tunnel{
+		addr:   host,
+		cfg:    config(),
+		local:  local,
+		remote: remote,
+	}
+
+	for _, fwd := range local {
+		ln, err := net.Listen("tcp", fwd.bind)
+		if err != nil {
+			die.With("local forward %s: %v", fwd, err)
+		}
+		defer ln.Close()
+
+		log.Printf("local forward %s listening on %s", fwd, ln.Addr())
+		go t.serveLocal(ln, fwd)
+	}
+
+	t.run(ctx)
+}
+
+func main() {
+	var pubFile, privFile, pskFile, pskIdentity string
+	var debug, help, listening bool
+	var local, remote forwardList
+	flag.Var(&listenPermits, "A", "address the dialer may bind a remote forward on")
+	flag.Var(&openPermits, "a", "address the dialer may connect to")
+	flag.BoolVar(&debug, "d", false, "log secure channel events")
+	flag.BoolVar(&help, "h", false, "display a short usage message")
+	flag.StringVar(&pskIdentity, "i", "", "identity hint for the pre-shared key")
+	flag.Var(&local, "L", "local port forward")
+	flag.BoolVar(&listening, "l", false, "listen for incoming tunnels")
+	flag.StringVar(&pskFile, "p", "", "path to pre-shared key")
+	flag.Var(&remote, "R", "remote port forward")
+	flag.StringVar(&privFile, "s", "", "path to signature key")
+	flag.StringVar(&pubFile, "v", "", "path to verification key")
+	flag.Usage = usage
+	flag.Parse()
+
+	if help {
+		usage()
+		os.Exit(1)
+	}
+
+	if pubFile == "" && pskFile == "" {
+		die.With("the peer must be authenticated with a verification key (-v) or a pre-shared key (-p)")
+	}
+
+	if listening {
+		if len(local) > 0 || len(remote) > 0 {
+			die.With("forwards (-L and -R) are requested by the dialer")
+		} else if flag.NArg() != 1 {
+			die.With("a port is required (and should be the only argument) when listening")
+		}
+	} else {
+		if len(openPermits) > 0 || len(listenPermits) > 0 {
+			die.With("forwards are allowed (-a and -A) by the listener")
+		} else if len(local) == 0 && len(remote) == 0 {
+			die.With("at least one forward (-L or -R) is required")
+		} else if flag.NArg() != 2 {
+			die.With("an address and port are required (and should be the only arguments)")
+		}
+	}
+
+	if debug {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		}))
+	}
+
+	var err error
+	idPriv, idPub, err = keyfile.LoadID(privFile, pubFile)
+	die.If(err)
+	psk, err = keyfile.LoadPSK(pskFile, pskIdentity)
+	die.If(err)
+	defer func() {
+		if idPriv != nil {
+			keyfile.Zero(idPriv[:], 0)
+		}
+
+		if psk != nil {
+			keyfile.Zero(psk.Key[:], 0)
+		}
+	}()
+
+	if idPub != nil {
+		log.Printf("peer identity must be %s", schannel.NewFingerprint(idPub))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if listening {
+		listen(ctx, flag.Arg(0))
+		return
+	}
+	dial(ctx, net.JoinHostPort(flag.Arg(0), flag.Arg(1)), local, remote)
+}
@@ -0,0 +1,290 @@
+package schannel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestSendReceiveInto(t *testing.T) {
+	alice, bob := testBufferPair(t, nil, nil)
+
+	var scratch []byte
+	p := make([]byte, len(message))
+	for i := 0; i < 4; i++ {
+		var ok bool
+		scratch, ok = alice.SendBuffer(scratch, message)
+		if !ok {
+			t.Fatal("alice failed to send a message")
+		}
+
+		mType, n, ok := bob.ReceiveInto(p)
+		if !ok {
+			t.Fatal("bob failed to receive a message")
+		} else if mType != NormalMessage {
+			t.Fatal("bob got an invalid message")
+		} else if !bytes.Equal(p[:n], message) {
+			t.Fatal("bob didn't get the message alice sent")
+		}
+	}
+
+	if !alice.Send(message) {
+		t.Fatal("alice failed to send a message")
+	}
+
+	if _, _, ok := bob.ReceiveInto(p[:len(message)-1]); ok {
+		t.Fatal("ReceiveInto should fail with a short buffer")
+	}
+}
+
+func TestZeroAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not reliable under the race detector")
+	}
+
+	alice, bob := testBufferPair(t, nil, nil)
+
+	var scratch []byte
+	p := make([]byte, len(message))
+	allocs := testing.AllocsPerRun(100, func() {
+		var ok bool
+		scratch, ok = alice.SendBuffer(scratch, message)
+		if !ok {
+			t.Fatal("alice failed to send a message")
+		}
+
+		if _, _, ok = bob.ReceiveInto(p); !ok {
+			t.Fatal("bob failed to receive a message")
+		}
+	})
+
+	if allocs != 0 {
+		t.Fatalf("expected no allocations per message, have %0.1f", allocs)
+	}
+}
+
+func benchmarkSendReceive(b *testing.B, size int) {
+	alice, bob := testBufferPair(b, nil, nil)
+	m := bytes.Repeat([]byte{0x2a}, size)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !alice.Send(m) {
+			b.Fatal("send failed")
+		}
+
+		if _, ok := bob.Receive(); !ok {
+			b.Fatal("receive failed")
+		}
+	}
+}
+
+func benchmarkSendReceiveInto(b *testing.B, size int) {
+	alice, bob := testBufferPair(b, nil, nil)
+	m := bytes.Repeat([]byte{0x2a}, size)
+	p := make([]byte, size)
+
+	var scratch []byte
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var ok bool
+		scratch, ok = alice.SendBuffer(scratch, m)
+		if !ok {
+			b.Fatal("send failed")
+		}
+
+		if _, _, ok = bob.ReceiveInto(p); !ok {
+			b.Fatal("receive failed")
+		}
+	}
+}
+
+func BenchmarkSendReceive64(b *testing.B)     { benchmarkSendReceive(b, 64) }
+func BenchmarkSendReceive4K(b *testing.B)     { benchmarkSendReceive(b, 4096) }
+func BenchmarkSendReceiveInto64(b *testing.B) { benchmarkSendReceiveInto(b, 64) }
+func BenchmarkSendReceiveInto4K(b *testing.B) { benchmarkSendReceiveInto(b, 4096) }
+
+// countingWriter counts the calls to Write.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.writes++
+	return cw.Buffer.Write(p)
+}
+
+func TestSingleWritePerFrame(t *testing.T) {
+	alice, bob := testBufferPair(t, nil, nil)
+	cw := &countingWriter{}
+	alice.Channel = cw
+	bob.Channel = cw
+
+	if !alice.Send(message) {
+		t.Fatal("alice failed to send a message")
+	} else if cw.writes != 1 {
+		t.Fatalf("expected a single write per frame, have %d", cw.writes)
+	}
+
+	if m, ok := bob.Receive(); !ok || !bytes.Equal(m.Contents, message) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	alice, bob := testBufferPair(t, nil, nil)
+	cw := &countingWriter{}
+	alice.Channel = cw
+	bob.Channel = cw
+
+	batch := bytes.SplitAfter(message, []byte("\n\n"))
+	if !alice.SendBatch(batch) {
+		t.Fatal("alice failed to send a batch of messages")
+	} else if cw.writes != 1 {
+		t.Fatalf("expected a single write per batch, have %d", cw.writes)
+	}
+
+	for i := range batch {
+		m, ok := bob.Receive()
+		if !ok {
+			t.Fatal("bob failed to receive a message")
+		} else if !bytes.Equal(m.Contents, batch[i]) {
+			t.Fatal("bob didn't get the message alice sent")
+		}
+	}
+
+	if alice.SendBatch([][]byte{message, nil}) {
+		t.Fatal("SendBatch should fail with an empty message")
+	} else if cw.writes != 1 {
+		t.Fatal("nothing should be written when a batch fails")
+	}
+}
+
+// sendSplit sends a message the way Send did before frames were
+// written with a single write, for comparison in benchmarks.
+func sendSplit(sch *SChannel, scratch, m []byte) ([]byte, bool) {
+	scratch, frame, ok := sch.seal(scratch, NormalMessage, m, 0, 0)
+	if !ok {
+		return scratch, false
+	}
+
+	if _, err := sch.Channel.Write(frame[:frameHeaderSize]); err != nil {
+		return scratch, false
+	}
+
+	_, err := sch.Channel.Write(frame[frameHeaderSize:])
+	return scratch, err == nil
+}
+
+// testTCPPair sets up a pair of secure channels over a loopback TCP
+// connection, which is closed when the test finishes.
+func testTCPPair(tb testing.TB) (*SChannel, *SChannel) {
+	return testTCPConfigPair(tb, nil, nil)
+}
+
+// testTCPConfigPair is like testTCPPair, but sets up the secure
+// channel with the given configurations.
+func testTCPConfigPair(tb testing.TB, dcfg, lcfg *Config) (*SChannel, *SChannel) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("%v", err)
+	}
+	defer ln.Close()
+
+	results := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			results <- handshakeResult{}
+			return
+		}
+
+		sch, err := ListenConfig(conn, lcfg)
+		if err != nil {
+			conn.Close()
+		}
+		results <- handshakeResult{sch, err == nil}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatalf("%v", err)
+	}
+
+	dialer, err := DialConfig(conn, dcfg)
+	listener := <-results
+	if err != nil || !listener.ok {
+		conn.Close()
+		tb.Fatal("failed to set up secure channel")
+	}
+
+	lconn := listener.sch.Channel.(net.Conn)
+	tb.Cleanup(func() {
+		conn.Close()
+		lconn.Close()
+	})
+	return dialer, listener.sch
+}
+
+// testTCPSender sets up a secure channel over a loopback TCP
+// connection whose peer discards everything it receives.
+func testTCPSender(tb testing.TB) *SChannel {
+	sch, peer := testTCPPair(tb)
+	go io.Copy(ioutil.Discard, peer.Channel)
+	return sch
+}
+
+func BenchmarkTCPSendSplit(b *testing.B) {
+	sch := testTCPSender(b)
+
+	var scratch []byte
+	b.ReportAllocs()
+	b.SetBytes(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var ok bool
+		if scratch, ok = sendSplit(sch, scratch, message[:64]); !ok {
+			b.Fatal("send failed")
+		}
+	}
+}
+
+func BenchmarkTCPSend(b *testing.B) {
+	sch := testTCPSender(b)
+
+	var scratch []byte
+	b.ReportAllocs()
+	b.SetBytes(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var ok bool
+		if scratch, ok = sch.SendBuffer(scratch, message[:64]); !ok {
+			b.Fatal("send failed")
+		}
+	}
+}
+
+func BenchmarkTCPSendBatch16(b *testing.B) {
+	sch := testTCPSender(b)
+
+	batch := make([][]byte, 16)
+	for i := range batch {
+		batch[i] = message[:64]
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(64 * int64(len(batch)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !sch.SendBatch(batch) {
+			b.Fatal("send failed")
+		}
+	}
+}
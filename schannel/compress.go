@@ -0,0 +1,175 @@
+package schannel
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+const (
+	// featureDeflate indicates that DEFLATE-compressed messages are
+	// accepted.
+	featureDeflate = 1
+
+	// minCompressSize is the smallest message that is compressed;
+	// smaller messages rarely shrink.
+	minCompressSize = 64
+)
+
+// errIncompressible is returned by a sliceWriter when the compressed
+// message would not be smaller than the original.
+var errIncompressible = errors.New("schannel: message is incompressible")
+
+// A sliceWriter appends to a pooled buffer, up to a limit. When the
+// buffer grows, the old one is zeroised.
+type sliceWriter struct {
+	p     *[]byte
+	limit int
+}
+
+func (w sliceWriter) Write(b []byte) (int, error) {
+	if len(*w.p)+len(b) > w.limit {
+		return 0, errIncompressible
+	}
+
+	if len(*w.p)+len(b) > cap(*w.p) {
+		grown := make([]byte, len(*w.p), 2*cap(*w.p)+len(b))
+		copy(grown, *w.p)
+		zero(*w.p, 0)
+		*w.p = grown
+	}
+
+	*w.p = append(*w.p, b...)
+	return len(b), nil
+}
+
+// Each peer's optional features, such as compression, are carried in
+// its half of the key exchange, one per public key, in the most
+// significant bit of the key's last byte. X25519 ignores this bit
+// (RFC 7748, section 5), and no public key has it set, so it changes
+// neither the session keys nor the handshake seen by a peer that
+// doesn't know about features. The bits are signed along with the
+// public keys.
+const featureKeys = kexPubSize / 32
+
+// features returns the features this side accepts.
+func (sch *SChannel) features() uint8 {
+	var features uint8
+	if sch.inflating {
+		features |= featureDeflate
+	}
+	return features
+}
+
+// markFeatures sets this side's feature bits in its public keys before
+// they are sent to the peer.
+func (sch *SChannel) markFeatures(pk []byte) {
+	features := sch.features()
+	for i := 0; i < featureKeys; i++ {
+		if features&(1<<i) != 0 {
+			pk[32*i+31] |= 0x80
+		}
+	}
+}
+
+// takeFeatures reads the peer's feature bits from its public keys and
+// clears them. Messages are only compressed if both sides enabled
+// compression.
+func (sch *SChannel) takeFeatures(pk []byte) {
+	var features uint8
+	for i := 0; i < featureKeys; i++ {
+		if pk[32*i+31]&0x80 != 0 {
+			features |= 1 << i
+			pk[32*i+31] &^= 0x80
+		}
+	}
+
+	sch.deflating = sch.inflating && features&featureDeflate != 0
+}
+
+// deflate compresses m into a pooled buffer, which the caller should
+// return with putBuffer. It returns false if compression is not in use
+// or the message does not shrink. The caller must hold the send lock.
+func (sch *SChannel) deflate(m []byte) (*[]byte, bool) {
+	if !sch.deflating || len(m) < minCompressSize {
+		return nil, false
+	}
+
+	out := getBuffer(len(m))
+	*out = (*out)[:0]
+	w := sliceWriter{p: out, limit: len(m) - 1}
+
+	if sch.fw == nil {
+		fw, err := flate.NewWriter(w, flate.DefaultCompression)
+		if err != nil {
+			putBuffer(out)
+			return nil, false
+		}
+		sch.fw = fw
+	} else {
+		sch.fw.Reset(w)
+	}
+
+	if _, err := sch.fw.Write(m); err != nil {
+		putBuffer(out)
+		return nil, false
+	}
+
+	if err := sch.fw.Close(); err != nil {
+		putBuffer(out)
+		return nil, false
+	}
+
+	return out, true
+}
+
+// inflate decompresses a payload into p, failing if it would expand
+// beyond len(p) bytes; this bounds the memory a decompression bomb can
+// consume. It returns the length of the decompressed message.
+func (sch *SChannel) inflate(p, payload []byte) (int, bool) {
+	if !sch.inflating {
+		return 0, false
+	}
+
+	src := bytes.NewReader(payload)
+	if sch.fr == nil {
+		sch.fr = flate.NewReader(src)
+	} else if err := sch.fr.(flate.Resetter).Reset(src, nil); err != nil {
+		return 0, false
+	}
+
+	var n int
+	for {
+		if n == len(p) {
+			// The message filled p; anything more is too large.
+			var extra [1]byte
+			if m, err := sch.fr.Read(extra[:]); m != 0 || err != io.EOF {
+				return 0, false
+			}
+			break
+		}
+
+		m, err := sch.fr.Read(p[n:])
+		n += m
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, false
+		}
+	}
+
+	return n, true
+}
+
+// SendUncompressed is like Send, but never compresses the message.
+// Compressing data that mixes secrets with attacker-controlled input
+// can leak the secrets through the length of the ciphertext, so such
+// messages should be sent with SendUncompressed.
+func (sch *SChannel) SendUncompressed(m []byte) bool {
+	if !sch.lockSend() {
+		return false
+	}
+	defer sch.smu.Unlock()
+	return sch.sendFlagged(NormalMessage, m, 0)
+}
@@ -0,0 +1,241 @@
+package schannel
+
+import (
+	"bytes"
+	"compress/flate"
+	"net"
+	"testing"
+)
+
+var compressible = bytes.Repeat([]byte(`{"sensor":"temperature","value":21.5}`), 64)
+
+// testCompressionPair sets up a pair of secure channels with the given
+// compression settings.
+func testCompressionPair(t *testing.T, dialer, listener bool) (*SChannel, *SChannel) {
+	return testTCPConfigPair(t, &Config{Compression: dialer},
+		&Config{Compression: listener})
+}
+
+func TestCompression(t *testing.T) {
+	alice, bob := testCompressionPair(t, true, true)
+
+	sent := alice.SData
+	if !alice.Send(compressible) {
+		t.Fatal("alice failed to send a message")
+	} else if alice.SData-sent >= uint64(len(compressible)) {
+		t.Fatal("the message should have been compressed")
+	}
+
+	m, ok := bob.Receive()
+	if !ok {
+		t.Fatal("bob failed to receive a compressed message")
+	} else if !bytes.Equal(m.Contents, compressible) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+
+	if !alice.Send(compressible) {
+		t.Fatal("alice failed to send a message")
+	}
+
+	p := make([]byte, len(compressible))
+	if _, n, ok := bob.ReceiveInto(p); !ok {
+		t.Fatal("bob failed to receive a compressed message")
+	} else if !bytes.Equal(p[:n], compressible) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+
+	// The decompressed message doesn't fit in p.
+	if !alice.Send(compressible) {
+		t.Fatal("alice failed to send a message")
+	} else if _, _, ok = bob.ReceiveInto(p[:len(p)-1]); ok {
+		t.Fatal("ReceiveInto should fail with a short buffer")
+	}
+
+	sent = alice.SData
+	if _, ok = alice.SendBuffer(nil, compressible); !ok {
+		t.Fatal("alice failed to send a message")
+	} else if alice.SData-sent >= uint64(len(compressible)) {
+		t.Fatal("SendBuffer should compress the message")
+	} else if m, ok = bob.Receive(); !ok || !bytes.Equal(m.Contents, compressible) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+
+	batch := [][]byte{compressible, message[:8], compressible}
+	sent = alice.SData
+	if !alice.SendBatch(batch) {
+		t.Fatal("alice failed to send a batch of messages")
+	} else if alice.SData-sent >= uint64(2*len(compressible)) {
+		t.Fatal("SendBatch should compress the messages")
+	}
+
+	for i := range batch {
+		if m, ok = bob.Receive(); !ok || !bytes.Equal(m.Contents, batch[i]) {
+			t.Fatal("bob didn't get the batch alice sent")
+		}
+	}
+
+	sent = alice.SData
+	if !alice.SendUncompressed(compressible) {
+		t.Fatal("alice failed to send a message")
+	} else if alice.SData-sent < uint64(len(compressible)) {
+		t.Fatal("the message should not have been compressed")
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	alice, bob := testCompressionPair(t, true, false)
+
+	sent := alice.SData
+	if !alice.Send(compressible) {
+		t.Fatal("alice failed to send a message")
+	} else if alice.SData-sent < uint64(len(compressible)) {
+		t.Fatal("alice should not compress for a peer without compression")
+	}
+
+	if m, ok := bob.Receive(); !ok {
+		t.Fatal("bob failed to receive a message")
+	} else if !bytes.Equal(m.Contents, compressible) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+
+	// Bob refuses compressed messages that he didn't ask for.
+	z := deflateTest(t, compressible)
+	alice.smu.Lock()
+	ok := alice.sendFlagged(NormalMessage, z, flagCompressed)
+	alice.smu.Unlock()
+	if !ok {
+		t.Fatal("alice failed to send a message")
+	} else if _, ok = bob.Receive(); ok {
+		t.Fatal("bob should refuse a compressed message")
+	}
+}
+
+// TestCompressionPipe checks that compression is agreed on during the
+// key exchange, over a channel that can't buffer anything, so that the
+// first message is compressed.
+func TestCompressionPipe(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	results := make(chan handshakeResult, 1)
+	go func() {
+		sch, err := ListenConfig(b, &Config{Compression: true})
+		results <- handshakeResult{sch, err == nil}
+	}()
+
+	alice, err := DialConfig(a, &Config{Compression: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer alice.Zero()
+
+	listener := <-results
+	if !listener.ok {
+		t.Fatal("listener failed to complete the key exchange")
+	}
+	bob := listener.sch
+	defer bob.Zero()
+
+	if !alice.deflating || !bob.deflating {
+		t.Fatal("compression should be agreed on in the key exchange")
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		m, _ := bob.Receive()
+		if m == nil {
+			received <- nil
+			return
+		}
+		received <- m.Contents
+	}()
+
+	if !alice.Send(compressible) {
+		t.Fatal("alice failed to send a message")
+	} else if alice.SData >= uint64(len(compressible)) {
+		t.Fatal("alice should compress the first message")
+	}
+
+	if m := <-received; !bytes.Equal(m, compressible) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+}
+
+func TestFeatureBits(t *testing.T) {
+	var sk [kexPrvSize]byte
+	var pk [kexPubSize]byte
+	if !generateKeypair(&sk, &pk) {
+		t.Fatal("failed to generate a keypair")
+	}
+
+	alice := &SChannel{inflating: true}
+	bob := &SChannel{inflating: true}
+	marked := pk
+	alice.markFeatures(marked[:])
+	if marked == pk {
+		t.Fatal("alice's features should be marked in her public keys")
+	}
+
+	bob.takeFeatures(marked[:])
+	if marked != pk {
+		t.Fatal("bob should clear the feature bits from alice's public keys")
+	} else if !bob.deflating {
+		t.Fatal("bob should compress messages to alice")
+	}
+
+	// A peer that doesn't know about features never sets the bits.
+	carol := &SChannel{inflating: true}
+	carol.takeFeatures(pk[:])
+	if carol.deflating {
+		t.Fatal("carol should not compress messages to an old peer")
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	cfg := &Config{Compression: true, MaxMessageSize: 4096}
+	alice, bob := testTCPConfigPair(t, cfg, cfg)
+
+	// The compressed message is small, but expands beyond the
+	// maximum message size.
+	z := deflateTest(t, make([]byte, 8192))
+	alice.smu.Lock()
+	ok := alice.sendFlagged(NormalMessage, z, flagCompressed)
+	alice.smu.Unlock()
+	if !ok {
+		t.Fatal("alice failed to send a message")
+	} else if _, ok = bob.Receive(); ok {
+		t.Fatal("bob should refuse a decompression bomb")
+	}
+}
+
+func TestCompressedEnvelope(t *testing.T) {
+	if _, ok := appendMessage(nil, 1, NormalMessage, message, 0, flagCompressed); !ok {
+		t.Fatal("failed to pack a compressed message")
+	}
+
+	if _, ok := appendMessage(nil, 1, KEXMessage, message, 0, flagCompressed); ok {
+		t.Fatal("only normal messages may be compressed")
+	}
+
+	if _, ok := appendMessage(nil, 1, NormalMessage, message, 0, 2); ok {
+		t.Fatal("appendMessage should fail with unknown flags")
+	}
+
+	out := testPackMessage(1, 1, extendedVersion, flagCompressed, KEXMessage, []byte{1})
+	if _, ok := unpackMessage(out); ok {
+		t.Fatal("unpackMessage should fail with a compressed key exchange")
+	}
+}
+
+func deflateTest(t *testing.T, m []byte) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	w.Write(m)
+	w.Close()
+	return buf.Bytes()
+}
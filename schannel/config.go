@@ -0,0 +1,256 @@
+package schannel
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+var (
+	// ErrNoChannel is returned when no insecure channel was
+	// provided to set up a secure channel over.
+	ErrNoChannel = errors.New("schannel: no channel was provided")
+
+	// ErrKeyExchange is returned when the key exchange with the peer
+	// failed, either due to an I/O error or because the peer could
+	// not be authenticated.
+	ErrKeyExchange = errors.New("schannel: key exchange failed")
+
+	// ErrInvalidPSK is returned when a pre-shared key is configured
+	// without a key, or with an identity hint that is too long.
+	ErrInvalidPSK = errors.New("schannel: invalid pre-shared key")
+
+	// ErrMessageSize is returned when the maximum message size is
+	// smaller than MinMessageSize or larger than BufSize.
+	ErrMessageSize = errors.New("schannel: invalid maximum message size")
+
+	// ErrReassemblySize is returned when the maximum reassembly size
+	// is negative.
+	ErrReassemblySize = errors.New("schannel: invalid maximum reassembly size")
+
+	// ErrKeepalive is returned when the keepalive interval or
+	// timeout is negative, or the timeout is not longer than the
+	// interval.
+	ErrKeepalive = errors.New("schannel: invalid keepalive settings")
+
+	// ErrCoverInterval is returned when the cover traffic interval
+	// is negative.
+	ErrCoverInterval = errors.New("schannel: invalid cover traffic interval")
+
+	// ErrTicketLifetime is returned when the session ticket lifetime
+	// is negative.
+	ErrTicketLifetime = errors.New("schannel: invalid ticket lifetime")
+)
+
+// A Config is used to configure a secure channel; it is passed to
+// DialConfig and ListenConfig. The same Config may be shared by
+// several channels, and should not be modified once it is in use.
+// The zero value is a valid configuration for an unauthenticated
+// secure channel.
+type Config struct {
+	// Signer, if not nil, is used to sign the key exchange.
+	Signer *[IdentityPrivateSize]byte
+
+	// Peer, if not nil, is used to verify the signature on the
+	// peer's key exchange.
+	Peer *[IdentityPublicSize]byte
+
+	// PSK, if not nil, is mixed into the session keys. A dialer
+	// sends its identity hint to the listener; a listener without
+	// a PSKLookup will only accept a dialer using the same hint.
+	PSK *PSK
+
+	// PSKLookup, if not nil, is used by a listener to select the
+	// pre-shared key for the identity hint sent by the dialer. It
+	// is ignored when dialing.
+	PSKLookup PSKLookup
+
+	// MaxMessageSize is the size of the largest message that may
+	// be sent or received. Larger incoming messages cause Receive to
+	// fail, so both peers should use the same value. If zero,
+	// BufSize is used. Buffers for incoming messages are only as
+	// large as the messages being received, and are shared between
+	// channels when idle.
+	MaxMessageSize int
+
+	// MaxReassemblySize is the size of the largest message that
+	// ReceiveLarge will reassemble from fragments; this bounds the
+	// memory a peer can make the receiver allocate. If zero,
+	// DefaultMaxReassemblySize is used.
+	MaxReassemblySize int
+
+	// KeepaliveInterval, if not zero, is how often a ping is sent
+	// to the peer. Pongs are consumed by Receive, so keepalives
+	// only work while another goroutine is receiving, as a Session
+	// does; the peer only times out while a Receive is waiting for
+	// it. Peers always answer pings, whatever their own settings.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveTimeout is how long the peer may go without sending
+	// anything before the channel is torn down; Err will then
+	// return ErrPeerTimeout. If zero, DefaultKeepaliveTimeouts
+	// intervals are used. It is ignored without an interval. A
+	// blocked Receive only returns if the Channel is an io.Closer or
+	// has a SetReadDeadline method, as a net.Conn does.
+	KeepaliveTimeout time.Duration
+
+	// Padding, if not nil, chooses how much padding is added to
+	// each message sent, hiding its length from an observer. Peers
+	// always accept padded messages, whatever their own settings.
+	Padding PaddingPolicy
+
+	// CoverInterval, if not zero, is the average interval between
+	// cover messages, which carry no data and are discarded by the
+	// peer. Cover messages are padded like any other message.
+	CoverInterval time.Duration
+
+	// Compression, if true, allows messages to be compressed with
+	// DEFLATE when both peers enable it. Messages sent with Send are
+	// compressed if that makes them smaller; decompressed messages
+	// are limited to the maximum message size. Compression can leak
+	// secrets through message lengths when they are mixed with data
+	// an attacker controls; such messages should be sent with
+	// SendUncompressed.
+	Compression bool
+
+	// Resumption, if true, tells the listener that the dialer
+	// supports session resumption; the listener must have
+	// TicketKeys. It is implied by Ticket.
+	Resumption bool
+
+	// Ticket, if not nil, is presented by a dialer to resume an
+	// earlier session without verifying signatures. If the ticket
+	// has expired, was issued for a different Peer, or is refused
+	// by the listener, a full handshake is done instead.
+	Ticket *Ticket
+
+	// TicketKeys, if not nil, are used by a listener to issue
+	// session tickets to dialers using resumption, and to open the
+	// tickets they present. Dialers must set Resumption.
+	TicketKeys *TicketKeys
+
+	// TicketLifetime is how long a listener accepts the tickets it
+	// issues. If zero, DefaultTicketLifetime is used.
+	TicketLifetime time.Duration
+
+	// Events, if not nil, is called for each Event in the life of
+	// the secure channel, such as the key exchange, key rotation
+	// and rejected messages. It may be called from several
+	// goroutines at once, and should return quickly.
+	Events func(Event)
+
+	// Logger, if not nil, logs each Event. Failures are logged as
+	// warnings, and the start of the key exchange and zeroisation
+	// at debug level.
+	Logger *slog.Logger
+}
+
+// validate reports whether the configuration can be used to set up a
+// secure channel.
+func (cfg *Config) validate() error {
+	if cfg.PSK != nil {
+		if cfg.PSK.Key == nil {
+			return ErrInvalidPSK
+		} else if len(cfg.PSK.Identity) > MaxPSKIdentitySize {
+			return ErrInvalidPSK
+		}
+	}
+
+	if cfg.MaxMessageSize != 0 {
+		if cfg.MaxMessageSize < MinMessageSize || cfg.MaxMessageSize > BufSize {
+			return ErrMessageSize
+		}
+	}
+
+	if cfg.MaxReassemblySize < 0 {
+		return ErrReassemblySize
+	}
+
+	if cfg.KeepaliveInterval < 0 || cfg.KeepaliveTimeout < 0 {
+		return ErrKeepalive
+	} else if cfg.KeepaliveTimeout != 0 && cfg.KeepaliveTimeout <= cfg.KeepaliveInterval {
+		return ErrKeepalive
+	}
+
+	if cfg.CoverInterval < 0 {
+		return ErrCoverInterval
+	}
+
+	if cfg.TicketLifetime < 0 {
+		return ErrTicketLifetime
+	}
+
+	return nil
+}
+
+// validateDatagram is like validate, but also checks that the
+// configuration can be used in datagram mode.
+func (cfg *Config) validateDatagram() error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	if cfg.Resumption || cfg.Ticket != nil || cfg.TicketKeys != nil {
+		return ErrDatagram
+	}
+
+	if cfg.MaxMessageSize > MaxDatagramMessageSize {
+		return ErrMessageSize
+	}
+	return nil
+}
+
+func (cfg *Config) maxDatagramMessageSize() int {
+	if cfg.MaxMessageSize == 0 {
+		return DefaultDatagramMessageSize
+	}
+	return cfg.MaxMessageSize
+}
+
+func (cfg *Config) maxMessageSize() int {
+	if cfg.MaxMessageSize == 0 {
+		return BufSize
+	}
+	return cfg.MaxMessageSize
+}
+
+func (cfg *Config) maxReassemblySize() int {
+	if cfg.MaxReassemblySize == 0 {
+		return DefaultMaxReassemblySize
+	}
+	return cfg.MaxReassemblySize
+}
+
+func (cfg *Config) keepaliveTimeout() time.Duration {
+	if cfg.KeepaliveTimeout == 0 {
+		return DefaultKeepaliveTimeouts * cfg.KeepaliveInterval
+	}
+	return cfg.KeepaliveTimeout
+}
+
+func (cfg *Config) ticketLifetime() time.Duration {
+	if cfg.TicketLifetime == 0 {
+		return DefaultTicketLifetime
+	}
+	return cfg.TicketLifetime
+}
+
+// pskLookup returns the PSKLookup a listener should use, if any.
+func (cfg *Config) pskLookup() PSKLookup {
+	if cfg.PSKLookup != nil {
+		return cfg.PSKLookup
+	}
+
+	if cfg.PSK == nil {
+		return nil
+	}
+
+	psk := cfg.PSK
+	return func(identity []byte) *[PSKSize]byte {
+		if !bytes.Equal(identity, psk.Identity) {
+			return nil
+		}
+		return psk.Key
+	}
+}
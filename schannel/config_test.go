@@ -0,0 +1,135 @@
+package schannel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kisom/testio"
+)
+
+func TestConfigValidate(t *testing.T) {
+	var key [PSKSize]byte
+
+	var tests = []struct {
+		cfg *Config
+		err error
+	}{
+		{&Config{}, nil},
+		{&Config{PSK: &PSK{Key: &key}}, nil},
+		{&Config{PSK: &PSK{}}, ErrInvalidPSK},
+		{&Config{PSK: &PSK{
+			Identity: make([]byte, MaxPSKIdentitySize+1),
+			Key:      &key,
+		}}, ErrInvalidPSK},
+		{&Config{MaxMessageSize: 4096}, nil},
+		{&Config{MaxMessageSize: MinMessageSize}, nil},
+		{&Config{MaxMessageSize: MinMessageSize - 1}, ErrMessageSize},
+		{&Config{MaxMessageSize: BufSize + 1}, ErrMessageSize},
+		{&Config{MaxMessageSize: -1}, ErrMessageSize},
+		{&Config{KeepaliveInterval: time.Second}, nil},
+		{&Config{KeepaliveInterval: time.Second, KeepaliveTimeout: 2 * time.Second}, nil},
+		{&Config{KeepaliveInterval: -time.Second}, ErrKeepalive},
+		{&Config{KeepaliveInterval: time.Second, KeepaliveTimeout: time.Second}, ErrKeepalive},
+		{&Config{KeepaliveTimeout: -time.Second}, ErrKeepalive},
+	}
+
+	for i, test := range tests {
+		if err := test.cfg.validate(); err != test.err {
+			t.Fatalf("test %d: expected %v, have %v", i, test.err, err)
+		}
+
+		if test.err == nil {
+			continue
+		}
+
+		if _, err := DialConfig(&bytes.Buffer{}, test.cfg); err != test.err {
+			t.Fatalf("test %d: DialConfig: expected %v, have %v",
+				i, test.err, err)
+		}
+
+		if _, err := ListenConfig(&bytes.Buffer{}, test.cfg); err != test.err {
+			t.Fatalf("test %d: ListenConfig: expected %v, have %v",
+				i, test.err, err)
+		}
+	}
+}
+
+func TestConfigNoChannel(t *testing.T) {
+	if _, err := DialConfig(nil, nil); err != ErrNoChannel {
+		t.Fatalf("expected %v, have %v", ErrNoChannel, err)
+	}
+
+	if _, err := ListenConfig(nil, nil); err != ErrNoChannel {
+		t.Fatalf("expected %v, have %v", ErrNoChannel, err)
+	}
+}
+
+func TestConfigKeyExchangeFailure(t *testing.T) {
+	if _, err := DialConfig(testio.NewBufferConn(), nil); err != ErrKeyExchange {
+		t.Fatalf("expected %v, have %v", ErrKeyExchange, err)
+	}
+
+	if _, err := ListenConfig(testio.NewBufferConn(), nil); err != ErrKeyExchange {
+		t.Fatalf("expected %v, have %v", ErrKeyExchange, err)
+	}
+}
+
+func TestConfigSharedPSK(t *testing.T) {
+	var key [PSKSize]byte
+	key[0] = 42
+	cfg := &Config{PSK: &PSK{Identity: []byte("gateway"), Key: &key}}
+
+	dialer, listener := testHandshake(func(ch Channel) (*SChannel, bool) {
+		sch, err := DialConfig(ch, cfg)
+		return sch, err == nil
+	}, func(ch Channel) (*SChannel, bool) {
+		sch, err := ListenConfig(ch, cfg)
+		return sch, err == nil
+	})
+	if !dialer.ok || !listener.ok {
+		t.Fatal("failed to set up secure channel from a shared Config")
+	}
+
+	go listener.sch.Send(message)
+	m, ok := dialer.sch.Receive()
+	if !ok {
+		t.Fatal("failed to receive message")
+	} else if !bytes.Equal(m.Contents, message) {
+		t.Fatal("dialer didn't get the message the listener sent")
+	}
+	dialer.sch.Channel.(net.Conn).Close()
+}
+
+func TestConfigMaxMessageSize(t *testing.T) {
+	small := &Config{MaxMessageSize: 128}
+	dialer, listener := testHandshake(func(ch Channel) (*SChannel, bool) {
+		sch, err := DialConfig(ch, small)
+		return sch, err == nil
+	}, func(ch Channel) (*SChannel, bool) {
+		sch, err := ListenConfig(ch, nil)
+		return sch, err == nil
+	})
+	if !dialer.ok || !listener.ok {
+		t.Fatal("failed to set up secure channel")
+	}
+	defer dialer.sch.Channel.(net.Conn).Close()
+
+	if dialer.sch.MaxMessageSize() != 128 {
+		t.Fatalf("expected a maximum message size of 128, have %d",
+			dialer.sch.MaxMessageSize())
+	} else if listener.sch.MaxMessageSize() != BufSize {
+		t.Fatalf("expected a maximum message size of %d, have %d",
+			BufSize, listener.sch.MaxMessageSize())
+	}
+
+	if dialer.sch.Send(message) {
+		t.Fatal("dialer should not send messages larger than its limit")
+	}
+
+	go listener.sch.Send(message)
+	if _, ok := dialer.sch.Receive(); ok {
+		t.Fatal("dialer should not receive messages larger than its limit")
+	}
+}
@@ -0,0 +1,334 @@
+package schannel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// ErrDatagram is returned when a Config option that needs a reliable
+// stream, such as session resumption, is used in datagram mode.
+var ErrDatagram = errors.New("schannel: option not supported in datagram mode")
+
+const (
+	// DefaultDatagramMessageSize is the default maximum message size
+	// in datagram mode; a sealed message of this size fits in a
+	// datagram on most networks without fragmentation.
+	DefaultDatagramMessageSize = 1024
+
+	// MaxDatagramMessageSize is the largest maximum message size
+	// that may be used in datagram mode.
+	MaxDatagramMessageSize = 65507 - frameHeaderSize - Overhead
+
+	// replayWindowSize is the number of sequence numbers, up to
+	// the highest received so far, that may arrive out of order.
+	replayWindowSize = 64
+
+	// handshakeRetransmit is the initial time a dialer waits for
+	// the listener's reply before retransmitting its key exchange;
+	// the wait doubles with each attempt.
+	handshakeRetransmit = 250 * time.Millisecond
+
+	// handshakeAttempts is the number of times a dialer sends its
+	// key exchange before giving up.
+	handshakeAttempts = 6
+)
+
+// A replayWindow tracks which of the most recent sequence numbers have
+// been received, so that messages may arrive out of order but not
+// more than once.
+type replayWindow struct {
+	top    uint32
+	bitmap uint64
+}
+
+// accept returns true if seq has not been seen and is recent enough to
+// be tracked, and records it.
+func (w *replayWindow) accept(seq uint32) bool {
+	if seq == 0 {
+		return false
+	}
+
+	if seq > w.top {
+		shift := seq - w.top
+		if shift >= replayWindowSize {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.top = seq
+		return true
+	}
+
+	diff := w.top - seq
+	if diff >= replayWindowSize {
+		return false
+	}
+
+	bit := uint64(1) << diff
+	if w.bitmap&bit != 0 {
+		return false
+	}
+	w.bitmap |= bit
+	return true
+}
+
+// A packetChannel is the Channel for a secure channel in datagram
+// mode. Each Write sends one datagram to the peer, and each Read
+// returns one datagram from the peer; datagrams from other addresses
+// are ignored.
+type packetChannel struct {
+	pc    net.PacketConn
+	raddr net.Addr
+}
+
+func (ch *packetChannel) Read(p []byte) (int, error) {
+	for {
+		n, addr, err := ch.pc.ReadFrom(p)
+		if err != nil {
+			return 0, err
+		}
+
+		if addr.String() == ch.raddr.String() {
+			return n, nil
+		}
+	}
+}
+
+func (ch *packetChannel) Write(p []byte) (int, error) {
+	return ch.pc.WriteTo(p, ch.raddr)
+}
+
+func (ch *packetChannel) Close() error {
+	return ch.pc.Close()
+}
+
+func (ch *packetChannel) SetReadDeadline(t time.Time) error {
+	return ch.pc.SetReadDeadline(t)
+}
+
+// A packetHandshake lets the dialer's key exchange run over datagrams.
+// Writes are collected into a single request, which is sent when the
+// reply is first read, and retransmitted until a reply arrives.
+type packetHandshake struct {
+	ch   *packetChannel
+	req  []byte
+	resp *bytes.Reader
+}
+
+func (h *packetHandshake) Write(p []byte) (int, error) {
+	h.req = append(h.req, p...)
+	return len(p), nil
+}
+
+func (h *packetHandshake) Read(p []byte) (int, error) {
+	if h.resp == nil {
+		if err := h.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	return h.resp.Read(p)
+}
+
+func (h *packetHandshake) exchange() error {
+	defer h.ch.SetReadDeadline(time.Time{})
+
+	reply := make([]byte, kexPubSize+SignatureSize+1)
+	wait := handshakeRetransmit
+	for i := 0; i < handshakeAttempts; i++ {
+		if _, err := h.ch.Write(h.req); err != nil {
+			return err
+		}
+
+		h.ch.SetReadDeadline(time.Now().Add(wait))
+		n, err := h.ch.Read(reply)
+		if err == nil {
+			h.resp = bytes.NewReader(reply[:n])
+			return nil
+		}
+
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			return err
+		}
+		wait *= 2
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// DialPacket sets up a secure channel in datagram mode with the peer
+// at raddr, using the settings in cfg. Each message is sent in its own
+// datagram; messages may be lost or arrive out of order, but are never
+// delivered twice. The key exchange is retransmitted if the reply is
+// lost. Key rotation and session resumption are not supported in
+// datagram mode, and fragmented messages are only reassembled if no
+// fragment is lost.
+func DialPacket(pc net.PacketConn, raddr net.Addr, cfg *Config) (*SChannel, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	if err := cfg.validateDatagram(); err != nil {
+		return nil, err
+	}
+
+	if pc == nil || raddr == nil {
+		return nil, ErrNoChannel
+	}
+
+	ch := &packetChannel{pc: pc, raddr: raddr}
+	var sch = &SChannel{}
+	sch.reset()
+	sch.maxSize = cfg.maxDatagramMessageSize()
+	sch.maxReassembly = cfg.maxReassemblySize()
+	sch.datagram = true
+	sch.dialer = true
+	sch.inflating = cfg.Compression
+	sch.setEvents(cfg, ch, raddr)
+	sch.event(EventHandshakeStart, nil)
+
+	if !sch.dialKEX(&packetHandshake{ch: ch}, cfg.Signer, cfg.Peer, cfg.PSK) {
+		return nil, sch.abort(ErrKeyExchange)
+	}
+
+	sch.Channel = ch
+	sch.ready = true
+	sch.pad = cfg.Padding
+	sch.startKeepalive(cfg.KeepaliveInterval, cfg.keepaliveTimeout())
+	sch.startCover(cfg.CoverInterval, sch.maxSize)
+	sch.event(EventHandshakeComplete, nil)
+	return sch, nil
+}
+
+// ListenPacket waits for a dialer to set up a secure channel in
+// datagram mode, using the settings in cfg. The channel is bound to
+// the address the key exchange came from. Datagrams that do not carry
+// a valid key exchange are ignored, so ListenPacket only returns an
+// error if reading from pc fails. The listener must be receiving in
+// order to answer a retransmitted key exchange.
+func ListenPacket(pc net.PacketConn, cfg *Config) (*SChannel, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	if err := cfg.validateDatagram(); err != nil {
+		return nil, err
+	}
+
+	if pc == nil {
+		return nil, ErrNoChannel
+	}
+
+	maxSize := cfg.maxDatagramMessageSize()
+	p := make([]byte, kexPubSize+SignatureSize+1+MaxPSKIdentitySize+1)
+	for {
+		n, raddr, err := pc.ReadFrom(p)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp bytes.Buffer
+		hs := struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(p[:n]), &resp}
+
+		var sch = &SChannel{}
+		sch.reset()
+		sch.maxSize = maxSize
+		sch.maxReassembly = cfg.maxReassemblySize()
+		sch.datagram = true
+		sch.inflating = cfg.Compression
+		sch.setEvents(cfg, nil, raddr)
+		sch.event(EventHandshakeStart, nil)
+
+		if !sch.listenKEX(hs, cfg.Signer, cfg.Peer, cfg.pskLookup()) {
+			sch.abort(ErrKeyExchange)
+			continue
+		}
+
+		ch := &packetChannel{pc: pc, raddr: raddr}
+		if _, err = ch.Write(resp.Bytes()); err != nil {
+			return nil, sch.abort(err)
+		}
+
+		// The reply is kept until the dialer is heard from, in
+		// case it is lost and the dialer retransmits.
+		sch.hsReq = append([]byte(nil), p[:n]...)
+		sch.hsResp = append([]byte(nil), resp.Bytes()...)
+		sch.Channel = ch
+		sch.ready = true
+		sch.pad = cfg.Padding
+		sch.startKeepalive(cfg.KeepaliveInterval, cfg.keepaliveTimeout())
+		sch.startCover(cfg.CoverInterval, sch.maxSize)
+		sch.event(EventHandshakeComplete, nil)
+		return sch, nil
+	}
+}
+
+// openDatagram reads datagrams until one carries a frame that can be
+// decrypted into buf. Lost, truncated, forged and duplicated datagrams
+// are dropped rather than failing the channel.
+func (sch *SChannel) openDatagram(buf []byte) ([]byte, bool) {
+	// The extra byte detects datagrams that were truncated.
+	box := getBuffer(frameHeaderSize + sch.maxSize + Overhead + 1)
+	defer putBuffer(box)
+
+	for {
+		n, err := sch.Channel.Read(*box)
+		if err != nil {
+			return nil, false
+		}
+		d := (*box)[:n]
+
+		if sch.hsReq != nil && bytes.Equal(d, sch.hsReq) {
+			sch.smu.Lock()
+			sch.Channel.Write(sch.hsResp)
+			sch.smu.Unlock()
+			continue
+		}
+
+		if n <= frameHeaderSize+nonceSize || n == len(*box) {
+			continue
+		} else if binary.BigEndian.Uint32(d) != uint32(n-frameHeaderSize) {
+			continue
+		}
+
+		var nonce [nonceSize]byte
+		copy(nonce[:], d[frameHeaderSize:])
+		out, ok := secretbox.Open(buf[:0], d[frameHeaderSize+nonceSize:], &nonce, &sch.rkey)
+		if !ok {
+			sch.event(EventDecryptFailed, nil)
+			continue
+		}
+
+		// The dialer has the session keys, so it will not
+		// retransmit its key exchange.
+		sch.hsReq, sch.hsResp = nil, nil
+		atomic.AddUint64(&sch.RData, uint64(len(out)))
+		countReceived(len(out))
+		return out, true
+	}
+}
+
+// writeDatagrams sends each of the sealed frames in its own datagram.
+func (sch *SChannel) writeDatagrams(frames []byte) bool {
+	for len(frames) > 0 {
+		n := frameHeaderSize + int(binary.BigEndian.Uint32(frames))
+		if _, err := sch.Channel.Write(frames[:n]); err != nil {
+			return false
+		}
+		frames = frames[n:]
+	}
+	return true
+}
+
+// Datagram returns true if the secure channel is in datagram mode.
+func (sch *SChannel) Datagram() bool {
+	return sch.datagram
+}
@@ -0,0 +1,264 @@
+package schannel
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+)
+
+// testPacketConn records the datagrams written to it, and drops the
+// first few.
+type testPacketConn struct {
+	net.PacketConn
+
+	mu   sync.Mutex
+	drop int
+	sent [][]byte
+}
+
+func (pc *testPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	pc.mu.Lock()
+	pc.sent = append(pc.sent, append([]byte(nil), p...))
+	drop := pc.drop > 0
+	if drop {
+		pc.drop--
+	}
+	pc.mu.Unlock()
+
+	if drop {
+		return len(p), nil
+	}
+	return pc.PacketConn.WriteTo(p, addr)
+}
+
+// testPacketConns returns a pair of loopback UDP sockets for the
+// listener and dialer, which are closed when the test finishes.
+func testPacketConns(t *testing.T) (*testPacketConn, *testPacketConn) {
+	lconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	dconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		lconn.Close()
+		t.Fatalf("%v", err)
+	}
+
+	t.Cleanup(func() {
+		lconn.Close()
+		dconn.Close()
+	})
+	return &testPacketConn{PacketConn: lconn}, &testPacketConn{PacketConn: dconn}
+}
+
+// testDatagramPair sets up a pair of secure channels in datagram mode
+// over loopback UDP sockets.
+func testDatagramPair(t *testing.T) (*SChannel, *SChannel, *testPacketConn) {
+	return testDatagramConfigPair(t, nil, nil)
+}
+
+// testDatagramConfigPair is like testDatagramPair, but sets up the
+// secure channels with the given configurations.
+func testDatagramConfigPair(t *testing.T, dcfg, lcfg *Config) (*SChannel, *SChannel, *testPacketConn) {
+	lpc, dpc := testPacketConns(t)
+
+	results := make(chan handshakeResult, 1)
+	go func() {
+		sch, err := ListenPacket(lpc, lcfg)
+		results <- handshakeResult{sch, err == nil}
+	}()
+
+	dialer, err := DialPacket(dpc, lpc.LocalAddr(), dcfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	listener := <-results
+	if !listener.ok {
+		t.Fatal("failed to set up secure channel")
+	}
+	return dialer, listener.sch, dpc
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	var tests = []struct {
+		seq uint32
+		ok  bool
+	}{
+		{0, false},
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{2, false},
+		{100, true},
+		{36, false},
+		{37, true},
+		{99, true},
+		{37, false},
+	}
+
+	for i, test := range tests {
+		if w.accept(test.seq) != test.ok {
+			t.Fatalf("test %d: sequence %d should have been accepted=%v",
+				i, test.seq, test.ok)
+		}
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	dialer, listener, _ := testDatagramPair(t)
+
+	if !dialer.Datagram() || !listener.Datagram() {
+		t.Fatal("channels should be in datagram mode")
+	} else if dialer.MaxMessageSize() != DefaultDatagramMessageSize {
+		t.Fatal("datagram mode should use a smaller default message size")
+	}
+
+	if !dialer.SendBatch([][]byte{message[:64], message[64:128]}) {
+		t.Fatal("dialer failed to send messages")
+	}
+
+	for _, want := range [][]byte{message[:64], message[64:128]} {
+		m, ok := listener.Receive()
+		if !ok {
+			t.Fatal("listener failed to receive a message")
+		} else if !bytes.Equal(m.Contents, want) {
+			t.Fatal("listener didn't get the message the dialer sent")
+		}
+	}
+
+	if !listener.Send(message) {
+		t.Fatal("listener failed to send a message")
+	}
+
+	if m, ok := dialer.Receive(); !ok || !bytes.Equal(m.Contents, message) {
+		t.Fatal("dialer didn't get the message the listener sent")
+	}
+
+	if dialer.Rekey() {
+		t.Fatal("keys cannot be rotated in datagram mode")
+	}
+}
+
+func TestDatagramPadding(t *testing.T) {
+	dialer, listener, dpc := testDatagramConfigPair(t,
+		&Config{Padding: PadToMultiple(256)}, nil)
+
+	var sizes []int
+	for _, n := range []int{1, 100, 200} {
+		if !dialer.Send(message[:n]) {
+			t.Fatal("dialer failed to send a message")
+		}
+
+		dpc.mu.Lock()
+		sizes = append(sizes, len(dpc.sent[len(dpc.sent)-1]))
+		dpc.mu.Unlock()
+
+		if m, ok := listener.Receive(); !ok || !bytes.Equal(m.Contents, message[:n]) {
+			t.Fatal("listener didn't get the message the dialer sent")
+		}
+	}
+
+	if sizes[0] != sizes[1] || sizes[1] != sizes[2] {
+		t.Fatalf("padded datagrams should have the same length: %v", sizes)
+	}
+}
+
+func TestDatagramHandshakeLoss(t *testing.T) {
+	lpc, dpc := testPacketConns(t)
+
+	// The listener's first reply is lost, so the dialer must
+	// retransmit its key exchange, which the listener answers
+	// while receiving.
+	lpc.drop = 1
+	received := make(chan []byte, 1)
+	go func() {
+		listener, err := ListenPacket(lpc, nil)
+		if err != nil {
+			received <- nil
+			return
+		}
+
+		m, ok := listener.Receive()
+		if !ok {
+			received <- nil
+			return
+		}
+		received <- m.Contents
+	}()
+
+	dialer, err := DialPacket(dpc, lpc.LocalAddr(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if !dialer.Send(message) {
+		t.Fatal("dialer failed to send a message")
+	} else if !bytes.Equal(<-received, message) {
+		t.Fatal("listener didn't get the message the dialer sent")
+	}
+
+	lpc.mu.Lock()
+	defer lpc.mu.Unlock()
+	if len(lpc.sent) < 2 || !bytes.Equal(lpc.sent[0], lpc.sent[1]) {
+		t.Fatal("the listener should resend its original reply")
+	}
+}
+
+func TestDatagramReplay(t *testing.T) {
+	dialer, listener, dpc := testDatagramPair(t)
+
+	dpc.mu.Lock()
+	start := len(dpc.sent)
+	dpc.drop = 2
+	dpc.mu.Unlock()
+
+	// The two messages are held back, then delivered out of order,
+	// with a replay of each.
+	dialer.Send(message[:8])
+	dialer.Send(message[8:16])
+
+	dpc.mu.Lock()
+	first, second := dpc.sent[start], dpc.sent[start+1]
+	dpc.mu.Unlock()
+
+	raddr := dialer.Channel.(*packetChannel).raddr
+	for _, d := range [][]byte{second, first, second, first} {
+		dpc.PacketConn.WriteTo(d, raddr)
+	}
+	dialer.Send(message[16:24])
+
+	for _, want := range [][]byte{message[8:16], message[:8], message[16:24]} {
+		m, ok := listener.Receive()
+		if !ok {
+			t.Fatal("listener failed to receive a message")
+		} else if !bytes.Equal(m.Contents, want) {
+			t.Fatalf("expected %q, have %q", want, m.Contents)
+		}
+	}
+}
+
+func TestDatagramConfig(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer pc.Close()
+
+	if _, err = DialPacket(pc, pc.LocalAddr(), &Config{Resumption: true}); err != ErrDatagram {
+		t.Fatalf("expected %v, have %v", ErrDatagram, err)
+	}
+
+	cfg := &Config{MaxMessageSize: MaxDatagramMessageSize + 1}
+	if _, err = ListenPacket(pc, cfg); err != ErrMessageSize {
+		t.Fatalf("expected %v, have %v", ErrMessageSize, err)
+	}
+
+	if _, err = DialPacket(nil, pc.LocalAddr(), nil); err != ErrNoChannel {
+		t.Fatalf("expected %v, have %v", ErrNoChannel, err)
+	}
+}
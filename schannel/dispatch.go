@@ -0,0 +1,102 @@
+package schannel
+
+import "sync"
+
+// SendType is like Send, but sends the message with an application
+// message type, which the peer's Receive returns unchanged. It fails
+// if t is not an application message type.
+func (sch *SChannel) SendType(t MessageType, m []byte) bool {
+	if !t.Application() {
+		return false
+	}
+	return sch.send(t, m)
+}
+
+// A HandlerFunc handles a message received by a Dispatcher.
+type HandlerFunc func(m *Message)
+
+// A Dispatcher routes received messages to the handler registered for
+// their type. Handlers may be registered while the dispatcher is
+// running.
+type Dispatcher struct {
+	mu       sync.RWMutex
+	handlers map[MessageType]HandlerFunc
+	fallback HandlerFunc
+}
+
+// NewDispatcher returns a Dispatcher with no handlers.
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{handlers: map[MessageType]HandlerFunc{}}
+}
+
+// Handle registers h as the handler for messages of type t, replacing
+// any previous handler. If h is nil, the handler is removed. Only
+// normal and application messages may be handled; the rest are used
+// by the secure channel itself.
+func (d *Dispatcher) Handle(t MessageType, h HandlerFunc) bool {
+	if t != NormalMessage && !t.Application() {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if h == nil {
+		delete(d.handlers, t)
+	} else {
+		d.handlers[t] = h
+	}
+	return true
+}
+
+// HandleDefault registers h as the handler for messages that have no
+// handler of their own. Without a default handler, such messages are
+// discarded.
+func (d *Dispatcher) HandleDefault(h HandlerFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fallback = h
+}
+
+// Dispatch passes m to the handler for its type. It returns false if
+// there was no handler for the message.
+func (d *Dispatcher) Dispatch(m *Message) bool {
+	d.mu.RLock()
+	h, ok := d.handlers[m.Type]
+	if !ok {
+		h = d.fallback
+	}
+	d.mu.RUnlock()
+
+	if h == nil {
+		return false
+	}
+
+	h(m)
+	return true
+}
+
+// Run receives messages from the secure channel and dispatches them
+// until the peer shuts the channel down, in which case the channel is
+// zeroised and Run returns true. If receiving fails, Run returns false.
+// Handlers are called from the goroutine calling Run, one at a time.
+// Messages sent with SendLarge are reassembled, as ReceiveLarge does,
+// and dispatched as normal messages; any other message used by the
+// secure channel itself is discarded.
+func (d *Dispatcher) Run(sch *SChannel) bool {
+	for {
+		m, ok := sch.ReceiveLarge()
+		if !ok {
+			return false
+		}
+
+		if m.Type == ShutdownMessage {
+			sch.Zero()
+			return true
+		} else if m.Type != NormalMessage && !m.Type.Application() {
+			continue
+		}
+
+		d.Dispatch(m)
+	}
+}
@@ -0,0 +1,101 @@
+package schannel
+
+import (
+	"bytes"
+	"testing"
+)
+
+const (
+	testControlMessage = ApplicationMessage + iota
+	testDataMessage
+)
+
+func TestSendType(t *testing.T) {
+	alice, bob := testBufferPair(t, nil, nil)
+
+	if alice.SendType(KEXMessage, message) {
+		t.Fatal("SendType should refuse reserved message types")
+	}
+
+	if !alice.SendType(testDataMessage, message) {
+		t.Fatal("alice failed to send an application message")
+	}
+
+	m, ok := bob.Receive()
+	if !ok {
+		t.Fatal("bob failed to receive an application message")
+	} else if m.Type != testDataMessage {
+		t.Fatalf("expected type %d, have %d", testDataMessage, m.Type)
+	} else if !bytes.Equal(m.Contents, message) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	alice, bob := testBufferPair(t, nil, nil)
+
+	var control, data, other int
+	d := NewDispatcher()
+	d.Handle(testControlMessage, func(m *Message) { control++ })
+	d.Handle(testDataMessage, func(m *Message) { data++ })
+	d.HandleDefault(func(m *Message) { other++ })
+
+	if d.Handle(ShutdownMessage, func(*Message) {}) {
+		t.Fatal("Handle should refuse reserved message types")
+	}
+
+	alice.SendType(testControlMessage, message[:8])
+	alice.SendType(testDataMessage, message)
+	alice.SendType(testDataMessage, message)
+	alice.Send(message)
+	alice.Close()
+
+	if !d.Run(bob) {
+		t.Fatal("the dispatcher should stop cleanly on shutdown")
+	}
+
+	if control != 1 || data != 2 || other != 1 {
+		t.Fatalf("messages were misrouted: control=%d data=%d other=%d",
+			control, data, other)
+	}
+
+	d.Handle(testDataMessage, nil)
+	d.HandleDefault(nil)
+	if d.Dispatch(&Message{Type: testDataMessage}) {
+		t.Fatal("Dispatch should fail without a handler")
+	}
+}
+
+func TestDispatcherLarge(t *testing.T) {
+	cfg := &Config{MaxMessageSize: 128}
+	alice, bob := testBufferPair(t, cfg, cfg)
+	large := bytes.Repeat(message, 4)
+
+	var received [][]byte
+	var other int
+	d := NewDispatcher()
+	d.Handle(NormalMessage, func(m *Message) {
+		received = append(received, m.Contents)
+	})
+	d.HandleDefault(func(m *Message) { other++ })
+
+	if !alice.SendLarge(large) {
+		t.Fatal("alice failed to send a large message")
+	}
+	alice.Send(message[:64])
+	alice.Close()
+
+	if !d.Run(bob) {
+		t.Fatal("the dispatcher should stop cleanly on shutdown")
+	}
+
+	if other != 0 {
+		t.Fatalf("%d messages reached the default handler", other)
+	} else if len(received) != 2 {
+		t.Fatalf("expected 2 messages, have %d", len(received))
+	} else if !bytes.Equal(received[0], large) {
+		t.Fatal("the large message was not reassembled")
+	} else if !bytes.Equal(received[1], message[:64]) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+}
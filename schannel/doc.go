@@ -44,6 +44,14 @@
 // be known ahead of time, and key distribution is not a part of this
 // library. Each side chooses whether to sign and/or verify the signature
 // on the key exchange by providing an appropriate key or a nil key.
+// Devices that cannot sign may instead use a pre-shared key with the
+// DialPSK and ListenPSK functions; the pre-shared key is mixed into the
+// session keys, and may also be combined with signatures.
+//
+// The DialConfig and ListenConfig functions take a Config that collects
+// these settings, and return an error describing why a secure channel
+// could not be set up. Dial, Listen, DialPSK and ListenPSK are
+// implemented on top of them.
 //
 // The two pairs may send messages over the secure channel using the Send
 // function. These messages may be received with the Receive function,
@@ -57,4 +65,93 @@
 // provided for informational purposes. However, if the message is a
 // ShutdownMessage, the receiver should call the Zero method on the secure
 // channel.
+//
+// Messages larger than the channel's maximum message size may be sent
+// with SendLarge, which splits them into FragmentMessages. The receiver
+// should use ReceiveLarge to reassemble them; Receive returns each
+// fragment as it arrives.
+//
+// Send and Receive allocate memory for each message. Programs that
+// send many messages may instead use SendBuffer and ReceiveInto, which
+// seal and open messages using caller-provided buffers and do not
+// allocate once those buffers are large enough.
+//
+// A Session multiplexes many streams over one secure channel. Each side
+// calls NewSession once the channel is established; streams are opened
+// with OpenStream and AcceptStream, and implement net.Conn.
+//
+// Setting KeepaliveInterval in the Config sends a PingMessage to the
+// peer periodically. Receive answers pings and consumes pongs without
+// returning them, updating the round trip time reported by RTT. If the
+// peer goes quiet for longer than KeepaliveTimeout, the underlying
+// channel is closed and Err returns ErrPeerTimeout.
+//
+// Ciphertexts reveal the length of the messages they carry. A Padding
+// policy in the Config pads each message, for example to a multiple of
+// a block size or to one of a set of bucket sizes, and CoverInterval
+// sends CoverMessages that the peer discards. Padded messages use a
+// newer envelope version; unpadded messages are unchanged.
+//
+// If both peers set Compression in their Config, messages sent with
+// Send are compressed with DEFLATE when that makes them smaller. Each
+// peer says whether it accepts compressed messages in its half of the
+// key exchange, so compression is agreed on before the first message
+// is sent, and peers that don't support it are unaffected. Messages
+// that mix secrets with attacker-controlled data should be sent with
+// SendUncompressed.
+//
+// Message types from ApplicationMessage to 255 are reserved for
+// applications: they are sent with SendType and returned by Receive
+// unchanged. A Dispatcher routes received messages to handlers
+// registered for their types.
+//
+// A ShutdownMessage carries a ShutdownReason and optional text, which
+// are returned by the Message's Reason method and by Err as a
+// *ShutdownError. Receiving a shutdown acknowledges it automatically.
+// Close and CloseReason send a shutdown and zeroise the channel at
+// once; Shutdown waits, for a bounded time, for the acknowledgement and
+// returns any messages that were still in flight.
+//
+// A listener with TicketKeys issues a session ticket to dialers that set
+// Resumption; the dialer retrieves it with Ticket and may present it in
+// the Config of a later dial. A resumed session uses a fresh ephemeral
+// key exchange mixed with a secret from the earlier session, but skips
+// the signatures. If the listener refuses the ticket, both sides fall
+// back to the full handshake.
+//
+// DialPacket and ListenPacket set up a secure channel in datagram mode
+// over a net.PacketConn, for UDP and lossy links. Each message is sent
+// in its own datagram, and a sliding replay window accepts messages
+// that arrive out of order while dropping duplicates. The dialer
+// retransmits its key exchange until the listener replies.
+//
+// A SerialChannel carries a secure channel over links such as UART
+// serial lines that drop or corrupt bytes. Frames are checked with a
+// CRC and COBS-encoded; corrupted frames are dropped and the reader
+// resynchronises at the next frame, so the session survives the loss.
+//
+// A WebSocketChannel carries each frame as a binary WebSocket message,
+// for networks that only allow HTTP. UpgradeWebSocket takes over an
+// HTTP request in a handler, and DialWebSocket or a WebSocketDialer
+// connects to a ws or wss URL, tunnelling through an HTTP proxy with
+// CONNECT when one is configured.
+//
+// A Server accepts connections, sets up a secure channel over each one
+// and passes it to a Handler, in the manner of net/http. It can limit
+// the number of connections, the rate of key exchanges from each
+// address and the time a key exchange may take. Shutdown sends a
+// ShutdownMessage to every live secure channel and waits for the
+// handlers to return.
+//
+// A Config's Events hook and Logger report what happens to a secure
+// channel: the key exchange and signature verification, key rotation,
+// rejected and undecryptable messages, shutdowns and zeroisation. Each
+// Event carries the peer's address, the fingerprint of its identity key
+// and the message counters, but never any key material.
+//
+// ReadMetrics returns counters aggregated over every secure channel in
+// the process: key exchanges and their failures, active sessions,
+// messages and bytes in each direction, key rotations and rejected
+// messages. The metrics subpackage publishes them through expvar and
+// serves them in the Prometheus text format.
 package schannel
@@ -1,10 +1,6 @@
 package schannel
 
-import (
-	"encoding/binary"
-
-	"github.com/kisom/sbuf"
-)
+import "encoding/binary"
 
 // A MessageType represents a type of message.
 type MessageType uint8
@@ -22,8 +18,49 @@ const (
 	// ShutdownMessage is an indication that the secure channel
 	// should be shut down.
 	ShutdownMessage
+
+	// FragmentMessage carries part of a message that was too large
+	// to be sent in a single frame.
+	FragmentMessage
+
+	// StreamMessage carries a frame for one of the streams in a
+	// multiplexed Session.
+	StreamMessage
+
+	// PingMessage is a keepalive sent to check that the peer is
+	// still responding; it is answered with a PongMessage.
+	PingMessage
+
+	// PongMessage is the answer to a PingMessage, and echoes its
+	// contents.
+	PongMessage
+
+	// CoverMessage is cover traffic; its contents are meaningless
+	// and it is discarded by the receiver.
+	CoverMessage
+
+	// TicketMessage carries a session ticket from the listener,
+	// which the dialer may use to resume the session later.
+	TicketMessage
 )
 
+// ApplicationMessage is the first of the message types reserved for
+// applications. Messages with types from ApplicationMessage to 255 are
+// passed through the secure channel untouched, and may be sent with
+// SendType.
+const ApplicationMessage MessageType = 128
+
+// Application returns true if t is one of the message types reserved
+// for applications.
+func (t MessageType) Application() bool {
+	return t >= ApplicationMessage
+}
+
+// compressible returns true if messages of type t may be compressed.
+func (t MessageType) compressible() bool {
+	return t == NormalMessage || t.Application()
+}
+
 // An envelope is used to wrap a message before encryption.
 type envelope struct {
 	// Version stores the message format version.
@@ -32,7 +69,9 @@ type envelope struct {
 	// Type contains the message type.
 	Type MessageType
 
-	// Pad contains two bytes of padding.
+	// Pad contains two bytes of padding. In an extended envelope,
+	// it holds flags describing the payload; otherwise, it must be
+	// zero.
 	Pad uint16
 
 	// Sequence contains the message sequence number.
@@ -41,21 +80,60 @@ type envelope struct {
 	// PayloadLength contains the length of the payload.
 	PayloadLength uint32
 
-	// Payload contains the message being sent.
-	Payload [BufSize]byte
+	// Payload contains the message being sent. In a padded
+	// envelope, it is followed by zero bytes of padding up to the
+	// end of the envelope.
+	Payload []byte
+
+	// Flags and Total are only present in fragments, where they
+	// are stored in a header at the start of the payload. Flags
+	// indicates whether more fragments follow, and Total contains
+	// the length of the reassembled message.
+	Flags uint8
+	Total uint32
 }
 
 const (
-	currentVersion  = 1
+	currentVersion = 1
+
+	// extendedVersion is used for envelopes with trailing padding
+	// or flags; the padding is whatever follows the payload.
+	extendedVersion = 2
+
+	// flagCompressed marks a payload compressed with DEFLATE.
+	flagCompressed = 1
+
 	messageOverhead = 12 // 2 * uint32 + 2 * uint8 + uint16
+
+	fragmentHeaderSize = 5 // uint8 + uint32
+
+	// fragmentMore is set on every fragment except the last.
+	fragmentMore = 1
+
+	// pingSize is the size of the identifier carried by ping and
+	// pong messages.
+	pingSize = 8
 )
 
 // packMessage serialises the message into a byte slice.
 func packMessage(sequence uint32, mType MessageType, message []byte) ([]byte, bool) {
+	return appendMessage(make([]byte, 0, messageOverhead+len(message)), sequence, mType, message, 0, 0)
+}
+
+// appendMessage serialises the message with the given flags, followed
+// by pad bytes of padding, appending it to out. If out has enough
+// capacity, no memory is allocated. Messages without padding or flags
+// use the original envelope version, so that they may be read by older
+// peers.
+func appendMessage(out []byte, sequence uint32, mType MessageType, message []byte, pad int, flags uint16) ([]byte, bool) {
 	if sequence == 0 {
 		return nil, false
 	}
 
+	if pad < 0 || len(message)+pad > BufSize {
+		return nil, false
+	}
+
 	if len(message) == 0 || len(message) > BufSize {
 		return nil, false
 	}
@@ -64,69 +142,167 @@ func packMessage(sequence uint32, mType MessageType, message []byte) ([]byte, bo
 	case NormalMessage:
 	case KEXMessage:
 	case ShutdownMessage:
+	case FragmentMessage:
+		// A fragment must contain a header and at least one byte.
+		if len(message) <= fragmentHeaderSize {
+			return nil, false
+		}
+	case StreamMessage:
+		if len(message) < streamHeaderSize {
+			return nil, false
+		}
+	case PingMessage, PongMessage:
+		if len(message) != pingSize {
+			return nil, false
+		}
+	case CoverMessage:
+	case TicketMessage:
+		if len(message) != ticketMessageSize {
+			return nil, false
+		}
 	default:
+		if !mType.Application() {
+			return nil, false
+		}
+	}
+
+	if flags&^flagCompressed != 0 {
+		return nil, false
+	} else if flags&flagCompressed != 0 && !mType.compressible() {
 		return nil, false
 	}
 
-	buf := sbuf.NewBuffer(messageOverhead + len(message))
-	buf.WriteByte(currentVersion)
-	buf.WriteByte(uint8(mType))
-	buf.WriteByte(0) // padding
-	buf.WriteByte(0) // padding
+	var hdr [messageOverhead]byte
+	hdr[0] = currentVersion
+	if pad > 0 || flags != 0 {
+		hdr[0] = extendedVersion
+	}
+	hdr[1] = uint8(mType)
+	binary.BigEndian.PutUint16(hdr[2:], flags)
+	binary.BigEndian.PutUint32(hdr[4:], sequence)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(message)))
 
-	// An sbuf won't fail to write unless it's out of memory, then this
-	// whole house of cards is coming crashing down anyways.
-	binary.Write(buf, binary.BigEndian, sequence)
-	binary.Write(buf, binary.BigEndian, uint32(len(message)))
-	buf.Write(message)
-	return buf.Bytes(), true
+	out = append(out, hdr[:]...)
+	out = append(out, message...)
+	return append(out, make([]byte, pad)...), true
 }
 
-// unpackMessage unpacks a byte slice into a message.
+// unpackMessage unpacks a byte slice into a message. The envelope's
+// payload is a copy of the message in the byte slice.
 func unpackMessage(in []byte) (*envelope, bool) {
 	var e envelope
-
-	if len(in) <= messageOverhead {
+	if !parseMessage(in, &e) {
 		return nil, false
 	}
 
-	buf := sbuf.NewBufferFrom(in)
-	defer buf.Close()
+	payload := make([]byte, len(e.Payload))
+	copy(payload, e.Payload)
+	e.Payload = payload
+	return &e, true
+}
 
-	// ReadByte won't fail given our length check at the beginning.
-	e.Version, _ = buf.ReadByte()
-	if e.Version != currentVersion {
-		return nil, false
+// parseMessage unpacks a byte slice into e without copying it; the
+// envelope's payload refers to the byte slice.
+func parseMessage(in []byte, e *envelope) bool {
+	if len(in) <= messageOverhead {
+		return false
+	}
+
+	e.Version = in[0]
+	if e.Version != currentVersion && e.Version != extendedVersion {
+		return false
 	}
 
-	c, _ := buf.ReadByte()
-	e.Type = MessageType(c)
+	e.Type = MessageType(in[1])
 	switch e.Type {
 	case NormalMessage:
 	case KEXMessage:
 	case ShutdownMessage:
+	case FragmentMessage:
+	case StreamMessage:
+	case PingMessage:
+	case PongMessage:
+	case CoverMessage:
+	case TicketMessage:
 	default:
-		return nil, false
+		if !e.Type.Application() {
+			return false
+		}
 	}
 
-	// Read won't fail here with an sbuf given our length check.
-	binary.Read(buf, binary.BigEndian, &e.Pad)
-	if e.Pad != 0 {
-		return nil, false
+	e.Pad = binary.BigEndian.Uint16(in[2:])
+	if e.Version == currentVersion && e.Pad != 0 {
+		return false
+	} else if e.Pad&^flagCompressed != 0 {
+		return false
+	} else if e.Pad&flagCompressed != 0 && !e.Type.compressible() {
+		return false
 	}
 
-	// Read won't fail here with an sbuf given our length check.
-	binary.Read(buf, binary.BigEndian, &e.Sequence)
-	binary.Read(buf, binary.BigEndian, &e.PayloadLength)
+	e.Sequence = binary.BigEndian.Uint32(in[4:])
+	e.PayloadLength = binary.BigEndian.Uint32(in[8:])
 	if e.PayloadLength == 0 {
-		return nil, false
+		return false
 	} else if e.PayloadLength > BufSize {
-		return nil, false
-	} else if buf.Len() != int(e.PayloadLength) {
-		return nil, false
+		return false
 	}
 
-	// Read won't fail here given the previous length checks.
-	buf.Read(e.Payload[:int(e.PayloadLength)])
-	return &e, true
+	body := in[messageOverhead:]
+	if len(body) < int(e.PayloadLength) {
+		return false
+	} else if e.Version == currentVersion && len(body) != int(e.PayloadLength) {
+		return false
+	}
+
+	e.Payload = body[:e.PayloadLength]
+	for _, b := range body[e.PayloadLength:] {
+		if b != 0 {
+			return false
+		}
+	}
+
+	switch e.Type {
+	case FragmentMessage:
+		return unpackFragment(e)
+	case StreamMessage:
+		return len(e.Payload) >= streamHeaderSize
+	case PingMessage, PongMessage:
+		return len(e.Payload) == pingSize
+	case TicketMessage:
+		return len(e.Payload) == ticketMessageSize
+	}
+	return true
+}
+
+// packFragment prepends the fragment header to a piece of a larger
+// message.
+func packFragment(more bool, total uint32, chunk []byte) []byte {
+	out := make([]byte, fragmentHeaderSize+len(chunk))
+	if more {
+		out[0] = fragmentMore
+	}
+	binary.BigEndian.PutUint32(out[1:], total)
+	copy(out[fragmentHeaderSize:], chunk)
+	return out
+}
+
+// unpackFragment removes the fragment header from the envelope's
+// payload.
+func unpackFragment(e *envelope) bool {
+	if len(e.Payload) <= fragmentHeaderSize {
+		return false
+	}
+
+	e.Flags = e.Payload[0]
+	if e.Flags&^fragmentMore != 0 {
+		return false
+	}
+
+	e.Total = binary.BigEndian.Uint32(e.Payload[1:])
+	if e.Total == 0 {
+		return false
+	}
+
+	e.Payload = e.Payload[fragmentHeaderSize:]
+	return true
 }
@@ -45,8 +45,9 @@ func TestInvalidPack(t *testing.T) {
 	var i MessageType
 	for i = 0; i < 255; i++ {
 		_, ok = packMessage(1, i, []byte{1})
-		switch i {
-		case NormalMessage, KEXMessage, ShutdownMessage:
+		switch {
+		case i == NormalMessage, i == KEXMessage, i == ShutdownMessage,
+			i == CoverMessage, i.Application():
 			if !ok {
 				t.Fatal("expected packMessage to succeed with type ", i)
 			}
@@ -81,8 +82,9 @@ func TestInvalidUnpack(t *testing.T) {
 	var i MessageType
 	for i = 0; i < 255; i++ {
 		out = testPackMessage(1, 1, currentVersion, 0, i, m)
-		switch i {
-		case NormalMessage, KEXMessage, ShutdownMessage:
+		switch {
+		case i == NormalMessage, i == KEXMessage, i == ShutdownMessage,
+			i == CoverMessage, i.Application():
 			_, ok := unpackMessage(out)
 			if !ok {
 				t.Fatal("expected unpackMessage to succeed with type ", i)
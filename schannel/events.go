@@ -0,0 +1,208 @@
+package schannel
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync/atomic"
+)
+
+// An EventType identifies something that happened to a secure channel.
+type EventType uint8
+
+const (
+	// EventHandshakeStart is reported when a key exchange begins.
+	EventHandshakeStart EventType = iota + 1
+
+	// EventHandshakeComplete is reported when the secure channel
+	// has been set up.
+	EventHandshakeComplete
+
+	// EventHandshakeFailed is reported when the secure channel
+	// could not be set up.
+	EventHandshakeFailed
+
+	// EventVerified is reported when the signature on the peer's
+	// key exchange has been verified.
+	EventVerified
+
+	// EventVerifyFailed is reported when the signature on the
+	// peer's key exchange is invalid.
+	EventVerifyFailed
+
+	// EventRekeyStart is reported when a key rotation is started,
+	// by either side.
+	EventRekeyStart
+
+	// EventRekeyComplete is reported when new keys are in place.
+	EventRekeyComplete
+
+	// EventReplay is reported when a message is rejected because
+	// its sequence number has already been seen.
+	EventReplay
+
+	// EventDecryptFailed is reported when a frame could not be
+	// authenticated and decrypted.
+	EventDecryptFailed
+
+	// EventShutdown is reported when the peer shuts the secure
+	// channel down; Err holds its *ShutdownError.
+	EventShutdown
+
+	// EventZeroise is reported when the secure channel is zeroised.
+	EventZeroise
+)
+
+var eventNames = map[EventType]string{
+	EventHandshakeStart:    "handshake started",
+	EventHandshakeComplete: "handshake completed",
+	EventHandshakeFailed:   "handshake failed",
+	EventVerified:          "peer verified",
+	EventVerifyFailed:      "peer verification failed",
+	EventRekeyStart:        "rekey started",
+	EventRekeyComplete:     "rekey completed",
+	EventReplay:            "replay rejected",
+	EventDecryptFailed:     "decryption failed",
+	EventShutdown:          "shutdown received",
+	EventZeroise:           "zeroised",
+}
+
+// String returns a short description of the event type.
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+	return "unknown event"
+}
+
+// level returns the level at which events of type t are logged.
+func (t EventType) level() slog.Level {
+	switch t {
+	case EventHandshakeStart, EventZeroise:
+		return slog.LevelDebug
+	case EventHandshakeFailed, EventVerifyFailed, EventReplay, EventDecryptFailed:
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// An Event describes something that happened to a secure channel. It
+// never contains key material.
+type Event struct {
+	Type EventType
+
+	// Dialer is true if the secure channel was set up by dialing.
+	Dialer bool
+
+	// Addr is the peer's address, if the insecure channel has a
+	// RemoteAddr method or is a datagram channel.
+	Addr net.Addr
+
+	// Peer is the fingerprint of the identity key used to verify
+	// the peer, or nil if the peer is not verified.
+	Peer *Fingerprint
+
+	// The counters of messages and data sent and received, as
+	// returned by SCtr and RCtr and stored in SData and RData.
+	SCtr, RCtr   uint32
+	SData, RData uint64
+
+	// Err holds the error for failures and the peer's reason for
+	// shutting down.
+	Err error
+}
+
+// attrs returns the event's details as logging attributes.
+func (ev Event) attrs() []slog.Attr {
+	role := "listener"
+	if ev.Dialer {
+		role = "dialer"
+	}
+
+	attrs := []slog.Attr{slog.String("role", role)}
+	if ev.Addr != nil {
+		attrs = append(attrs, slog.String("addr", ev.Addr.String()))
+	}
+
+	if ev.Peer != nil {
+		attrs = append(attrs, slog.String("peer", ev.Peer.String()))
+	}
+
+	attrs = append(attrs,
+		slog.Uint64("sctr", uint64(ev.SCtr)),
+		slog.Uint64("rctr", uint64(ev.RCtr)),
+		slog.Uint64("sdata", ev.SData),
+		slog.Uint64("rdata", ev.RData))
+
+	if ev.Err != nil {
+		attrs = append(attrs, slog.String("err", ev.Err.Error()))
+	}
+	return attrs
+}
+
+// eventFunc returns the function that reports events for channels
+// using cfg, or nil if events are not wanted.
+func (cfg *Config) eventFunc() func(Event) {
+	hook, logger := cfg.Events, cfg.Logger
+	if logger == nil {
+		return hook
+	}
+
+	return func(ev Event) {
+		logger.LogAttrs(context.Background(), ev.Type.level(), "schannel: "+ev.Type.String(), ev.attrs()...)
+		if hook != nil {
+			hook(ev)
+		}
+	}
+}
+
+// setEvents prepares the channel to report events for cfg. addr is
+// the peer's address, if known; otherwise it is taken from ch.
+func (sch *SChannel) setEvents(cfg *Config, ch Channel, addr net.Addr) {
+	sch.events = cfg.eventFunc()
+	if sch.events == nil {
+		return
+	}
+
+	if addr == nil {
+		if ra, ok := ch.(interface{ RemoteAddr() net.Addr }); ok {
+			addr = ra.RemoteAddr()
+		}
+	}
+	sch.addr = addr
+
+	if cfg.Peer != nil {
+		fpr := NewFingerprint(cfg.Peer)
+		sch.peer = &fpr
+	}
+}
+
+// event updates the metrics for an event and reports it. No locks are
+// taken, so that events may be reported from either direction and
+// hooks may use the channel.
+func (sch *SChannel) event(t EventType, err error) {
+	sch.count(t)
+	if sch.events == nil {
+		return
+	}
+
+	sch.events(Event{
+		Type:   t,
+		Dialer: sch.dialer,
+		Addr:   sch.addr,
+		Peer:   sch.peer,
+		SCtr:   atomic.LoadUint32(&sch.sctr),
+		RCtr:   atomic.LoadUint32(&sch.rctr),
+		SData:  atomic.LoadUint64(&sch.SData),
+		RData:  atomic.LoadUint64(&sch.RData),
+		Err:    err,
+	})
+}
+
+// abort reports that the key exchange failed and zeroises the channel,
+// returning err.
+func (sch *SChannel) abort(err error) error {
+	sch.event(EventHandshakeFailed, err)
+	sch.Zero()
+	return err
+}
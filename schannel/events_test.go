@@ -0,0 +1,280 @@
+package schannel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+)
+
+// testIdentities generates identity keys for a dialer and a listener.
+func testIdentities(t *testing.T) (dpub *[IdentityPublicSize]byte, dpriv *[IdentityPrivateSize]byte, lpub *[IdentityPublicSize]byte, lpriv *[IdentityPrivateSize]byte) {
+	dpub, dpriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	lpub, lpriv, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return dpub, dpriv, lpub, lpriv
+}
+
+// eventRecorder records the events reported to it.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) record(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var types []EventType
+	for _, ev := range r.events {
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func (r *eventRecorder) find(t EventType) (Event, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ev := range r.events {
+		if ev.Type == t {
+			return ev, true
+		}
+	}
+	return Event{}, false
+}
+
+func (r *eventRecorder) expect(t *testing.T, want ...EventType) {
+	t.Helper()
+	have := r.types()
+	if len(have) != len(want) {
+		t.Fatalf("expected events %v, have %v", want, have)
+	}
+
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("expected events %v, have %v", want, have)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dpub, dpriv, lpub, lpriv := testIdentities(t)
+
+	var dev, lev eventRecorder
+	dialer, listener := testTCPConfigPair(t, &Config{
+		Signer: dpriv,
+		Peer:   lpub,
+		Events: dev.record,
+	}, &Config{
+		Signer: lpriv,
+		Peer:   dpub,
+		Events: lev.record,
+	})
+
+	dev.expect(t, EventHandshakeStart, EventVerified, EventHandshakeComplete)
+	lev.expect(t, EventHandshakeStart, EventVerified, EventHandshakeComplete)
+
+	ev, _ := dev.find(EventVerified)
+	if !ev.Dialer || ev.Addr == nil {
+		t.Fatal("event does not describe the dialer's peer")
+	} else if ev.Peer == nil || *ev.Peer != NewFingerprint(lpub) {
+		t.Fatal("event does not carry the peer's fingerprint")
+	}
+
+	done := make(chan bool)
+	go func() {
+		m, ok := listener.Receive()
+		done <- ok && m.Type == KEXMessage
+	}()
+
+	if !dialer.Rekey() || !<-done {
+		t.Fatal("rekey failed")
+	}
+
+	if !dialer.Send(message) {
+		t.Fatal("failed to send a message")
+	}
+
+	if _, ok := listener.Receive(); !ok {
+		t.Fatal("failed to receive a message")
+	}
+
+	dialer.Close()
+	if m, ok := listener.Receive(); !ok || m.Type != ShutdownMessage {
+		t.Fatal("expected a shutdown message")
+	}
+	listener.Zero()
+
+	// Only the first Zero is reported.
+	listener.Zero()
+	dialer.Zero()
+
+	dev.expect(t, EventHandshakeStart, EventVerified, EventHandshakeComplete,
+		EventRekeyStart, EventRekeyComplete, EventZeroise)
+	lev.expect(t, EventHandshakeStart, EventVerified, EventHandshakeComplete,
+		EventRekeyStart, EventRekeyComplete, EventShutdown, EventZeroise)
+
+	ev, _ = lev.find(EventShutdown)
+	if err, ok := ev.Err.(*ShutdownError); !ok || err.Reason != ShutdownNormal {
+		t.Fatalf("expected a normal shutdown, have %v", ev.Err)
+	}
+
+	ev, _ = lev.find(EventZeroise)
+	if ev.RCtr != 3 || ev.RData == 0 {
+		t.Fatalf("unexpected counters in %+v", ev)
+	}
+}
+
+func TestEventsDuringSend(t *testing.T) {
+	var dev eventRecorder
+	dialer, _ := testTCPConfigPair(t, &Config{Events: dev.record}, nil)
+
+	// A send stuck in a slow write holds the send lock; events from
+	// the receive path should still be reported.
+	dialer.smu.Lock()
+	defer dialer.smu.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		dialer.event(EventDecryptFailed, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the event waited for the send lock")
+	}
+
+	if _, ok := dev.find(EventDecryptFailed); !ok {
+		t.Fatal("the event was not reported")
+	}
+}
+
+func TestEventsHandshakeFailed(t *testing.T) {
+	_, dpriv, lpub, _ := testIdentities(t)
+
+	var lev eventRecorder
+	lcfg := &Config{Peer: lpub, Events: lev.record}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		// The dialer signs with the wrong key.
+		DialConfig(a, &Config{Signer: dpriv})
+		a.Close()
+	}()
+
+	if _, err := ListenConfig(b, lcfg); err != ErrKeyExchange {
+		t.Fatalf("expected %v, have %v", ErrKeyExchange, err)
+	}
+
+	lev.expect(t, EventHandshakeStart, EventVerifyFailed, EventHandshakeFailed, EventZeroise)
+	if ev, _ := lev.find(EventHandshakeFailed); ev.Err != ErrKeyExchange {
+		t.Fatalf("expected %v, have %v", ErrKeyExchange, ev.Err)
+	}
+}
+
+func TestEventsRejected(t *testing.T) {
+	var lev eventRecorder
+	dialer, listener := testTCPConfigPair(t, nil, &Config{Events: lev.record})
+
+	// Sending with an old sequence number replays it.
+	dialer.Send(message)
+	listener.Receive()
+	dialer.sctr = 0
+	dialer.Send(message)
+	if _, ok := listener.Receive(); ok {
+		t.Fatal("a replayed message should be rejected")
+	}
+
+	if _, ok := lev.find(EventReplay); !ok {
+		t.Fatal("the replay was not reported")
+	}
+
+	var lev2 eventRecorder
+	dialer, listener = testTCPConfigPair(t, nil, &Config{Events: lev2.record})
+
+	frame := make([]byte, frameHeaderSize+nonceSize+32)
+	frame[frameHeaderSize-1] = nonceSize + 32
+	dialer.Channel.(net.Conn).Write(frame)
+	if _, ok := listener.Receive(); ok {
+		t.Fatal("a forged frame should be rejected")
+	}
+
+	if _, ok := lev2.find(EventDecryptFailed); !ok {
+		t.Fatal("the decryption failure was not reported")
+	}
+}
+
+func TestEventsLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	logger := slog.New(slog.NewTextHandler(&lockedWriter{w: &buf, mu: &mu}, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	_, _, lpub, lpriv := testIdentities(t)
+
+	var dev eventRecorder
+	dialer, _ := testTCPConfigPair(t, &Config{
+		Peer:   lpub,
+		Logger: logger,
+		Events: dev.record,
+	}, &Config{Signer: lpriv})
+	dialer.Zero()
+
+	mu.Lock()
+	out := buf.String()
+	mu.Unlock()
+
+	for _, want := range []string{
+		"schannel: handshake started",
+		"schannel: peer verified",
+		"role=dialer",
+		"peer=" + NewFingerprint(lpub).String(),
+		"schannel: zeroised",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in the log:\n%s", want, out)
+		}
+	}
+
+	// The hook is still called alongside the logger.
+	if _, ok := dev.find(EventHandshakeComplete); !ok {
+		t.Fatal("the hook was not called")
+	}
+}
+
+// lockedWriter serialises writes to w.
+type lockedWriter struct {
+	w  *bytes.Buffer
+	mu *sync.Mutex
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
@@ -0,0 +1,55 @@
+package schannel_test
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/kisom/go-schannel/schannel"
+)
+
+// This example sets up a secure channel over a WebSocket connection to
+// an HTTP server.
+func ExampleDialWebSocket() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := schannel.UpgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		sch, err := schannel.ListenConfig(ws, nil)
+		if err != nil {
+			return
+		}
+
+		m, ok := sch.Receive()
+		if ok && m.Type == schannel.NormalMessage {
+			sch.Send(append([]byte("echo: "), m.Contents...))
+		}
+		sch.Close()
+	}))
+	defer srv.Close()
+
+	ws, err := schannel.DialWebSocket("ws" + strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ws.Close()
+
+	sch, err := schannel.DialConfig(ws, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sch.Send([]byte("hello"))
+	m, ok := sch.Receive()
+	if !ok {
+		log.Fatal("receive failed")
+	}
+	fmt.Println(string(m.Contents))
+	sch.Zero()
+	// Output: echo: hello
+}
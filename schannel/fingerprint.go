@@ -0,0 +1,105 @@
+package schannel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// FingerprintSize is the size of an identity key fingerprint.
+const FingerprintSize = sha256.Size
+
+// A Fingerprint is the SHA-256 digest of an identity public key. It
+// is intended to be compared out of band, either in its text form or
+// using the randomart rendering.
+type Fingerprint [FingerprintSize]byte
+
+// NewFingerprint computes the fingerprint of an identity public key.
+func NewFingerprint(pub *[IdentityPublicSize]byte) Fingerprint {
+	return Fingerprint(sha256.Sum256(pub[:]))
+}
+
+// String returns the stable text form of the fingerprint; this is the
+// unpadded base64 encoding of the digest prefixed with "SHA256:".
+func (fpr Fingerprint) String() string {
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(fpr[:])
+}
+
+const (
+	artWidth  = 17
+	artHeight = 9
+)
+
+// artSymbols are used to show how many times the bishop has visited a
+// square; the last two are reserved for the start and end positions.
+var artSymbols = []byte(" .o+=*BOX@%&#/^SE")
+
+// Randomart renders the fingerprint using the "drunken bishop"
+// algorithm, producing the same style of picture that OpenSSH uses
+// for host keys. Small changes in a key produce very different
+// pictures, making it easier for a human to spot a mismatch.
+func (fpr Fingerprint) Randomart() string {
+	var field [artWidth][artHeight]int
+	x, y := artWidth/2, artHeight/2
+	maxVisits := len(artSymbols) - 3
+
+	for _, b := range fpr {
+		for i := 0; i < 4; i++ {
+			if b&1 != 0 {
+				x++
+			} else {
+				x--
+			}
+
+			if b&2 != 0 {
+				y++
+			} else {
+				y--
+			}
+
+			x = clamp(x, 0, artWidth-1)
+			y = clamp(y, 0, artHeight-1)
+			if field[x][y] < maxVisits {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+
+	field[artWidth/2][artHeight/2] = len(artSymbols) - 2
+	field[x][y] = len(artSymbols) - 1
+
+	buf := &bytes.Buffer{}
+	writeArtBorder(buf, "[ED25519 256]")
+	for j := 0; j < artHeight; j++ {
+		buf.WriteByte('|')
+		for i := 0; i < artWidth; i++ {
+			buf.WriteByte(artSymbols[field[i][j]])
+		}
+		buf.WriteString("|\n")
+	}
+	writeArtBorder(buf, "[SHA256]")
+	return buf.String()
+}
+
+func writeArtBorder(buf *bytes.Buffer, title string) {
+	pad := artWidth - len(title)
+	buf.WriteByte('+')
+	for i := 0; i < pad/2; i++ {
+		buf.WriteByte('-')
+	}
+	buf.WriteString(title)
+	for i := 0; i < pad-pad/2; i++ {
+		buf.WriteByte('-')
+	}
+	buf.WriteString("+\n")
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	} else if n > max {
+		return max
+	}
+	return n
+}
@@ -0,0 +1,55 @@
+package schannel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	var pub [IdentityPublicSize]byte
+	fpr := NewFingerprint(&pub)
+
+	// This is the SHA-256 digest of 32 zero bytes.
+	expected := "SHA256:Zmh6rfhivXdsj8GLjp+OIAiXFIVu4jOzkCpZHQ1fKSU"
+	if fpr.String() != expected {
+		t.Fatalf("invalid fingerprint: expected %s, have %s",
+			expected, fpr.String())
+	}
+
+	pub[0] = 1
+	if NewFingerprint(&pub) == fpr {
+		t.Fatal("distinct keys should have distinct fingerprints")
+	}
+}
+
+func TestRandomart(t *testing.T) {
+	var pub [IdentityPublicSize]byte
+	fpr := NewFingerprint(&pub)
+	art := fpr.Randomart()
+	if art != fpr.Randomart() {
+		t.Fatal("randomart should be stable")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(art, "\n"), "\n")
+	if len(lines) != artHeight+2 {
+		t.Fatalf("expected %d lines of randomart, have %d",
+			artHeight+2, len(lines))
+	}
+
+	for _, line := range lines {
+		if len(line) != artWidth+2 {
+			t.Fatalf("invalid randomart line: %q", line)
+		}
+	}
+
+	field := strings.Join(lines[1:artHeight+1], "")
+	if strings.Count(field, "S") > 1 || strings.Count(field, "E") != 1 {
+		t.Fatal("randomart should mark the start and end positions")
+	}
+
+	pub[0] = 1
+	other := NewFingerprint(&pub)
+	if other.Randomart() == art {
+		t.Fatal("distinct keys should have distinct randomart")
+	}
+}
@@ -0,0 +1,125 @@
+package schannel
+
+import "math"
+
+// DefaultMaxReassemblySize is the largest message that ReceiveLarge
+// will reassemble if the Config does not set a limit.
+const DefaultMaxReassemblySize = 64 * 1024 * 1024 // 64MiB
+
+// SendLarge seals and sends a message that may be larger than the
+// channel's maximum message size. A message that fits in a single
+// frame is sent as a NormalMessage, exactly as Send would. Larger
+// messages are split into fragments, each sealed in its own frame,
+// that the peer must reassemble with ReceiveLarge. The send lock is
+// held until the last fragment has been sent, so that messages sent
+// from other goroutines can't come between the fragments.
+func (sch *SChannel) SendLarge(m []byte) bool {
+	if !sch.Ready() {
+		return false
+	}
+
+	if len(m) <= sch.maxSize {
+		return sch.send(NormalMessage, m)
+	}
+
+	if uint64(len(m)) > math.MaxUint32 {
+		return false
+	}
+
+	if !sch.lockSend() {
+		return false
+	}
+	defer sch.smu.Unlock()
+
+	total := uint32(len(m))
+	chunkSize := sch.maxSize - fragmentHeaderSize
+	for len(m) > 0 {
+		n := chunkSize
+		if n > len(m) {
+			n = len(m)
+		}
+
+		frag := packFragment(n < len(m), total, m[:n])
+		ok := sch.sendLocked(FragmentMessage, frag)
+		zero(frag, 0)
+		if !ok {
+			return false
+		}
+		m = m[n:]
+	}
+
+	return true
+}
+
+// ReceiveLarge reads a message from the secure channel, reassembling
+// it if the peer sent it in fragments with SendLarge; the reassembled
+// message is returned as a NormalMessage. Messages larger than the
+// channel's maximum reassembly size are rejected before any memory is
+// allocated for them.
+//
+// Fragments must arrive consecutively. A key rotation may take place
+// between fragments, but any other message will cause ReceiveLarge to
+// fail, except for a ShutdownMessage, which discards the partial
+// message and is returned to the caller.
+func (sch *SChannel) ReceiveLarge() (*Message, bool) {
+	var out []byte
+	var total uint32
+
+	for {
+		m, ok := sch.Receive()
+		if !ok {
+			zero(out, 0)
+			return nil, false
+		}
+
+		if m.Type != FragmentMessage {
+			if out == nil {
+				return m, true
+			}
+
+			switch m.Type {
+			case KEXMessage:
+				continue
+			case ShutdownMessage:
+				zero(out, 0)
+				return m, true
+			default:
+				zero(out, 0)
+				return nil, false
+			}
+		}
+
+		if out == nil {
+			if int64(m.total) > int64(sch.maxReassembly) {
+				zero(m.Contents, 0)
+				return nil, false
+			}
+
+			total = m.total
+			out = make([]byte, 0, int(total))
+		} else if m.total != total {
+			zero(out, 0)
+			zero(m.Contents, 0)
+			return nil, false
+		}
+
+		if len(out)+len(m.Contents) > int(total) {
+			zero(out, 0)
+			zero(m.Contents, 0)
+			return nil, false
+		}
+
+		out = append(out, m.Contents...)
+		zero(m.Contents, 0)
+		if m.more {
+			continue
+		}
+
+		if len(out) != int(total) {
+			zero(out, 0)
+			return nil, false
+		}
+
+		return &Message{Type: NormalMessage, Contents: out}, true
+	}
+}
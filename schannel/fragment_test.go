@@ -0,0 +1,205 @@
+package schannel
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBufferPair sets up a pair of secure channels with the given
+// configurations, then moves both onto a shared buffer so that either
+// side may send messages for the other to receive without blocking.
+func testBufferPair(t testing.TB, dcfg, lcfg *Config) (*SChannel, *SChannel) {
+	dialer, listener := testHandshake(func(ch Channel) (*SChannel, bool) {
+		sch, err := DialConfig(ch, dcfg)
+		return sch, err == nil
+	}, func(ch Channel) (*SChannel, bool) {
+		sch, err := ListenConfig(ch, lcfg)
+		return sch, err == nil
+	})
+	if !dialer.ok || !listener.ok {
+		t.Fatal("failed to set up secure channel")
+	}
+
+	dialer.sch.Channel.(net.Conn).Close()
+	buf := &bytes.Buffer{}
+	dialer.sch.Channel = buf
+	listener.sch.Channel = buf
+	return dialer.sch, listener.sch
+}
+
+func TestFragmentEnvelope(t *testing.T) {
+	frag := packFragment(true, 1024, message[:64])
+	out, ok := packMessage(1, FragmentMessage, frag)
+	if !ok {
+		t.Fatal("failed to pack fragment")
+	}
+
+	e, ok := unpackMessage(out)
+	if !ok {
+		t.Fatal("failed to unpack fragment")
+	}
+
+	if e.Flags != fragmentMore || e.Total != 1024 {
+		t.Fatal("invalid fragment header")
+	} else if !bytes.Equal(e.Payload, message[:64]) {
+		t.Fatal("invalid fragment payload")
+	}
+
+	if _, ok = packMessage(1, FragmentMessage, frag[:fragmentHeaderSize]); ok {
+		t.Fatal("packMessage should fail with an empty fragment")
+	}
+
+	frag[0] = 2
+	out, _ = packMessage(1, FragmentMessage, frag)
+	if _, ok = unpackMessage(out); ok {
+		t.Fatal("unpackMessage should fail with invalid fragment flags")
+	}
+
+	frag = packFragment(false, 0, message[:64])
+	out, _ = packMessage(1, FragmentMessage, frag)
+	if _, ok = unpackMessage(out); ok {
+		t.Fatal("unpackMessage should fail with a zero total length")
+	}
+}
+
+func TestSendLarge(t *testing.T) {
+	cfg := &Config{MaxMessageSize: 128}
+	alice, bob := testBufferPair(t, cfg, cfg)
+
+	large := bytes.Repeat(message, 4)
+	if !alice.SendLarge(large) {
+		t.Fatal("alice failed to send a large message")
+	}
+
+	if alice.SCtr() <= 1 {
+		t.Fatal("the large message should have been fragmented")
+	}
+
+	m, ok := bob.ReceiveLarge()
+	if !ok {
+		t.Fatal("bob failed to receive a large message")
+	} else if m.Type != NormalMessage {
+		t.Fatal("bob should receive a normal message")
+	} else if !bytes.Equal(m.Contents, large) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+
+	// Small messages are sent without fragmentation.
+	if !alice.SendLarge(message[:64]) {
+		t.Fatal("alice failed to send a small message")
+	}
+
+	m, ok = bob.ReceiveLarge()
+	if !ok {
+		t.Fatal("bob failed to receive a small message")
+	} else if !bytes.Equal(m.Contents, message[:64]) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+}
+
+// hookWriter calls hook before the first write.
+type hookWriter struct {
+	*bytes.Buffer
+	once sync.Once
+	hook func()
+}
+
+func (w *hookWriter) Write(p []byte) (int, error) {
+	w.once.Do(w.hook)
+	return w.Buffer.Write(p)
+}
+
+// TestSendLargeConcurrent sends a message from another goroutine while
+// a large message is being sent; it must not land between the
+// fragments.
+func TestSendLargeConcurrent(t *testing.T) {
+	cfg := &Config{MaxMessageSize: 128}
+	alice, bob := testBufferPair(t, cfg, cfg)
+	large := bytes.Repeat(message, 4)
+
+	var wg sync.WaitGroup
+	alice.Channel = &hookWriter{
+		Buffer: bob.Channel.(*bytes.Buffer),
+		hook: func() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				alice.Send(message[:8])
+			}()
+
+			// Give the sender time to start waiting.
+			time.Sleep(10 * time.Millisecond)
+		},
+	}
+
+	if !alice.SendLarge(large) {
+		t.Fatal("alice failed to send a large message")
+	}
+	wg.Wait()
+
+	m, ok := bob.ReceiveLarge()
+	if !ok {
+		t.Fatal("bob failed to receive the large message")
+	} else if !bytes.Equal(m.Contents, large) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+
+	if m, ok = bob.ReceiveLarge(); !ok || !bytes.Equal(m.Contents, message[:8]) {
+		t.Fatal("bob didn't get the small message alice sent")
+	}
+}
+
+func TestReceiveLargeLimit(t *testing.T) {
+	alice, bob := testBufferPair(t, &Config{MaxMessageSize: 128},
+		&Config{MaxMessageSize: 128, MaxReassemblySize: 256})
+
+	if !alice.SendLarge(message) {
+		t.Fatal("alice failed to send a large message")
+	}
+
+	if _, ok := bob.ReceiveLarge(); ok {
+		t.Fatal("bob should refuse to reassemble an oversized message")
+	}
+}
+
+func TestReceiveLargeInterrupted(t *testing.T) {
+	cfg := &Config{MaxMessageSize: 128}
+	alice, bob := testBufferPair(t, cfg, cfg)
+
+	frag := packFragment(true, uint32(len(message)), message[:64])
+	if !alice.send(FragmentMessage, frag) {
+		t.Fatal("alice failed to send a fragment")
+	}
+
+	if !alice.Send(message[:64]) {
+		t.Fatal("alice failed to send a message")
+	}
+
+	if _, ok := bob.ReceiveLarge(); ok {
+		t.Fatal("bob should fail when a message interrupts a fragmented message")
+	}
+}
+
+func TestReceiveLargeShutdown(t *testing.T) {
+	cfg := &Config{MaxMessageSize: 128}
+	alice, bob := testBufferPair(t, cfg, cfg)
+
+	frag := packFragment(true, uint32(len(message)), message[:64])
+	if !alice.send(FragmentMessage, frag) {
+		t.Fatal("alice failed to send a fragment")
+	}
+
+	if !alice.Close() {
+		t.Fatal("alice failed to shut down the channel")
+	}
+
+	m, ok := bob.ReceiveLarge()
+	if !ok {
+		t.Fatal("bob failed to receive the shutdown message")
+	} else if m.Type != ShutdownMessage {
+		t.Fatal("bob expected a shutdown message")
+	}
+}
@@ -0,0 +1,223 @@
+package schannel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrPeerTimeout is returned by Err when the secure channel was torn
+// down because the peer stopped responding to keepalives.
+var ErrPeerTimeout = errors.New("schannel: peer stopped responding")
+
+// DefaultKeepaliveTimeouts is the number of keepalive intervals that
+// may pass without hearing from the peer when no timeout is set.
+const DefaultKeepaliveTimeouts = 3
+
+// keepalive tracks pings sent to the peer, and when the peer was last
+// heard from. It is shared between the goroutine receiving messages
+// and the one sending pings.
+type keepalive struct {
+	mu sync.Mutex
+
+	// interval and timeout are set when the channel is established
+	// and do not change afterwards; keepalives are disabled if the
+	// interval is zero.
+	interval time.Duration
+	timeout  time.Duration
+
+	// last is when a message was last received from the peer, and
+	// receiving is true while a goroutine is waiting for one. Pongs
+	// are only read by the receiver, so the peer only times out
+	// while it is receiving.
+	last      time.Time
+	receiving bool
+
+	// next is the identifier of the next ping; id and sent record
+	// the outstanding ping, if id is not zero.
+	next uint64
+	id   uint64
+	sent time.Time
+
+	// rtt is the round trip time measured by the last pong.
+	rtt time.Duration
+
+	// stop is closed to stop sending pings.
+	stop chan struct{}
+}
+
+// enabled returns true if pings are sent periodically.
+func (ka *keepalive) enabled() bool {
+	return ka.interval > 0
+}
+
+// received records that a message arrived from the peer.
+func (ka *keepalive) received() {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	ka.last = time.Now()
+}
+
+// waiting records that the receiver has started or stopped waiting
+// for a message. The peer's silence is only counted from when the
+// receiver starts waiting.
+func (ka *keepalive) waiting(receiving bool) {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	if receiving && !ka.receiving {
+		ka.last = time.Now()
+	}
+	ka.receiving = receiving
+}
+
+// ping returns the payload for a new ping, and records it as the
+// outstanding ping.
+func (ka *keepalive) ping() []byte {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	ka.next++
+	ka.id = ka.next
+	ka.sent = time.Now()
+
+	var p [pingSize]byte
+	binary.BigEndian.PutUint64(p[:], ka.id)
+	return p[:]
+}
+
+// pong measures the round trip time if the pong answers the
+// outstanding ping; stale pongs are ignored.
+func (ka *keepalive) pong(p []byte) {
+	id := binary.BigEndian.Uint64(p)
+
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	if id == 0 || id != ka.id {
+		return
+	}
+
+	ka.rtt = time.Since(ka.sent)
+	ka.id = 0
+}
+
+// halt stops sending pings.
+func (ka *keepalive) halt() {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+
+	if ka.stop != nil {
+		close(ka.stop)
+		ka.stop = nil
+	}
+}
+
+// startKeepalive begins sending pings every interval once the channel
+// has been established. If nothing is received from the peer for
+// longer than timeout, the channel is torn down.
+func (sch *SChannel) startKeepalive(interval, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	sch.ka.interval = interval
+	sch.ka.timeout = timeout
+	sch.ka.last = time.Now()
+	sch.ka.stop = make(chan struct{})
+	go sch.runKeepalive(sch.ka.stop)
+}
+
+func (sch *SChannel) runKeepalive(stop chan struct{}) {
+	ticker := time.NewTicker(sch.ka.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		sch.ka.mu.Lock()
+		idle := time.Since(sch.ka.last)
+		receiving := sch.ka.receiving
+		sch.ka.mu.Unlock()
+
+		if receiving && idle > sch.ka.timeout {
+			sch.fail(ErrPeerTimeout)
+			return
+		}
+
+		if !sch.Ping() {
+			return
+		}
+	}
+}
+
+// setErr records why the channel was torn down, unless a reason has
+// already been recorded.
+func (sch *SChannel) setErr(err error) {
+	sch.emu.Lock()
+	defer sch.emu.Unlock()
+
+	if sch.err == nil {
+		sch.err = err
+	}
+}
+
+// A readDeadliner is a Channel, such as a net.Conn, whose reads can be
+// interrupted with a deadline.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// fail records why the channel is being torn down, and closes the
+// insecure channel so that a blocked Receive returns. A channel that
+// can't be closed has its read deadline set instead, if it has one.
+func (sch *SChannel) fail(err error) {
+	sch.setErr(err)
+
+	sch.smu.Lock()
+	ch := sch.Channel
+	sch.smu.Unlock()
+
+	if c, ok := ch.(io.Closer); ok {
+		c.Close()
+	} else if d, ok := ch.(readDeadliner); ok {
+		d.SetReadDeadline(time.Now())
+	}
+}
+
+// Ping sends a ping to the peer. The answering pong is consumed by
+// Receive, which updates the round trip time reported by RTT. Pings
+// are sent automatically if a keepalive interval was configured.
+func (sch *SChannel) Ping() bool {
+	// The send lock guards against the channel being zeroised
+	// while the keepalive goroutine is pinging.
+	return sch.send(PingMessage, sch.ka.ping())
+}
+
+// RTT returns the round trip time measured by the most recently
+// answered ping, or zero if no ping has been answered.
+func (sch *SChannel) RTT() time.Duration {
+	sch.ka.mu.Lock()
+	defer sch.ka.mu.Unlock()
+
+	return sch.ka.rtt
+}
+
+// Err returns the reason the secure channel was torn down, if it was
+// torn down by the peer or the package rather than by a failed send or
+// receive. Once the peer stops responding to keepalives, Err returns
+// ErrPeerTimeout; once the peer shuts the channel down, it returns a
+// *ShutdownError.
+func (sch *SChannel) Err() error {
+	sch.emu.Lock()
+	defer sch.emu.Unlock()
+
+	return sch.err
+}
@@ -0,0 +1,208 @@
+package schannel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPingEnvelope(t *testing.T) {
+	var ka keepalive
+	out, ok := packMessage(1, PingMessage, ka.ping())
+	if !ok {
+		t.Fatal("failed to pack ping")
+	}
+
+	if _, ok = unpackMessage(out); !ok {
+		t.Fatal("failed to unpack ping")
+	}
+
+	if _, ok = packMessage(1, PongMessage, message[:pingSize+1]); ok {
+		t.Fatal("packMessage should fail with an oversized pong")
+	}
+}
+
+func TestPing(t *testing.T) {
+	alice, bob := testBufferPair(t, nil, nil)
+
+	if !alice.Ping() {
+		t.Fatal("alice failed to send a ping")
+	}
+
+	if !alice.Send(message[:64]) {
+		t.Fatal("alice failed to send a message")
+	}
+
+	// Bob answers the ping and only returns the message.
+	m, ok := bob.Receive()
+	if !ok {
+		t.Fatal("bob failed to receive a message")
+	} else if m.Type != NormalMessage {
+		t.Fatalf("bob expected a normal message, have type %d", m.Type)
+	}
+
+	if !bob.Send(message[:64]) {
+		t.Fatal("bob failed to send a message")
+	}
+
+	if _, ok = alice.Receive(); !ok {
+		t.Fatal("alice failed to receive a message")
+	} else if alice.RTT() <= 0 {
+		t.Fatal("alice should have measured the round trip time")
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	dialer, listener := testTCPPair(t)
+	dialer.startKeepalive(10*time.Millisecond, time.Second)
+	go func() {
+		for {
+			if _, ok := listener.Receive(); !ok {
+				return
+			}
+		}
+	}()
+
+	received := make(chan bool, 1)
+	go func() {
+		_, ok := dialer.Receive()
+		received <- ok
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for dialer.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no pong was received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := dialer.Err(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	dialer.ka.halt()
+	if !listener.Send(message[:64]) {
+		t.Fatal("listener failed to send a message")
+	}
+
+	if !<-received {
+		t.Fatal("dialer failed to receive a message")
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	dialer, _ := testTCPPair(t)
+
+	// The listener never receives, so no pongs are sent.
+	dialer.startKeepalive(10*time.Millisecond, 50*time.Millisecond)
+	if _, ok := dialer.Receive(); ok {
+		t.Fatal("receive should fail once the peer has timed out")
+	}
+
+	if err := dialer.Err(); err != ErrPeerTimeout {
+		t.Fatalf("expected %v, have %v", ErrPeerTimeout, err)
+	}
+}
+
+func TestKeepaliveSendOnly(t *testing.T) {
+	dialer, listener := testTCPPair(t)
+	received := receiveAll(listener)
+
+	// The dialer never receives, so the pongs go unread; it should
+	// not time out the peer for that.
+	dialer.startKeepalive(10*time.Millisecond, 30*time.Millisecond)
+	defer dialer.ka.halt()
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if !dialer.Send(message[:64]) {
+			t.Fatalf("%v", dialer.Err())
+		}
+		<-received
+	}
+
+	if err := dialer.Err(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// receiveAll receives from sch in the background, as a Session would,
+// passing on normal messages until the channel fails.
+func receiveAll(sch *SChannel) <-chan []byte {
+	received := make(chan []byte, 16)
+	go func() {
+		defer close(received)
+		for {
+			m, ok := sch.Receive()
+			if !ok {
+				return
+			} else if m.Type == NormalMessage {
+				received <- m.Contents
+			}
+		}
+	}()
+	return received
+}
+
+// deadlineConn hides a connection's Close method, leaving only its
+// read deadline to interrupt a blocked read.
+type deadlineConn struct {
+	conn net.Conn
+}
+
+func (c deadlineConn) Read(p []byte) (int, error)  { return c.conn.Read(p) }
+func (c deadlineConn) Write(p []byte) (int, error) { return c.conn.Write(p) }
+
+func (c deadlineConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func TestKeepaliveTimeoutDeadline(t *testing.T) {
+	dialer, _ := testTCPPair(t)
+	dialer.Channel = deadlineConn{dialer.Channel.(net.Conn)}
+
+	dialer.startKeepalive(10*time.Millisecond, 50*time.Millisecond)
+	if _, ok := dialer.Receive(); ok {
+		t.Fatal("receive should fail once the peer has timed out")
+	}
+
+	if err := dialer.Err(); err != ErrPeerTimeout {
+		t.Fatalf("expected %v, have %v", ErrPeerTimeout, err)
+	}
+}
+
+func TestRekeyKeepalive(t *testing.T) {
+	dialer, listener := testTCPPair(t)
+	dialer.startKeepalive(time.Millisecond, time.Second)
+	listener.startKeepalive(time.Millisecond, time.Second)
+
+	dreceived, lreceived := receiveAll(dialer), receiveAll(listener)
+
+	// Both sides take turns rotating keys while pings are sent in
+	// both directions.
+	for i := 0; i < 10; i++ {
+		sender, receiver, received := dialer, listener, lreceived
+		if i%2 == 1 {
+			sender, receiver, received = listener, dialer, dreceived
+		}
+
+		if !receiver.Rekey() {
+			t.Fatalf("rekey %d failed", i)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		if !sender.Send(message[:64]) {
+			t.Fatalf("failed to send a message after rekey %d", i)
+		} else if m, ok := <-received; !ok || !bytes.Equal(m, message[:64]) {
+			t.Fatalf("failed to receive a message after rekey %d", i)
+		}
+	}
+
+	if err := dialer.Err(); err != nil {
+		t.Fatalf("%v", err)
+	} else if err = listener.Err(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package schannel
+
+import "sync/atomic"
+
+// Reasons a key exchange failed, as counted in Metrics.
+const (
+	// FailureVerify counts key exchanges where the signature on the
+	// peer's key exchange was invalid.
+	FailureVerify = "verify"
+
+	// FailureExchange counts key exchanges that failed for any
+	// other reason, such as an I/O error, a malformed key exchange
+	// or an unknown pre-shared key.
+	FailureExchange = "exchange"
+)
+
+// Metrics holds counters aggregated over every secure channel in the
+// process.
+type Metrics struct {
+	// Handshakes is the number of key exchanges that completed,
+	// and HandshakeFailures the number that failed, by reason.
+	Handshakes        uint64
+	HandshakeFailures map[string]uint64
+
+	// ActiveSessions is the number of secure channels that have
+	// been set up and not yet zeroised.
+	ActiveSessions int64
+
+	// MessagesSent and MessagesReceived count every message,
+	// including those used by the secure channel itself, such as
+	// pings. BytesSent and BytesReceived count the data in them, as
+	// SData and RData do for each channel.
+	MessagesSent     uint64
+	MessagesReceived uint64
+	BytesSent        uint64
+	BytesReceived    uint64
+
+	// Rekeys counts completed key rotations; each side of a
+	// channel counts its own.
+	Rekeys uint64
+
+	// Replays counts messages rejected because their sequence
+	// number had already been seen, and DecryptFailures counts
+	// frames that could not be authenticated.
+	Replays         uint64
+	DecryptFailures uint64
+}
+
+// metrics holds the process-wide counters; they are updated
+// atomically.
+var metrics struct {
+	handshakes       uint64
+	verifyFailures   uint64
+	exchangeFailures uint64
+	active           int64
+	messagesSent     uint64
+	messagesReceived uint64
+	bytesSent        uint64
+	bytesReceived    uint64
+	rekeys           uint64
+	replays          uint64
+	decryptFailures  uint64
+}
+
+// ReadMetrics returns the current values of the process-wide counters.
+func ReadMetrics() Metrics {
+	return Metrics{
+		Handshakes: atomic.LoadUint64(&metrics.handshakes),
+		HandshakeFailures: map[string]uint64{
+			FailureVerify:   atomic.LoadUint64(&metrics.verifyFailures),
+			FailureExchange: atomic.LoadUint64(&metrics.exchangeFailures),
+		},
+		ActiveSessions:   atomic.LoadInt64(&metrics.active),
+		MessagesSent:     atomic.LoadUint64(&metrics.messagesSent),
+		MessagesReceived: atomic.LoadUint64(&metrics.messagesReceived),
+		BytesSent:        atomic.LoadUint64(&metrics.bytesSent),
+		BytesReceived:    atomic.LoadUint64(&metrics.bytesReceived),
+		Rekeys:           atomic.LoadUint64(&metrics.rekeys),
+		Replays:          atomic.LoadUint64(&metrics.replays),
+		DecryptFailures:  atomic.LoadUint64(&metrics.decryptFailures),
+	}
+}
+
+// countSent and countReceived record a message of n bytes.
+func countSent(n int) {
+	atomic.AddUint64(&metrics.messagesSent, 1)
+	atomic.AddUint64(&metrics.bytesSent, uint64(n))
+}
+
+func countReceived(n int) {
+	atomic.AddUint64(&metrics.messagesReceived, 1)
+	atomic.AddUint64(&metrics.bytesReceived, uint64(n))
+}
+
+// count updates the counters for an event on the channel.
+func (sch *SChannel) count(t EventType) {
+	switch t {
+	case EventHandshakeComplete:
+		atomic.AddUint64(&metrics.handshakes, 1)
+		if atomic.CompareAndSwapInt32(&sch.active, 0, 1) {
+			atomic.AddInt64(&metrics.active, 1)
+		}
+	case EventVerifyFailed:
+		sch.verifyFailed = true
+	case EventHandshakeFailed:
+		if sch.verifyFailed {
+			atomic.AddUint64(&metrics.verifyFailures, 1)
+		} else {
+			atomic.AddUint64(&metrics.exchangeFailures, 1)
+		}
+	case EventRekeyComplete:
+		atomic.AddUint64(&metrics.rekeys, 1)
+	case EventReplay:
+		atomic.AddUint64(&metrics.replays, 1)
+	case EventDecryptFailed:
+		atomic.AddUint64(&metrics.decryptFailures, 1)
+	case EventZeroise:
+		// Zero may be called from more than one goroutine, but
+		// the session is only counted as ended once.
+		if atomic.CompareAndSwapInt32(&sch.active, 1, 0) {
+			atomic.AddInt64(&metrics.active, -1)
+		}
+	}
+}
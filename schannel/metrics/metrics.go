@@ -0,0 +1,101 @@
+// Package metrics exports the schannel package's process-wide metrics.
+// Importing it publishes them through expvar under the name
+// "schannel"; Handler serves them in the Prometheus text exposition
+// format.
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/kisom/go-schannel/schannel"
+)
+
+func init() {
+	expvar.Publish("schannel", expvar.Func(func() interface{} {
+		return schannel.ReadMetrics()
+	}))
+}
+
+// ContentType is the content type of the Prometheus text exposition
+// format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler returns an http.Handler that serves the current metrics in
+// the Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		WritePrometheus(w, schannel.ReadMetrics())
+	})
+}
+
+// metric writes one metric family. Each sample is a label set, which
+// may be empty, and a value.
+func metric(w io.Writer, name, kind, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %v\n", name, s.labels, s.value)
+	}
+}
+
+type sample struct {
+	labels string
+	value  interface{}
+}
+
+// WritePrometheus writes m to w in the Prometheus text exposition
+// format.
+func WritePrometheus(w io.Writer, m schannel.Metrics) error {
+	bw := bufio.NewWriter(w)
+
+	metric(bw, "schannel_handshakes_total", "counter",
+		"Key exchanges that completed.",
+		sample{"", m.Handshakes})
+
+	var reasons []string
+	for reason := range m.HandshakeFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	var failures []sample
+	for _, reason := range reasons {
+		failures = append(failures, sample{fmt.Sprintf("{reason=%q}", reason), m.HandshakeFailures[reason]})
+	}
+	metric(bw, "schannel_handshake_failures_total", "counter",
+		"Key exchanges that failed, by reason.", failures...)
+
+	metric(bw, "schannel_active_sessions", "gauge",
+		"Secure channels that have been set up and not yet zeroised.",
+		sample{"", m.ActiveSessions})
+
+	metric(bw, "schannel_messages_total", "counter",
+		"Messages sent and received, including control messages.",
+		sample{`{direction="sent"}`, m.MessagesSent},
+		sample{`{direction="received"}`, m.MessagesReceived})
+
+	metric(bw, "schannel_bytes_total", "counter",
+		"Bytes of messages sent and received.",
+		sample{`{direction="sent"}`, m.BytesSent},
+		sample{`{direction="received"}`, m.BytesReceived})
+
+	metric(bw, "schannel_rekeys_total", "counter",
+		"Key rotations completed.",
+		sample{"", m.Rekeys})
+
+	metric(bw, "schannel_replays_rejected_total", "counter",
+		"Messages rejected as replays.",
+		sample{"", m.Replays})
+
+	metric(bw, "schannel_decrypt_failures_total", "counter",
+		"Frames that could not be authenticated and decrypted.",
+		sample{"", m.DecryptFailures})
+
+	return bw.Flush()
+}
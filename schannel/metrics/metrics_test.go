@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kisom/go-schannel/schannel"
+)
+
+// testSession sets up a secure channel over a pipe, exchanges a
+// message and zeroises both ends.
+func testSession(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan *schannel.SChannel)
+	go func() {
+		sch, _ := schannel.ListenConfig(b, nil)
+		if sch != nil {
+			sch.Receive()
+		}
+		done <- sch
+	}()
+
+	sch, err := schannel.DialConfig(a, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	sch.Send([]byte("hello, world"))
+
+	listener := <-done
+	if listener == nil {
+		t.Fatal("failed to set up secure channel")
+	}
+	sch.Zero()
+	listener.Zero()
+}
+
+func TestMetrics(t *testing.T) {
+	before := schannel.ReadMetrics()
+	testSession(t)
+	after := schannel.ReadMetrics()
+
+	if after.Handshakes-before.Handshakes != 2 {
+		t.Fatalf("expected 2 handshakes, have %d", after.Handshakes-before.Handshakes)
+	} else if after.MessagesSent-before.MessagesSent != 1 {
+		t.Fatalf("expected 1 message sent, have %d", after.MessagesSent-before.MessagesSent)
+	} else if after.MessagesReceived-before.MessagesReceived != 1 {
+		t.Fatalf("expected 1 message received, have %d", after.MessagesReceived-before.MessagesReceived)
+	} else if after.ActiveSessions != before.ActiveSessions {
+		t.Fatalf("expected %d active sessions, have %d", before.ActiveSessions, after.ActiveSessions)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	testSession(t)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatalf("expected content type %q, have %q", ContentType, ct)
+	}
+
+	body, _ := io.ReadAll(w.Body)
+	for _, want := range []string{
+		"# TYPE schannel_handshakes_total counter\n",
+		`schannel_handshake_failures_total{reason="verify"} `,
+		`schannel_handshake_failures_total{reason="exchange"} `,
+		"# TYPE schannel_active_sessions gauge\n",
+		`schannel_messages_total{direction="sent"} `,
+		`schannel_bytes_total{direction="received"} `,
+		"schannel_rekeys_total ",
+		"schannel_replays_rejected_total ",
+		"schannel_decrypt_failures_total ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("expected %q in the output:\n%s", want, body)
+		}
+	}
+
+	if strings.Contains(string(body), "schannel_handshakes_total 0\n") {
+		t.Fatal("handshakes were not counted")
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	v := expvar.Get("schannel")
+	if v == nil {
+		t.Fatal("metrics were not published")
+	}
+
+	var m schannel.Metrics
+	if err := json.Unmarshal([]byte(v.String()), &m); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, ok := m.HandshakeFailures[schannel.FailureVerify]; !ok {
+		t.Fatal("handshake failures are missing")
+	}
+}
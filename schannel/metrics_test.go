@@ -0,0 +1,108 @@
+package schannel
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetricsFailures(t *testing.T) {
+	_, dpriv, lpub, _ := testIdentities(t)
+	before := ReadMetrics()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := DialConfig(a, &Config{Signer: dpriv})
+		done <- err
+	}()
+
+	if _, err := ListenConfig(b, &Config{Peer: lpub}); err == nil {
+		t.Fatal("the key exchange should fail")
+	}
+	b.Close()
+
+	if err := <-done; err == nil {
+		t.Fatal("the dialer's key exchange should fail")
+	}
+
+	after := ReadMetrics()
+	if after.HandshakeFailures[FailureVerify]-before.HandshakeFailures[FailureVerify] != 1 {
+		t.Fatal("the verification failure was not counted")
+	}
+
+	// The dialer's side failed when the listener hung up.
+	if after.HandshakeFailures[FailureExchange] == before.HandshakeFailures[FailureExchange] {
+		t.Fatal("the dialer's failure was not counted")
+	}
+}
+
+func TestMetricsSessions(t *testing.T) {
+	before := ReadMetrics()
+	dialer, listener := testTCPConfigPair(t, nil, nil)
+
+	if active := ReadMetrics().ActiveSessions - before.ActiveSessions; active != 2 {
+		t.Fatalf("expected 2 active sessions, have %d", active)
+	}
+
+	dialer.Send(message)
+	listener.Receive()
+	dialer.sctr = 0
+	dialer.Send(message)
+	listener.Receive()
+
+	dialer.Zero()
+	listener.Zero()
+	listener.Zero()
+
+	after := ReadMetrics()
+	if after.ActiveSessions != before.ActiveSessions {
+		t.Fatalf("expected %d active sessions, have %d", before.ActiveSessions, after.ActiveSessions)
+	} else if after.Replays == before.Replays {
+		t.Fatal("the replay was not counted")
+	} else if after.BytesSent-before.BytesSent < 2*uint64(len(message)) {
+		t.Fatal("the data sent was not counted")
+	}
+}
+
+// TestMetricsConcurrentZero zeroises a channel from several goroutines
+// at once, as a Server's handler and a Session may; the session should
+// only be counted as ended once.
+func TestMetricsConcurrentZero(t *testing.T) {
+	before := ReadMetrics()
+
+	var dev, lev eventRecorder
+	dialer, listener := testTCPConfigPair(t, &Config{Events: dev.record},
+		&Config{Events: lev.record})
+	session := NewSession(listener)
+
+	// The session zeroises the channel when the dialer hangs up,
+	// while the handler does the same.
+	shutdown := make(chan struct{})
+	go func() {
+		dialer.Shutdown(ShutdownNormal, "", time.Second)
+		close(shutdown)
+	}()
+	<-session.Done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listener.Zero()
+		}()
+	}
+	wg.Wait()
+	<-shutdown
+	dialer.Zero()
+
+	after := ReadMetrics()
+	if after.ActiveSessions != before.ActiveSessions {
+		t.Fatalf("expected %d active sessions, have %d", before.ActiveSessions, after.ActiveSessions)
+	}
+}
@@ -0,0 +1,652 @@
+package schannel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream frames are carried in StreamMessages; each starts with a
+// one-byte frame type and a four-byte stream ID.
+const (
+	streamOpen uint8 = iota + 1
+	streamData
+	streamClose
+	streamReset
+	streamWindow
+
+	streamHeaderSize = 5 // uint8 + uint32
+)
+
+const (
+	// StreamWindow is the amount of data that may be sent on a
+	// stream before the receiver has read it.
+	StreamWindow = 256 * 1024 // 256KiB
+
+	// acceptBacklog is the number of streams opened by the peer
+	// that may be waiting for AcceptStream; streams beyond this are
+	// reset.
+	acceptBacklog = 64
+)
+
+var (
+	// ErrSessionClosed is returned when the session, or the secure
+	// channel underneath it, has been closed.
+	ErrSessionClosed = errors.New("schannel: session closed")
+
+	// ErrStreamClosed is returned when reading from or writing to a
+	// stream that has been closed.
+	ErrStreamClosed = errors.New("schannel: stream closed")
+
+	// ErrStreamReset is returned when the peer reset the stream.
+	ErrStreamReset = errors.New("schannel: stream reset by peer")
+
+	// ErrStreamsExhausted is returned when no more stream IDs are
+	// available in the session.
+	ErrStreamsExhausted = errors.New("schannel: stream IDs exhausted")
+)
+
+// A Session multiplexes many streams over a single secure channel, so
+// that an application may run a control channel alongside several
+// bulk transfers with a single key exchange. Each stream has its own
+// flow control window, so a stream whose reader has stalled does not
+// block the others.
+//
+// Once a Session has been created, it owns the secure channel: it
+// receives all incoming messages, and the channel should not be used
+// directly except to send messages, which the peer's Session will
+// ignore. Keys may be rotated with Rekey while the session is in use;
+// the session's receiver reads the peer's answer, and streams wait for
+// the rotation to finish before sending.
+type Session struct {
+	sch  *SChannel
+	conn Channel
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// NewSession starts multiplexing streams over the secure channel. Both
+// peers must create a Session. Streams opened by the dialer have odd
+// IDs and those opened by the listener have even IDs, so both sides
+// may open streams at the same time.
+func NewSession(sch *SChannel) *Session {
+	s := &Session{
+		sch:     sch,
+		conn:    sch.Channel,
+		streams: map[uint32]*Stream{},
+		nextID:  2,
+		accept:  make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+
+	if sch.dialer {
+		s.nextID = 1
+	}
+
+	go s.run()
+	return s
+}
+
+// OpenStream opens a new stream to the peer.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+
+	id := s.nextID
+	if id+2 < id {
+		s.mu.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextID += 2
+
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if !s.sendFrame(streamOpen, id, nil) {
+		s.remove(id)
+		return nil, ErrSessionClosed
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the peer to open a stream.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		// Streams that were opened before the session closed
+		// may still be accepted.
+		select {
+		case st := <-s.accept:
+			return st, nil
+		default:
+			return nil, s.err
+		}
+	}
+}
+
+// Close sends a ShutdownMessage to the peer and closes all streams. If
+// the underlying channel implements io.Closer, it is closed; otherwise,
+// the session will finish when the peer closes its side. The secure
+// channel is zeroised once the session has finished.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	closed := s.err != nil
+	s.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	s.sch.sendShutdown(ShutdownNormal, "")
+	s.shutdown(ErrSessionClosed)
+	if c, ok := s.conn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Done returns a channel that is closed when the session finishes.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// run receives messages from the secure channel and dispatches them to
+// their streams.
+func (s *Session) run() {
+	for {
+		m, ok := s.sch.Receive()
+		if !ok {
+			break
+		}
+
+		if m.Type == ShutdownMessage {
+			break
+		} else if m.Type == StreamMessage {
+			s.handle(m.Contents)
+		}
+	}
+
+	s.shutdown(ErrSessionClosed)
+
+	s.sch.Zero()
+}
+
+func (s *Session) handle(frame []byte) {
+	if len(frame) < streamHeaderSize {
+		return
+	}
+
+	kind := frame[0]
+	id := binary.BigEndian.Uint32(frame[1:])
+	data := frame[streamHeaderSize:]
+
+	if kind == streamOpen {
+		s.opened(id)
+		return
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+
+	if st == nil {
+		if kind != streamReset {
+			go s.sendFrame(streamReset, id, nil)
+		}
+		return
+	}
+
+	switch kind {
+	case streamData:
+		if !st.push(data) {
+			st.abort(ErrStreamReset)
+			s.remove(id)
+			go s.sendFrame(streamReset, id, nil)
+		}
+	case streamClose:
+		st.remoteClose()
+	case streamReset:
+		st.abort(ErrStreamReset)
+		s.remove(id)
+	case streamWindow:
+		if len(data) == 4 {
+			st.grow(binary.BigEndian.Uint32(data))
+		}
+	}
+}
+
+// opened handles a stream opened by the peer.
+func (s *Session) opened(id uint32) {
+	// The peer may only open streams with its own parity.
+	peerParity := uint32(1)
+	if s.sch.dialer {
+		peerParity = 0
+	}
+
+	s.mu.Lock()
+	if id%2 != peerParity || s.streams[id] != nil || s.err != nil {
+		s.mu.Unlock()
+		go s.sendFrame(streamReset, id, nil)
+		return
+	}
+
+	st := newStream(s, id)
+	select {
+	case s.accept <- st:
+		s.streams[id] = st
+		s.mu.Unlock()
+	default:
+		s.mu.Unlock()
+		go s.sendFrame(streamReset, id, nil)
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+
+	s.err = err
+	close(s.done)
+	streams := s.streams
+	s.streams = map[uint32]*Stream{}
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		st.abort(err)
+	}
+}
+
+// sendFrame sends a stream frame to the peer.
+func (s *Session) sendFrame(kind uint8, id uint32, data []byte) bool {
+	frame := make([]byte, streamHeaderSize+len(data))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[streamHeaderSize:], data)
+	return s.sch.send(StreamMessage, frame)
+}
+
+// maxData is the largest amount of stream data that fits in a single
+// frame.
+func (s *Session) maxData() int {
+	return s.sch.maxSize - streamHeaderSize
+}
+
+// A Stream is a bidirectional byte stream within a Session. It
+// implements net.Conn.
+type Stream struct {
+	s  *Session
+	id uint32
+
+	// rmu and wmu serialise readers and writers, respectively.
+	rmu sync.Mutex
+	wmu sync.Mutex
+
+	mu        sync.Mutex
+	rbuf      []byte
+	rerr      error  // returned once rbuf is empty
+	werr      error  // returned by Write
+	consumed  uint32 // bytes read since the last window update
+	swindow   uint32 // bytes that may be sent before a window update
+	localFIN  bool
+	remoteFIN bool
+
+	readable  chan struct{}
+	writable  chan struct{}
+	rdeadline deadline
+	wdeadline deadline
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		s:         s,
+		id:        id,
+		swindow:   StreamWindow,
+		readable:  make(chan struct{}, 1),
+		writable:  make(chan struct{}, 1),
+		rdeadline: makeDeadline(),
+		wdeadline: makeDeadline(),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// ID returns the stream's ID.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads data sent by the peer on this stream. It returns io.EOF
+// once the peer has closed the stream and all data has been read.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.rmu.Lock()
+	defer st.rmu.Unlock()
+
+	for {
+		st.mu.Lock()
+		if len(st.rbuf) > 0 {
+			n := copy(p, st.rbuf)
+			zero(st.rbuf[:n], 0)
+			st.rbuf = st.rbuf[n:]
+
+			// Let the peer send more once half of the window
+			// has been consumed.
+			var increment uint32
+			st.consumed += uint32(n)
+			if st.consumed >= StreamWindow/2 && !st.remoteFIN {
+				increment = st.consumed
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+
+			if increment > 0 {
+				var inc [4]byte
+				binary.BigEndian.PutUint32(inc[:], increment)
+				st.s.sendFrame(streamWindow, st.id, inc[:])
+			}
+			return n, nil
+		}
+
+		if st.rerr != nil {
+			err := st.rerr
+			st.mu.Unlock()
+			return 0, err
+		}
+		st.mu.Unlock()
+
+		select {
+		case <-st.readable:
+		case <-st.rdeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write sends data to the peer on this stream, blocking while the
+// peer's receive window is full.
+func (st *Stream) Write(p []byte) (int, error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	var written int
+	for len(p) > 0 {
+		st.mu.Lock()
+		if st.werr != nil {
+			err := st.werr
+			st.mu.Unlock()
+			return written, err
+		}
+		window := st.swindow
+		st.mu.Unlock()
+
+		if window == 0 {
+			select {
+			case <-st.writable:
+				continue
+			case <-st.wdeadline.wait():
+				return written, os.ErrDeadlineExceeded
+			}
+		}
+
+		n := len(p)
+		if n > int(window) {
+			n = int(window)
+		}
+		if n > st.s.maxData() {
+			n = st.s.maxData()
+		}
+
+		if !st.s.sendFrame(streamData, st.id, p[:n]) {
+			return written, ErrSessionClosed
+		}
+
+		st.mu.Lock()
+		st.swindow -= uint32(n)
+		st.mu.Unlock()
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// CloseWrite closes the sending side of the stream; the peer will read
+// io.EOF once it has read all data sent so far. Data may still be read
+// from the stream.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.localFIN {
+		st.mu.Unlock()
+		return nil
+	}
+
+	if st.werr == nil {
+		st.werr = ErrStreamClosed
+	}
+	st.localFIN = true
+	finished := st.remoteFIN
+	st.mu.Unlock()
+	notify(st.writable)
+
+	if finished {
+		st.s.remove(st.id)
+	}
+
+	if !st.s.sendFrame(streamClose, st.id, nil) {
+		return ErrSessionClosed
+	}
+	return nil
+}
+
+// Close closes both sides of the stream. Any data the peer sends after
+// this causes the stream to be reset.
+func (st *Stream) Close() error {
+	err := st.CloseWrite()
+
+	st.mu.Lock()
+	zero(st.rbuf, 0)
+	st.rbuf = nil
+	if st.rerr == nil || st.rerr == io.EOF {
+		st.rerr = ErrStreamClosed
+	}
+	st.mu.Unlock()
+	notify(st.readable)
+	return err
+}
+
+// push adds data received from the peer, returning false if the peer
+// has sent more than the window allows or sent data after the stream
+// was closed.
+func (st *Stream) push(data []byte) bool {
+	st.mu.Lock()
+	defer notify(st.readable)
+	defer st.mu.Unlock()
+
+	if st.rerr != nil || st.remoteFIN {
+		return false
+	}
+
+	if len(st.rbuf)+len(data) > StreamWindow {
+		return false
+	}
+
+	st.rbuf = append(st.rbuf, data...)
+	return true
+}
+
+// remoteClose handles the peer closing its sending side.
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteFIN = true
+	if st.rerr == nil {
+		st.rerr = io.EOF
+	}
+	finished := st.localFIN
+	st.mu.Unlock()
+	notify(st.readable)
+
+	if finished {
+		st.s.remove(st.id)
+	}
+}
+
+// grow handles a window update from the peer.
+func (st *Stream) grow(increment uint32) {
+	st.mu.Lock()
+	if st.swindow+increment >= st.swindow {
+		st.swindow += increment
+	}
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+// abort fails any further reads and writes with err.
+func (st *Stream) abort(err error) {
+	st.mu.Lock()
+	if st.rerr == nil || st.rerr == io.EOF {
+		st.rerr = err
+	}
+	if st.werr == nil {
+		st.werr = err
+	}
+	zero(st.rbuf, 0)
+	st.rbuf = nil
+	st.mu.Unlock()
+
+	notify(st.readable)
+	notify(st.writable)
+}
+
+// streamAddr is used as the address of a stream when the underlying
+// channel is not a net.Conn.
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "schannel" }
+func (streamAddr) String() string  { return "schannel" }
+
+// LocalAddr returns the local address of the underlying connection.
+func (st *Stream) LocalAddr() net.Addr {
+	if conn, ok := st.s.conn.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return streamAddr{}
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (st *Stream) RemoteAddr() net.Addr {
+	if conn, ok := st.s.conn.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return streamAddr{}
+}
+
+// SetDeadline sets the read and write deadlines for the stream.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.rdeadline.set(t)
+	st.wdeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read calls.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.rdeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls; a write that
+// times out may have sent part of the data.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.wdeadline.set(t)
+	return nil
+}
+
+// A deadline is a channel that is closed once the deadline passes.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set changes the deadline; the zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer has fired; wait for it to close cancel.
+		<-d.cancel
+	}
+	d.timer = nil
+
+	expired := isClosed(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,266 @@
+package schannel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// testSessions sets up a pair of multiplexed sessions over a loopback
+// TCP connection.
+func testSessions(t *testing.T) (*Session, *Session) {
+	dialer, listener := testTCPPair(t)
+	client, server := NewSession(dialer), NewSession(listener)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStreamEcho(t *testing.T) {
+	client, server := testSessions(t)
+
+	go func() {
+		for {
+			st, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	streams := make([]*Stream, 4)
+	for i := range streams {
+		st, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("%v", err)
+		} else if st.ID()%2 != 1 {
+			t.Fatal("streams opened by the dialer should have odd IDs")
+		}
+		streams[i] = st
+	}
+
+	for _, st := range streams {
+		if _, err := st.Write(message); err != nil {
+			t.Fatalf("%v", err)
+		}
+		st.CloseWrite()
+	}
+
+	for _, st := range streams {
+		echo, err := ioutil.ReadAll(st)
+		if err != nil {
+			t.Fatalf("%v", err)
+		} else if !bytes.Equal(echo, message) {
+			t.Fatal("stream didn't echo the message")
+		}
+		st.Close()
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client, server := testSessions(t)
+
+	large := bytes.Repeat(message, (3*StreamWindow)/len(message))
+	done := make(chan error, 1)
+	go func() {
+		st, err := client.OpenStream()
+		if err != nil {
+			done <- err
+			return
+		}
+
+		_, err = st.Write(large)
+		st.CloseWrite()
+		done <- err
+	}()
+
+	st, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The writer must block once the window is full.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err = <-done:
+		t.Fatalf("write should block on a full window (err=%v)", err)
+	default:
+	}
+
+	// Meanwhile, other streams are not blocked.
+	other, err := server.OpenStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	} else if other.ID()%2 != 0 {
+		t.Fatal("streams opened by the listener should have even IDs")
+	}
+
+	accepted, err := client.AcceptStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	go other.Write(message)
+	p := make([]byte, len(message))
+	if _, err = io.ReadFull(accepted, p); err != nil {
+		t.Fatalf("%v", err)
+	} else if !bytes.Equal(p, message) {
+		t.Fatal("stream received the wrong data")
+	}
+
+	received, err := ioutil.ReadAll(st)
+	if err != nil {
+		t.Fatalf("%v", err)
+	} else if !bytes.Equal(received, large) {
+		t.Fatal("stream received the wrong data")
+	}
+
+	if err = <-done; err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	client, server := testSessions(t)
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	accepted.Close()
+
+	// Data sent after the peer has closed the stream causes it to
+	// be reset; the reset arrives asynchronously.
+	st.Write(message)
+	for i := 0; i < 100; i++ {
+		if _, err = st.Write(message); err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err != ErrStreamReset {
+		t.Fatalf("expected %v, have %v", ErrStreamReset, err)
+	}
+
+	if _, err = st.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("expected %v, have %v", ErrStreamReset, err)
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	client, _ := testSessions(t)
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	st.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = st.Read(make([]byte, 1))
+	if err != os.ErrDeadlineExceeded {
+		t.Fatalf("expected %v, have %v", os.ErrDeadlineExceeded, err)
+	} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatal("deadline errors should be timeouts")
+	}
+
+	st.SetReadDeadline(time.Time{})
+	st.SetWriteDeadline(time.Now().Add(-time.Second))
+	st.mu.Lock()
+	st.swindow = 0
+	st.mu.Unlock()
+	if _, err = st.Write(message); err != os.ErrDeadlineExceeded {
+		t.Fatalf("expected %v, have %v", os.ErrDeadlineExceeded, err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := testSessions(t)
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	client.Close()
+	<-server.Done()
+
+	if _, err = accepted.Read(make([]byte, 1)); err != ErrSessionClosed {
+		t.Fatalf("expected %v, have %v", ErrSessionClosed, err)
+	}
+
+	if _, err = st.Write(message); err != ErrSessionClosed {
+		t.Fatalf("expected %v, have %v", ErrSessionClosed, err)
+	}
+
+	if _, err = server.OpenStream(); err != ErrSessionClosed {
+		t.Fatalf("expected %v, have %v", ErrSessionClosed, err)
+	}
+
+	if _, err = server.AcceptStream(); err != ErrSessionClosed {
+		t.Fatalf("expected %v, have %v", ErrSessionClosed, err)
+	}
+}
+
+func TestSessionRekey(t *testing.T) {
+	client, server := testSessions(t)
+
+	go func() {
+		st, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(st, st)
+		st.CloseWrite()
+	}()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The stream is written to while the dialer rotates its keys.
+	const count = 32
+	go func() {
+		for i := 0; i < count; i++ {
+			if _, err := st.Write(message); err != nil {
+				return
+			}
+		}
+		st.CloseWrite()
+	}()
+
+	for i := 0; i < 8; i++ {
+		if !client.sch.Rekey() {
+			t.Fatalf("rekey %d failed", i)
+		}
+	}
+
+	echo, err := ioutil.ReadAll(st)
+	if err != nil {
+		t.Fatalf("%v", err)
+	} else if !bytes.Equal(echo, bytes.Repeat(message, count)) {
+		t.Fatal("stream didn't echo the messages")
+	}
+}
@@ -0,0 +1,142 @@
+package schannel
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+)
+
+// A PaddingPolicy returns the number of bytes of padding to add to a
+// message of the given size, so that the length of the ciphertext
+// does not reveal the length of the message. The padding is trimmed
+// if it would make the message larger than the maximum message size.
+type PaddingPolicy func(size int) int
+
+// PadToMultiple pads messages to a multiple of block bytes.
+func PadToMultiple(block int) PaddingPolicy {
+	return func(size int) int {
+		if block <= 1 {
+			return 0
+		}
+		return (block - size%block) % block
+	}
+}
+
+// PadToBuckets pads messages to the smallest of the bucket sizes that
+// can hold them. Messages larger than every bucket are padded to a
+// multiple of the largest bucket.
+func PadToBuckets(buckets ...int) PaddingPolicy {
+	sorted := make([]int, 0, len(buckets))
+	for _, b := range buckets {
+		if b > 0 {
+			sorted = append(sorted, b)
+		}
+	}
+	sort.Ints(sorted)
+
+	return func(size int) int {
+		if len(sorted) == 0 {
+			return 0
+		}
+
+		for _, b := range sorted {
+			if size <= b {
+				return b - size
+			}
+		}
+		return PadToMultiple(sorted[len(sorted)-1])(size)
+	}
+}
+
+// PadRandom adds between zero and max bytes of padding, chosen at
+// random for each message.
+func PadRandom(max int) PaddingPolicy {
+	return func(int) int {
+		return randInt(max + 1)
+	}
+}
+
+// randInt returns a random integer in [0, n), or zero if the PRNG
+// fails.
+func randInt(n int) int {
+	if n <= 1 {
+		return 0
+	}
+
+	var b [8]byte
+	if _, err := io.ReadFull(prng, b[:]); err != nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(b[:]) % uint64(n))
+}
+
+// padding returns the amount of padding to add to a message of n
+// bytes.
+func (sch *SChannel) padding(n int) int {
+	if sch.pad == nil {
+		return 0
+	}
+
+	pad := sch.pad(n)
+	if pad < 0 {
+		return 0
+	} else if pad > sch.maxSize-n {
+		return sch.maxSize - n
+	}
+	return pad
+}
+
+// maxCoverSize is the largest cover message sent automatically, before
+// padding.
+const maxCoverSize = 256
+
+// SendCover sends a cover message carrying n meaningless bytes, padded
+// as any other message would be. The peer's Receive discards cover
+// messages. Cover messages are sent automatically if a cover interval
+// was configured; like other messages, they wait for a key rotation in
+// progress to finish.
+func (sch *SChannel) SendCover(n int) bool {
+	if n <= 0 {
+		return false
+	}
+
+	buf := getBuffer(n)
+	defer putBuffer(buf)
+	return sch.send(CoverMessage, *buf)
+}
+
+// startCover begins sending cover messages at random intervals that
+// average interval. Each carries up to size bytes.
+func (sch *SChannel) startCover(interval time.Duration, size int) {
+	if interval <= 0 {
+		return
+	}
+
+	if size > maxCoverSize {
+		size = maxCoverSize
+	}
+
+	sch.coverStop = make(chan struct{})
+	go sch.runCover(sch.coverStop, interval, size)
+}
+
+func (sch *SChannel) runCover(stop chan struct{}, interval time.Duration, size int) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		if !sch.SendCover(1 + randInt(size)) {
+			return
+		}
+
+		// Delays are spread evenly over [interval/2, 3*interval/2).
+		timer.Reset(interval/2 + time.Duration(randInt(int(interval))))
+	}
+}
@@ -0,0 +1,196 @@
+package schannel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPaddingPolicies(t *testing.T) {
+	var tests = []struct {
+		policy PaddingPolicy
+		size   int
+		pad    int
+	}{
+		{PadToMultiple(64), 1, 63},
+		{PadToMultiple(64), 64, 0},
+		{PadToMultiple(64), 65, 63},
+		{PadToMultiple(0), 65, 0},
+		{PadToBuckets(1024, 64, 256), 1, 63},
+		{PadToBuckets(1024, 64, 256), 100, 156},
+		{PadToBuckets(1024, 64, 256), 1024, 0},
+		{PadToBuckets(1024, 64, 256), 1025, 1023},
+		{PadToBuckets(), 100, 0},
+	}
+
+	for i, test := range tests {
+		if pad := test.policy(test.size); pad != test.pad {
+			t.Fatalf("test %d: expected %d bytes of padding, have %d",
+				i, test.pad, pad)
+		}
+	}
+
+	random := PadRandom(16)
+	for i := 0; i < 64; i++ {
+		if pad := random(1); pad < 0 || pad > 16 {
+			t.Fatalf("random padding out of range: %d", pad)
+		}
+	}
+}
+
+func TestPaddedEnvelope(t *testing.T) {
+	m := message[:64]
+	out, ok := appendMessage(nil, 1, NormalMessage, m, 32, 0)
+	if !ok {
+		t.Fatal("failed to pack padded message")
+	} else if len(out) != messageOverhead+len(m)+32 {
+		t.Fatal("padded message has the wrong length")
+	}
+
+	e, ok := unpackMessage(out)
+	if !ok {
+		t.Fatal("failed to unpack padded message")
+	} else if e.Version != extendedVersion {
+		t.Fatal("padded message should use the padded envelope version")
+	} else if !bytes.Equal(e.Payload, m) {
+		t.Fatal("invalid payload")
+	}
+
+	out[len(out)-1] = 1
+	if _, ok = unpackMessage(out); ok {
+		t.Fatal("unpackMessage should fail with non-zero padding")
+	}
+
+	out = testPackMessage(1, 1, currentVersion, 0, NormalMessage, []byte{1, 0})
+	if _, ok = unpackMessage(out); ok {
+		t.Fatal("unpackMessage should fail with trailing data in an unpadded envelope")
+	}
+
+	out = testPackMessage(1, 1, extendedVersion, 2, NormalMessage, []byte{1, 0})
+	if _, ok = unpackMessage(out); ok {
+		t.Fatal("unpackMessage should fail with unknown flags")
+	}
+}
+
+func TestPaddedChannel(t *testing.T) {
+	cfg := &Config{Padding: PadToMultiple(256)}
+	alice, bob := testBufferPair(t, cfg, nil)
+	buf := alice.Channel.(*bytes.Buffer)
+
+	var sizes []int
+	for _, n := range []int{1, 100, 200} {
+		before := buf.Len()
+		if !alice.Send(message[:n]) {
+			t.Fatal("alice failed to send a message")
+		}
+		sizes = append(sizes, buf.Len()-before)
+
+		m, ok := bob.Receive()
+		if !ok {
+			t.Fatal("bob failed to receive a padded message")
+		} else if !bytes.Equal(m.Contents, message[:n]) {
+			t.Fatal("bob didn't get the message alice sent")
+		}
+	}
+
+	if sizes[0] != sizes[1] || sizes[1] != sizes[2] {
+		t.Fatalf("padded frames should have the same length: %v", sizes)
+	}
+
+	before := buf.Len()
+	if !alice.SendBatch([][]byte{message[:1], message[:200]}) {
+		t.Fatal("alice failed to send a batch")
+	} else if buf.Len()-before != 2*sizes[0] {
+		t.Fatal("batched messages should be padded")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := bob.Receive(); !ok {
+			t.Fatal("bob failed to receive a padded message")
+		}
+	}
+}
+
+func TestPaddingTrimmed(t *testing.T) {
+	cfg := &Config{Padding: PadToMultiple(256), MaxMessageSize: 300}
+	alice, bob := testBufferPair(t, cfg, cfg)
+
+	// The padding would take the message past the maximum message
+	// size, so it is trimmed.
+	large := bytes.Repeat([]byte{1}, 260)
+	if alice.padding(len(large)) != 40 {
+		t.Fatal("padding should be trimmed to the maximum message size")
+	}
+
+	if !alice.Send(large) {
+		t.Fatal("alice failed to send a message")
+	}
+
+	if m, ok := bob.Receive(); !ok {
+		t.Fatal("bob failed to receive a padded message")
+	} else if !bytes.Equal(m.Contents, large) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+}
+
+func TestCoverTraffic(t *testing.T) {
+	alice, bob := testBufferPair(t, nil, nil)
+
+	if !alice.SendCover(64) {
+		t.Fatal("alice failed to send cover traffic")
+	}
+
+	if !alice.Send(message[:64]) {
+		t.Fatal("alice failed to send a message")
+	}
+
+	m, ok := bob.Receive()
+	if !ok {
+		t.Fatal("bob failed to receive a message")
+	} else if m.Type != NormalMessage {
+		t.Fatal("bob should discard cover traffic")
+	} else if bob.RCtr() != 2 {
+		t.Fatal("bob should have received the cover message")
+	}
+}
+
+func TestCoverInterval(t *testing.T) {
+	dialer, listener := testTCPPair(t)
+	dialer.startCover(5*time.Millisecond, dialer.maxSize)
+
+	time.Sleep(50 * time.Millisecond)
+	if !dialer.Send(message[:64]) {
+		t.Fatal("dialer failed to send a message")
+	}
+
+	m, ok := listener.Receive()
+	if !ok {
+		t.Fatal("listener failed to receive a message")
+	} else if m.Type != NormalMessage {
+		t.Fatal("listener should discard cover traffic")
+	} else if listener.RCtr() < 2 {
+		t.Fatal("no cover traffic was sent")
+	}
+}
+
+func TestRekeyCover(t *testing.T) {
+	dialer, listener := testTCPPair(t)
+	dialer.startCover(time.Millisecond, dialer.maxSize)
+	listener.startCover(time.Millisecond, listener.maxSize)
+
+	received := receiveAll(listener)
+	go receiveAll(dialer)
+
+	for i := 0; i < 10; i++ {
+		if !dialer.Rekey() {
+			t.Fatalf("rekey %d failed", i)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		if !dialer.Send(message[:64]) {
+			t.Fatalf("failed to send a message after rekey %d", i)
+		} else if m, ok := <-received; !ok || !bytes.Equal(m, message[:64]) {
+			t.Fatalf("failed to receive a message after rekey %d", i)
+		}
+	}
+}
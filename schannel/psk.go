@@ -0,0 +1,97 @@
+package schannel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+)
+
+const (
+	// PSKSize is the size of a pre-shared key.
+	PSKSize = 32
+
+	// MaxPSKIdentitySize is the maximum length of a PSK identity
+	// hint.
+	MaxPSKIdentitySize = 255
+)
+
+// pskLabel is used to separate PSK key derivation from any other use
+// of the pre-shared key.
+var pskLabel = []byte("schannel PSK v1")
+
+// A PSK is a pre-shared symmetric key. Devices that cannot store or
+// use an identity signature key can instead share a secret with their
+// peer; an attacker without the key cannot derive the session keys,
+// so the channel is protected against man-in-the-middle attacks even
+// when the key exchange is not signed.
+type PSK struct {
+	// Identity is a hint, sent in the clear, that allows the
+	// listener to select the right key. It may be empty, but must
+	// not be longer than MaxPSKIdentitySize.
+	Identity []byte
+
+	// Key is the pre-shared key.
+	Key *[PSKSize]byte
+}
+
+// A PSKLookup is used by a listener to select a pre-shared key given
+// the identity hint sent by the dialer. It should return nil if the
+// identity is not recognised.
+type PSKLookup func(identity []byte) *[PSKSize]byte
+
+func (sch *SChannel) setPSK(id []byte, key *[PSKSize]byte) bool {
+	if key == nil || len(id) > MaxPSKIdentitySize {
+		return false
+	}
+
+	copy(sch.psk[:], key[:])
+	sch.pskID = make([]byte, len(id))
+	copy(sch.pskID, id)
+	sch.usePSK = true
+	return true
+}
+
+// mixPSK derives a new key from a shared key produced by the ECDH
+// exchange and the pre-shared key, if the channel is in PSK mode. The
+// identity hint is included so that both sides must agree on it.
+func (sch *SChannel) mixPSK(key *[KeySize]byte) {
+	if !sch.usePSK {
+		return
+	}
+
+	h := hmac.New(sha256.New, sch.psk[:])
+	h.Write(pskLabel)
+	h.Write([]byte{byte(len(sch.pskID))})
+	h.Write(sch.pskID)
+	h.Write(key[:])
+	mixed := h.Sum(nil)
+	copy(key[:], mixed)
+	zero(mixed, 0)
+}
+
+// writePSKIdentity sends the identity hint as a single length byte
+// followed by the hint.
+func writePSKIdentity(w io.Writer, id []byte) bool {
+	if len(id) > MaxPSKIdentitySize {
+		return false
+	}
+
+	out := make([]byte, 1+len(id))
+	out[0] = byte(len(id))
+	copy(out[1:], id)
+	n, err := w.Write(out)
+	return err == nil && n == len(out)
+}
+
+func readPSKIdentity(r io.Reader) ([]byte, bool) {
+	var idLen [1]byte
+	if _, err := io.ReadFull(r, idLen[:]); err != nil {
+		return nil, false
+	}
+
+	id := make([]byte, int(idLen[0]))
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, false
+	}
+	return id, true
+}
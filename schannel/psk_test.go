@@ -0,0 +1,123 @@
+package schannel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/agl/ed25519"
+)
+
+type handshakeResult struct {
+	sch *SChannel
+	ok  bool
+}
+
+// testHandshake runs dial and listen concurrently over an in-memory
+// connection, returning the dialing and listening secure channels.
+func testHandshake(dial, listen func(Channel) (*SChannel, bool)) (handshakeResult, handshakeResult) {
+	client, server := net.Pipe()
+
+	results := make(chan handshakeResult, 1)
+	go func() {
+		sch, ok := dial(client)
+		if !ok {
+			client.Close()
+		}
+		results <- handshakeResult{sch, ok}
+	}()
+
+	sch, ok := listen(server)
+	if !ok {
+		server.Close()
+	}
+	return <-results, handshakeResult{sch, ok}
+}
+
+func TestPSK(t *testing.T) {
+	var key [PSKSize]byte
+	key[0] = 42
+	id := []byte("sensor-17")
+	lookup := func(hint []byte) *[PSKSize]byte {
+		if !bytes.Equal(hint, id) {
+			return nil
+		}
+		return &key
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	dialer, listener := testHandshake(func(ch Channel) (*SChannel, bool) {
+		return DialPSK(ch, nil, pub, &PSK{Identity: id, Key: &key})
+	}, func(ch Channel) (*SChannel, bool) {
+		return ListenPSK(ch, priv, nil, lookup)
+	})
+	if !dialer.ok || !listener.ok {
+		t.Fatal("failed to set up PSK secure channel")
+	}
+
+	go dialer.sch.Send(message)
+	m, ok := listener.sch.Receive()
+	if !ok {
+		t.Fatal("failed to receive message over PSK secure channel")
+	} else if !bytes.Equal(m.Contents, message) {
+		t.Fatal("listener didn't get the message the dialer sent")
+	}
+	dialer.sch.Channel.(net.Conn).Close()
+}
+
+func TestPSKMismatch(t *testing.T) {
+	var key, wrong [PSKSize]byte
+	key[0] = 42
+	wrong[0] = 43
+
+	dialer, listener := testHandshake(func(ch Channel) (*SChannel, bool) {
+		return DialPSK(ch, nil, nil, &PSK{Key: &wrong})
+	}, func(ch Channel) (*SChannel, bool) {
+		return ListenPSK(ch, nil, nil, func([]byte) *[PSKSize]byte {
+			return &key
+		})
+	})
+	if !dialer.ok || !listener.ok {
+		t.Fatal("handshake should complete without key confirmation")
+	}
+
+	go dialer.sch.Send(message)
+	if _, ok := listener.sch.Receive(); ok {
+		t.Fatal("message should not decrypt with mismatched PSKs")
+	}
+	dialer.sch.Channel.(net.Conn).Close()
+}
+
+func TestPSKUnknownIdentity(t *testing.T) {
+	var key [PSKSize]byte
+
+	dialer, listener := testHandshake(func(ch Channel) (*SChannel, bool) {
+		return DialPSK(ch, nil, nil, &PSK{Identity: []byte("unknown"), Key: &key})
+	}, func(ch Channel) (*SChannel, bool) {
+		return ListenPSK(ch, nil, nil, func([]byte) *[PSKSize]byte {
+			return nil
+		})
+	})
+	if dialer.ok || listener.ok {
+		t.Fatal("handshake should fail with an unknown PSK identity")
+	}
+}
+
+func TestPSKIdentityTooLong(t *testing.T) {
+	var key [PSKSize]byte
+	var buf bytes.Buffer
+
+	psk := &PSK{Identity: make([]byte, MaxPSKIdentitySize+1), Key: &key}
+	if _, ok := DialPSK(&buf, nil, nil, psk); ok {
+		t.Fatal("DialPSK should fail with an oversized identity")
+	}
+
+	if writePSKIdentity(&buf, psk.Identity) {
+		t.Fatal("writePSKIdentity should fail with an oversized identity")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build race
+
+package schannel
+
+// raceEnabled is set when the race detector is enabled; sync.Pool
+// deliberately drops items under the race detector, so allocation
+// counts are not meaningful.
+const raceEnabled = true
@@ -0,0 +1,91 @@
+package schannel
+
+import "io"
+
+// readBufferSize is the amount of data read from the insecure channel
+// at once when receiving messages.
+const readBufferSize = 4096
+
+// A frameReader buffers reads from the insecure channel, so that
+// receiving a small frame costs a single read instead of one for the
+// length prefix and another for the body. Bytes are zeroised as soon
+// as they are consumed, and the buffer is returned to the pool once it
+// has been drained so that idle channels do not hold on to it.
+type frameReader struct {
+	buf   *[]byte
+	start int
+	end   int
+}
+
+// buffered returns the number of bytes waiting in the buffer.
+func (fr *frameReader) buffered() int {
+	return fr.end - fr.start
+}
+
+// fill reads from r into an empty buffer.
+func (fr *frameReader) fill(r io.Reader) error {
+	if fr.buf == nil {
+		fr.buf = getBuffer(readBufferSize)
+	}
+
+	for {
+		n, err := r.Read(*fr.buf)
+		if n > 0 {
+			// Any error will be returned again by the next read
+			// once the buffered data has been consumed.
+			fr.start, fr.end = 0, n
+			return nil
+		}
+
+		if err != nil {
+			fr.release()
+			return err
+		}
+	}
+}
+
+// readFull reads exactly len(p) bytes, as io.ReadFull would, using
+// buffered data first. Reads that are larger than the buffer go
+// directly to r once the buffered data has been used.
+func (fr *frameReader) readFull(r io.Reader, p []byte) error {
+	for len(p) > 0 {
+		if fr.buffered() == 0 {
+			fr.release()
+			if len(p) >= readBufferSize {
+				_, err := io.ReadFull(r, p)
+				return err
+			}
+
+			if err := fr.fill(r); err != nil {
+				return err
+			}
+		}
+
+		consumed := (*fr.buf)[fr.start:fr.end]
+		n := copy(p, consumed)
+		zero(consumed[:n], 0)
+		fr.start += n
+		p = p[n:]
+	}
+
+	if fr.buffered() == 0 {
+		fr.release()
+	}
+	return nil
+}
+
+// release zeroises any buffered data and returns the buffer to the
+// pool.
+func (fr *frameReader) release() {
+	if fr.buf == nil {
+		return
+	}
+
+	// Consumed bytes have already been zeroised, and nothing was
+	// read past the end of the buffered data.
+	zero((*fr.buf)[fr.start:fr.end], 0)
+	*fr.buf = (*fr.buf)[:0]
+	putBuffer(fr.buf)
+	fr.buf = nil
+	fr.start, fr.end = 0, 0
+}
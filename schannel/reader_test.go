@@ -0,0 +1,169 @@
+package schannel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// countingReader counts the calls to Read.
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	cr.reads++
+	return cr.Reader.Read(p)
+}
+
+func TestFrameReader(t *testing.T) {
+	var fr frameReader
+	in := newBuffer(64)
+	cr := &countingReader{Reader: bytes.NewReader(in)}
+
+	p := make([]byte, 16)
+	if err := fr.readFull(cr, p); err != nil {
+		t.Fatalf("%v", err)
+	} else if !bytes.Equal(p, in[:16]) {
+		t.Fatal("frameReader returned the wrong data")
+	}
+
+	verifyZeroised((*fr.buf)[:fr.start], t)
+	verifyNotZeroised((*fr.buf)[fr.start:fr.end], t)
+
+	p = make([]byte, 48)
+	if err := fr.readFull(cr, p); err != nil {
+		t.Fatalf("%v", err)
+	} else if !bytes.Equal(p, in[16:]) {
+		t.Fatal("frameReader returned the wrong data")
+	}
+
+	if cr.reads != 1 {
+		t.Fatalf("expected a single read, have %d", cr.reads)
+	} else if fr.buf != nil {
+		t.Fatal("frameReader should release its buffer once drained")
+	}
+
+	if err := fr.readFull(cr, p); err != io.EOF {
+		t.Fatalf("expected %v, have %v", io.EOF, err)
+	}
+}
+
+func TestFrameReaderLarge(t *testing.T) {
+	var fr frameReader
+	in := newBuffer(readBufferSize * 2)
+	cr := &countingReader{Reader: bytes.NewReader(in)}
+
+	p := make([]byte, 8)
+	if err := fr.readFull(cr, p); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	p = make([]byte, len(in)-8)
+	if err := fr.readFull(cr, p); err != nil {
+		t.Fatalf("%v", err)
+	} else if !bytes.Equal(p, in[8:]) {
+		t.Fatal("frameReader returned the wrong data")
+	}
+
+	p = make([]byte, 8)
+	if err := fr.readFull(cr, p); err != io.EOF {
+		t.Fatalf("expected %v, have %v", io.EOF, err)
+	}
+}
+
+func TestSingleReadPerFrame(t *testing.T) {
+	alice, bob := testBufferPair(t, nil, nil)
+	buf := &bytes.Buffer{}
+	cr := &countingReader{Reader: buf}
+	alice.Channel = buf
+	bob.Channel = struct {
+		io.Reader
+		io.Writer
+	}{cr, buf}
+
+	if !alice.SendBatch([][]byte{message[:64], message[64:128]}) {
+		t.Fatal("alice failed to send messages")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := bob.Receive(); !ok {
+			t.Fatal("bob failed to receive a message")
+		}
+	}
+
+	if cr.reads != 1 {
+		t.Fatalf("expected a single read for both frames, have %d", cr.reads)
+	}
+}
+
+func BenchmarkTCPReceive(b *testing.B) {
+	alice, bob := testTCPPair(b)
+
+	batch := make([][]byte, 64)
+	for i := range batch {
+		batch[i] = message[:64]
+	}
+
+	go func() {
+		for i := 0; i < b.N; i += len(batch) {
+			if !alice.SendBatch(batch) {
+				return
+			}
+		}
+	}()
+
+	p := make([]byte, 64)
+	b.ReportAllocs()
+	b.SetBytes(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, ok := bob.ReceiveInto(p); !ok {
+			b.Fatal("receive failed")
+		}
+	}
+}
+
+// signalingChannel reports when a read starts.
+type signalingChannel struct {
+	Channel
+	reading chan struct{}
+}
+
+func (sc *signalingChannel) Read(p []byte) (int, error) {
+	select {
+	case sc.reading <- struct{}{}:
+	default:
+	}
+	return sc.Channel.Read(p)
+}
+
+// TestZeroWhileReceiving zeroises a channel while another goroutine is
+// blocked reading from it, as a Session's receiver may be. The read
+// buffer must stay with the receiver until its read returns.
+func TestZeroWhileReceiving(t *testing.T) {
+	alice, bob := testTCPPair(t)
+	sc := &signalingChannel{Channel: bob.Channel, reading: make(chan struct{}, 1)}
+	bob.Channel = sc
+
+	received := make(chan bool, 1)
+	go func() {
+		_, ok := bob.Receive()
+		received <- ok
+	}()
+
+	<-sc.reading
+	bob.Zero()
+	if !alice.Send(message) {
+		t.Fatal("alice failed to send a message")
+	}
+
+	if <-received {
+		t.Fatal("receive should fail once the channel has been zeroised")
+	} else if bob.rbuf.buf != nil {
+		t.Fatal("the read buffer should have been released")
+	} else if !bytes.Equal(bob.rkey[:], make([]byte, KeySize)) {
+		t.Fatal("the receive key should have been wiped")
+	}
+}
@@ -0,0 +1,241 @@
+package schannel
+
+// A rekey tracks a key rotation started with Rekey. Once the key
+// exchange has been sent, nothing else may be sealed with the old send
+// key, as the peer switches to the new keys as soon as it reads the
+// exchange; other senders wait on done until the rotation finishes.
+type rekey struct {
+	sk   [kexPrvSize]byte
+	done chan struct{}
+	ok   bool
+
+	// queued holds the messages the receiver had to answer while
+	// the rotation was in progress, such as pongs; they are sent
+	// with the new keys.
+	queued []queuedMessage
+}
+
+type queuedMessage struct {
+	t MessageType
+	m []byte
+}
+
+// lockSend takes the send lock, first waiting for any key rotation in
+// progress to finish. It returns false, without the lock, if a
+// rotation failed and the peers no longer share keys.
+func (sch *SChannel) lockSend() bool {
+	for {
+		sch.smu.Lock()
+		rk := sch.rekey
+		if rk == nil {
+			break
+		}
+		sch.smu.Unlock()
+		<-rk.done
+	}
+
+	if sch.stale {
+		sch.smu.Unlock()
+		return false
+	}
+	return true
+}
+
+// reply sends a message on behalf of the receiver, which cannot wait
+// for a key rotation that only it can finish. During a rotation, the
+// message is queued and sent once the new keys are in place.
+func (sch *SChannel) reply(t MessageType, m []byte) bool {
+	sch.smu.Lock()
+	defer sch.smu.Unlock()
+
+	if sch.stale {
+		return false
+	} else if sch.rekey != nil {
+		sch.rekey.queued = append(sch.rekey.queued, queuedMessage{t, append([]byte(nil), m...)})
+		return true
+	}
+	return sch.replyLocked(t, m)
+}
+
+// replyLocked sends a reply; the caller must hold the send lock. A
+// shutdown is only sent if one hasn't been already.
+func (sch *SChannel) replyLocked(t MessageType, m []byte) bool {
+	if t == ShutdownMessage {
+		return sch.sendShutdownLocked(m)
+	}
+	return sch.sendLocked(t, m)
+}
+
+// startRekey sends a new key exchange to the peer and marks the
+// rotation as in progress.
+func (sch *SChannel) startRekey() (*rekey, bool) {
+	rk := &rekey{done: make(chan struct{})}
+	var pk [kexPubSize]byte
+	if !generateKeypair(&rk.sk, &pk) {
+		return nil, false
+	}
+
+	if !sch.lockSend() {
+		zero(rk.sk[:], 0)
+		return nil, false
+	}
+	defer sch.smu.Unlock()
+
+	if !sch.sendLocked(KEXMessage, pk[:]) {
+		zero(rk.sk[:], 0)
+		return nil, false
+	}
+
+	sch.rekey = rk
+	return rk, true
+}
+
+// finishRekey completes the rotation in progress with the peer's
+// answering key exchange, then sends the queued replies. The caller
+// must hold the send lock.
+func (sch *SChannel) finishRekey(pub []byte) bool {
+	rk := sch.rekey
+	sch.rekey = nil
+
+	rk.ok = sch.doKEX(rk.sk[:], pub, true)
+	zero(rk.sk[:], 0)
+	if !rk.ok {
+		sch.stale = true
+	} else {
+		for _, q := range rk.queued {
+			sch.replyLocked(q.t, q.m)
+		}
+	}
+
+	close(rk.done)
+	return rk.ok
+}
+
+// abandonRekey fails the rotation in progress, if any; the peers may
+// no longer share keys, so nothing more can be sent. The caller must
+// hold the send lock.
+func (sch *SChannel) abandonRekey() {
+	rk := sch.rekey
+	if rk == nil {
+		return
+	}
+
+	sch.rekey = nil
+	sch.stale = true
+	zero(rk.sk[:], 0)
+	close(rk.done)
+}
+
+func (sch *SChannel) failRekey() {
+	sch.smu.Lock()
+	defer sch.smu.Unlock()
+	sch.abandonRekey()
+}
+
+// receiveKEX handles a key exchange from the peer. If a rotation
+// started with Rekey is waiting for it, the rotation is completed;
+// otherwise, the peer started the rotation, and it is answered, in
+// which case answered is true. The send lock is held until the new
+// keys are in place, so that no other message is sealed with the old
+// send key after the peer has switched to the new one.
+func (sch *SChannel) receiveKEX(e *envelope) (answered, ok bool) {
+	if e == nil || kexPubSize != int(e.PayloadLength) {
+		return false, false
+	}
+
+	sch.smu.Lock()
+	defer sch.smu.Unlock()
+
+	if !sch.Ready() || sch.stale {
+		return false, false
+	} else if sch.rekey != nil {
+		return false, sch.finishRekey(e.Payload[:kexPubSize])
+	}
+
+	var sk [kexPrvSize]byte
+	var pk [kexPubSize]byte
+
+	if !generateKeypair(&sk, &pk) {
+		return false, false
+	}
+
+	if !sch.sendLocked(KEXMessage, pk[:]) {
+		return false, false
+	}
+
+	if !sch.doKEX(sk[:], e.Payload[:kexPubSize], false) {
+		return false, false
+	}
+
+	return true, true
+}
+
+// Rekey initiates a key rotation with the other side. Both sides will
+// generate new session private keys, and exchange their public
+// halves. These session keys will not be signed, as the channel is
+// assumed to be authenticated and secure at this point. Generally,
+// key rotation will not be an issue. However, peers may elect to
+// rekey after a certain time period, a certain number of messages
+// have been sent, or a certain amount of data will be sent. Keys
+// cannot be rotated in datagram mode.
+//
+// Messages sent from other goroutines, including keepalives and cover
+// traffic, wait until the rotation has finished. If another goroutine
+// is receiving, as a Session does, it reads the peer's answer and
+// Rekey waits for it to do so; otherwise, Rekey receives the answer
+// itself, and any messages that arrive first are returned by the next
+// calls to Receive. If Rekey fails, nothing more can be sent, and the
+// channel should be zeroised. Only one peer should rotate keys at a
+// time; if both call Rekey at once, the channel fails.
+func (sch *SChannel) Rekey() bool {
+	if !sch.Ready() {
+		return false
+	} else if sch.datagram {
+		return false
+	}
+
+	sch.event(EventRekeyStart, nil)
+	rk, ok := sch.startRekey()
+	if !ok {
+		return false
+	}
+
+	if sch.rmu.TryLock() {
+		sch.awaitRekey(rk)
+		sch.rmu.Unlock()
+	}
+
+	<-rk.done
+	if !rk.ok {
+		return false
+	}
+
+	sch.event(EventRekeyComplete, nil)
+	return true
+}
+
+// awaitRekey receives until the peer answers the rotation; the caller
+// must hold the receive lock. Messages that arrive first are held for
+// the next calls to Receive.
+func (sch *SChannel) awaitRekey(rk *rekey) {
+	buf := getBuffer(0)
+	defer putBuffer(buf)
+
+	for {
+		var e envelope
+		if !sch.receiveLocked(buf, &e) {
+			sch.failRekey()
+			return
+		}
+
+		select {
+		case <-rk.done:
+			return
+		default:
+		}
+
+		held := e
+		held.Payload = append([]byte(nil), e.Payload...)
+		sch.held = append(sch.held, &held)
+	}
+}
@@ -0,0 +1,440 @@
+package schannel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// DefaultTicketLifetime is how long a session ticket may be used to
+// resume a session if no lifetime is configured.
+const DefaultTicketLifetime = 24 * time.Hour
+
+const (
+	// handshakeFull and handshakeResume are sent by a dialer using
+	// resumption to choose the kind of handshake.
+	handshakeFull   = 0
+	handshakeResume = 1
+
+	ticketKeyIDSize = 4
+	ticketVersion   = 1
+
+	// ticketPlainSize is the size of a ticket's contents: version,
+	// issue time, flags, peer identity and resumption secret.
+	ticketPlainSize = 1 + 8 + 1 + IdentityPublicSize + KeySize
+
+	// ticketSize is the size of a sealed ticket.
+	ticketSize = ticketKeyIDSize + nonceSize + secretbox.Overhead + ticketPlainSize
+
+	// ticketMessageSize is the size of a TicketMessage: the ticket
+	// lifetime followed by the sealed ticket.
+	ticketMessageSize = 8 + ticketSize
+
+	// ticketVerified is set in a ticket's flags if the dialer's
+	// identity was verified in the session that issued it.
+	ticketVerified = 1
+
+	// maxTicketKeys is the number of ticket keys kept; tickets
+	// sealed with a key that has been rotated out are rejected.
+	maxTicketKeys = 2
+)
+
+var (
+	// resumptionLabel separates the resumption secret from the
+	// session keys it is derived from.
+	resumptionLabel = []byte("schannel resumption v1")
+
+	// resumptionID is used as the PSK identity when the resumption
+	// secret is mixed into the session keys.
+	resumptionID = []byte("resumption")
+)
+
+type ticketKey struct {
+	id  [ticketKeyIDSize]byte
+	key [KeySize]byte
+}
+
+// TicketKeys hold the keys a listener uses to seal and open session
+// tickets. Rotating the keys regularly limits how long a stolen ticket
+// key can be used to resume sessions; tickets sealed with the previous
+// key remain valid until the next rotation. TicketKeys may be shared
+// by several listeners.
+type TicketKeys struct {
+	mu   sync.RWMutex
+	keys []ticketKey
+}
+
+// NewTicketKeys returns a set of ticket keys with a fresh random key.
+func NewTicketKeys() (*TicketKeys, bool) {
+	tk := &TicketKeys{}
+	if !tk.Rotate() {
+		return nil, false
+	}
+	return tk, true
+}
+
+// Rotate generates a new key for sealing tickets. The previous key is
+// kept for opening tickets that have already been issued; older keys
+// are zeroised.
+func (tk *TicketKeys) Rotate() bool {
+	var k ticketKey
+	if _, err := io.ReadFull(prng, k.id[:]); err != nil {
+		return false
+	}
+
+	if _, err := io.ReadFull(prng, k.key[:]); err != nil {
+		return false
+	}
+
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	tk.keys = append([]ticketKey{k}, tk.keys...)
+	for len(tk.keys) > maxTicketKeys {
+		last := &tk.keys[len(tk.keys)-1]
+		zero(last.key[:], 0)
+		tk.keys = tk.keys[:len(tk.keys)-1]
+	}
+	zero(k.key[:], 0)
+	return true
+}
+
+// Zero wipes the ticket keys; no tickets can be issued or opened
+// afterwards.
+func (tk *TicketKeys) Zero() {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	for i := range tk.keys {
+		zero(tk.keys[i].key[:], 0)
+	}
+	tk.keys = nil
+}
+
+// seal seals the ticket contents with the current key.
+func (tk *TicketKeys) seal(plain []byte) ([]byte, bool) {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+
+	if len(tk.keys) == 0 {
+		return nil, false
+	}
+
+	out := make([]byte, ticketKeyIDSize+nonceSize, ticketSize)
+	copy(out, tk.keys[0].id[:])
+	if _, err := io.ReadFull(prng, out[ticketKeyIDSize:]); err != nil {
+		return nil, false
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], out[ticketKeyIDSize:])
+	return secretbox.Seal(out, plain, &nonce, &tk.keys[0].key), true
+}
+
+// open opens a ticket sealed with the current or previous key.
+func (tk *TicketKeys) open(ticket []byte) ([]byte, bool) {
+	if len(ticket) != ticketSize {
+		return nil, false
+	}
+
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+
+	for i := range tk.keys {
+		if !hmac.Equal(tk.keys[i].id[:], ticket[:ticketKeyIDSize]) {
+			continue
+		}
+
+		var nonce [nonceSize]byte
+		copy(nonce[:], ticket[ticketKeyIDSize:])
+		return secretbox.Open(nil, ticket[ticketKeyIDSize+nonceSize:], &nonce, &tk.keys[i].key)
+	}
+	return nil, false
+}
+
+// A Ticket is held by a dialer to resume a session with the listener
+// that issued it. Tickets are only kept in memory; a Ticket should be
+// zeroised once it is no longer needed.
+type Ticket struct {
+	opaque   []byte
+	secret   [KeySize]byte
+	peer     [IdentityPublicSize]byte
+	verified bool
+	expires  time.Time
+}
+
+// Expires returns the time after which the listener will no longer
+// accept the ticket.
+func (t *Ticket) Expires() time.Time {
+	return t.expires
+}
+
+// Zero wipes the ticket.
+func (t *Ticket) Zero() {
+	zero(t.secret[:], 0)
+	t.opaque = nil
+	t.verified = false
+}
+
+// usable returns true if the ticket may be used to resume a session
+// with a listener identified by peer.
+func (t *Ticket) usable(peer *[IdentityPublicSize]byte) bool {
+	if t == nil || t.opaque == nil || !time.Now().Before(t.expires) {
+		return false
+	}
+
+	if peer != nil {
+		return t.verified && hmac.Equal(t.peer[:], peer[:])
+	}
+	return true
+}
+
+// Resumed returns true if the secure channel was set up by resuming
+// an earlier session.
+func (sch *SChannel) Resumed() bool {
+	return sch.resumed
+}
+
+// Ticket returns the session ticket issued by the listener when the
+// channel was set up, which may be passed in the Config of a later
+// dial to resume the session. It returns nil if no ticket was issued.
+func (sch *SChannel) Ticket() *Ticket {
+	return sch.ticket
+}
+
+// resumptionSecret derives the secret used to resume the session from
+// the session keys. It must be called before the keys are rotated.
+func (sch *SChannel) resumptionSecret(dialer bool) [KeySize]byte {
+	// The A->B key is the dialer's send key and the listener's
+	// receive key.
+	ab, ba := &sch.skey, &sch.rkey
+	if !dialer {
+		ab, ba = ba, ab
+	}
+
+	h := hmac.New(sha256.New, ab[:])
+	h.Write(resumptionLabel)
+	h.Write(ba[:])
+
+	var secret [KeySize]byte
+	sum := h.Sum(nil)
+	copy(secret[:], sum)
+	zero(sum, 0)
+	return secret
+}
+
+// dialResume starts a handshake with a listener that supports
+// resumption. If the ticket can be used, it is presented to the
+// listener; if the listener accepts it, the session is resumed and
+// dialResume returns true. Otherwise, the caller should continue with
+// a full handshake.
+func (sch *SChannel) dialResume(ch Channel, ticket *Ticket, peer *[IdentityPublicSize]byte) (bool, bool) {
+	if !ticket.usable(peer) {
+		n, err := ch.Write([]byte{handshakeFull})
+		return false, err == nil && n == 1
+	}
+
+	var sk [kexPrvSize]byte
+	var pk [kexPubSize]byte
+	if !generateKeypair(&sk, &pk) {
+		return false, false
+	}
+	defer zero(sk[:], 0)
+	sch.markFeatures(pk[:])
+
+	req := make([]byte, 0, 3+ticketSize+kexPubSize)
+	req = append(req, handshakeResume, 0, 0)
+	binary.BigEndian.PutUint16(req[1:], uint16(len(ticket.opaque)))
+	req = append(req, ticket.opaque...)
+	req = append(req, pk[:]...)
+	if n, err := ch.Write(req); err != nil || n != len(req) {
+		return false, false
+	}
+
+	var status [1]byte
+	if _, err := io.ReadFull(ch, status[:]); err != nil {
+		return false, false
+	} else if status[0] != handshakeResume {
+		// The listener refused the ticket.
+		return false, status[0] == handshakeFull
+	}
+
+	var peerPK [kexPubSize]byte
+	if _, err := io.ReadFull(ch, peerPK[:]); err != nil {
+		return false, false
+	}
+
+	if !sch.setPSK(resumptionID, &ticket.secret) {
+		return false, false
+	}
+
+	sch.takeFeatures(peerPK[:])
+	if !sch.doKEX(sk[:], peerPK[:], true) {
+		return false, false
+	}
+	return true, true
+}
+
+// listenResume reads the handshake mode chosen by the dialer and, if
+// the dialer presented a valid ticket, resumes the session. It returns
+// false if the caller should continue with a full handshake.
+func (sch *SChannel) listenResume(ch Channel, keys *TicketKeys, lifetime time.Duration, peer *[IdentityPublicSize]byte) (bool, bool) {
+	var mode [1]byte
+	if _, err := io.ReadFull(ch, mode[:]); err != nil {
+		return false, false
+	}
+
+	switch mode[0] {
+	case handshakeFull:
+		return false, true
+	case handshakeResume:
+	default:
+		return false, false
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(ch, length[:]); err != nil {
+		return false, false
+	} else if binary.BigEndian.Uint16(length[:]) != ticketSize {
+		return false, false
+	}
+
+	req := make([]byte, ticketSize+kexPubSize)
+	if _, err := io.ReadFull(ch, req); err != nil {
+		return false, false
+	}
+
+	secret, ok := openTicket(keys, req[:ticketSize], lifetime, peer)
+	if !ok {
+		n, err := ch.Write([]byte{handshakeFull})
+		return false, err == nil && n == 1
+	}
+	defer zero(secret[:], 0)
+
+	var sk [kexPrvSize]byte
+	var pk [kexPubSize]byte
+	if !generateKeypair(&sk, &pk) {
+		return false, false
+	}
+	defer zero(sk[:], 0)
+	sch.markFeatures(pk[:])
+
+	resp := append([]byte{handshakeResume}, pk[:]...)
+	if n, err := ch.Write(resp); err != nil || n != len(resp) {
+		return false, false
+	}
+
+	if !sch.setPSK(resumptionID, &secret) {
+		return false, false
+	}
+
+	sch.takeFeatures(req[ticketSize:])
+	if !sch.doKEX(sk[:], req[ticketSize:], false) {
+		return false, false
+	}
+	return true, true
+}
+
+// openTicket checks a ticket presented by a dialer, returning its
+// resumption secret.
+func openTicket(keys *TicketKeys, ticket []byte, lifetime time.Duration, peer *[IdentityPublicSize]byte) ([KeySize]byte, bool) {
+	var secret [KeySize]byte
+	plain, ok := keys.open(ticket)
+	if !ok {
+		return secret, false
+	}
+	defer zero(plain, 0)
+
+	if len(plain) != ticketPlainSize || plain[0] != ticketVersion {
+		return secret, false
+	}
+
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(plain[1:])))
+	if age := time.Since(issued); age < 0 || age > lifetime {
+		return secret, false
+	}
+
+	// A resumed session skips signature verification, so the
+	// ticket must come from a session that verified the same peer.
+	if peer != nil {
+		if plain[9]&ticketVerified == 0 {
+			return secret, false
+		} else if !hmac.Equal(plain[10:10+IdentityPublicSize], peer[:]) {
+			return secret, false
+		}
+	}
+
+	copy(secret[:], plain[10+IdentityPublicSize:])
+	return secret, true
+}
+
+// issueTicket seals a ticket for the dialer and sends it over the
+// secure channel. It must be called by the listener before any other
+// message is sent.
+func (sch *SChannel) issueTicket(keys *TicketKeys, lifetime time.Duration, peer *[IdentityPublicSize]byte) bool {
+	plain := make([]byte, ticketPlainSize)
+	defer zero(plain, 0)
+
+	plain[0] = ticketVersion
+	binary.BigEndian.PutUint64(plain[1:], uint64(time.Now().UnixNano()))
+	if peer != nil {
+		plain[9] = ticketVerified
+		copy(plain[10:], peer[:])
+	}
+
+	secret := sch.resumptionSecret(false)
+	copy(plain[10+IdentityPublicSize:], secret[:])
+	zero(secret[:], 0)
+
+	ticket, ok := keys.seal(plain)
+	if !ok {
+		return false
+	}
+
+	m := make([]byte, 8, ticketMessageSize)
+	binary.BigEndian.PutUint64(m, uint64(lifetime))
+	m = append(m, ticket...)
+	return sch.send(TicketMessage, m)
+}
+
+// receiveTicket reads the ticket issued by the listener, which must be
+// the first message it sends.
+func (sch *SChannel) receiveTicket(peer *[IdentityPublicSize]byte) bool {
+	buf := getBuffer(0)
+	defer putBuffer(buf)
+
+	out, ok := sch.open(*buf)
+	if !ok {
+		return false
+	}
+	*buf = out
+
+	var e envelope
+	if !parseMessage(out, &e) || e.Type != TicketMessage {
+		return false
+	} else if e.Sequence <= sch.rctr {
+		return false
+	}
+	atomic.StoreUint32(&sch.rctr, e.Sequence)
+
+	lifetime := time.Duration(binary.BigEndian.Uint64(e.Payload))
+	t := &Ticket{
+		opaque:  make([]byte, ticketSize),
+		secret:  sch.resumptionSecret(true),
+		expires: time.Now().Add(lifetime),
+	}
+	copy(t.opaque, e.Payload[8:])
+	if peer != nil {
+		t.verified = true
+		copy(t.peer[:], peer[:])
+	}
+
+	sch.ticket = t
+	return true
+}
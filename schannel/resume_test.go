@@ -0,0 +1,149 @@
+package schannel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+)
+
+// testResumeHandshake sets up a secure channel over a pipe with the
+// given configurations. The pipe is closed when the test finishes.
+func testResumeHandshake(t *testing.T, dcfg, lcfg *Config) (handshakeResult, handshakeResult) {
+	dialer, listener := testHandshake(func(ch Channel) (*SChannel, bool) {
+		sch, err := DialConfig(ch, dcfg)
+		return sch, err == nil
+	}, func(ch Channel) (*SChannel, bool) {
+		sch, err := ListenConfig(ch, lcfg)
+		return sch, err == nil
+	})
+
+	if dialer.ok {
+		conn := dialer.sch.Channel.(net.Conn)
+		t.Cleanup(func() { conn.Close() })
+	}
+	return dialer, listener
+}
+
+func TestResumption(t *testing.T) {
+	keys, ok := NewTicketKeys()
+	if !ok {
+		t.Fatal("failed to generate ticket keys")
+	}
+
+	lcfg := &Config{TicketKeys: keys}
+	alice, bob := testBufferPair(t, &Config{Resumption: true}, lcfg)
+	if alice.Resumed() || bob.Resumed() {
+		t.Fatal("the first session should use a full handshake")
+	}
+
+	ticket := alice.Ticket()
+	if ticket == nil {
+		t.Fatal("the listener should issue a ticket")
+	} else if !ticket.Expires().After(time.Now().Add(time.Hour)) {
+		t.Fatal("the ticket should use the default lifetime")
+	}
+
+	alice, bob = testBufferPair(t, &Config{Ticket: ticket}, lcfg)
+	if !alice.Resumed() || !bob.Resumed() {
+		t.Fatal("the session should have been resumed")
+	} else if alice.Ticket() == nil {
+		t.Fatal("the listener should issue a new ticket on resumption")
+	}
+
+	if !alice.Send(message) {
+		t.Fatal("alice failed to send a message")
+	}
+
+	m, ok := bob.Receive()
+	if !ok {
+		t.Fatal("bob failed to receive a message")
+	} else if !bytes.Equal(m.Contents, message) {
+		t.Fatal("bob didn't get the message alice sent")
+	}
+
+	// Resumed sessions use fresh keys.
+	first, _ := testBufferPair(t, &Config{Ticket: ticket}, lcfg)
+	if first.skey == alice.skey {
+		t.Fatal("resumed sessions should not share keys")
+	}
+}
+
+func TestResumptionFallback(t *testing.T) {
+	keys, _ := NewTicketKeys()
+	lcfg := &Config{TicketKeys: keys}
+	alice, _ := testBufferPair(t, &Config{Resumption: true}, lcfg)
+	ticket := alice.Ticket()
+
+	// Tickets sealed with the previous key are still accepted.
+	keys.Rotate()
+	alice, _ = testBufferPair(t, &Config{Ticket: ticket}, lcfg)
+	if !alice.Resumed() {
+		t.Fatal("the session should have been resumed after one rotation")
+	}
+
+	keys.Rotate()
+	alice, bob := testBufferPair(t, &Config{Ticket: ticket}, lcfg)
+	if alice.Resumed() || bob.Resumed() {
+		t.Fatal("the listener should refuse a ticket whose key was rotated out")
+	}
+
+	// A ticket the listener considers expired is refused.
+	lcfg = &Config{TicketKeys: keys, TicketLifetime: time.Millisecond}
+	alice, _ = testBufferPair(t, &Config{Resumption: true}, lcfg)
+	ticket = alice.Ticket()
+	time.Sleep(5 * time.Millisecond)
+	ticket.expires = time.Now().Add(time.Hour)
+
+	alice, bob = testBufferPair(t, &Config{Ticket: ticket}, lcfg)
+	if alice.Resumed() || bob.Resumed() {
+		t.Fatal("the listener should refuse an expired ticket")
+	}
+
+	ticket.Zero()
+	if ticket.usable(nil) {
+		t.Fatal("a zeroised ticket should not be used")
+	}
+}
+
+func TestResumptionIdentity(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	keys, _ := NewTicketKeys()
+	lcfg := &Config{TicketKeys: keys, Peer: pub}
+	alice, _ := testBufferPair(t, &Config{Resumption: true, Signer: priv}, lcfg)
+	ticket := alice.Ticket()
+
+	// The dialer doesn't need to sign a resumed session.
+	alice, _ = testBufferPair(t, &Config{Ticket: ticket}, lcfg)
+	if !alice.Resumed() {
+		t.Fatal("the session should have been resumed")
+	}
+
+	// The ticket was issued to a session that verified a different
+	// peer, so the listener falls back to a full handshake, which
+	// fails without a signature.
+	lcfg = &Config{TicketKeys: keys, Peer: other}
+	dialer, listener := testResumeHandshake(t, &Config{Ticket: ticket}, lcfg)
+	if dialer.ok || listener.ok {
+		t.Fatal("the listener should refuse a ticket for another peer")
+	}
+
+	// The dialer only uses tickets issued by the peer it expects.
+	dcfg := &Config{Ticket: ticket, Peer: pub}
+	alice, _ = testBufferPair(t, dcfg, &Config{TicketKeys: keys, Signer: priv})
+	if alice.Resumed() {
+		t.Fatal("the dialer should not present a ticket for another peer")
+	}
+}
@@ -1,9 +1,13 @@
 package schannel
 
 import (
+	"compress/flate"
 	"crypto/rand"
 	"encoding/binary"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/agl/ed25519"
 	"golang.org/x/crypto/nacl/box"
@@ -20,9 +24,15 @@ const (
 var prng = rand.Reader
 
 const (
-	// BufSize is the maximum size of an encrypted message.
+	// BufSize is the maximum size of an encrypted message. This is
+	// the default maximum message size for a secure channel.
 	BufSize = 2097152 // 2MiB: 2 * 1024 * 1024B
 
+	// MinMessageSize is the smallest maximum message size that a
+	// secure channel may be configured with; it must be able to
+	// carry a key exchange.
+	MinMessageSize = kexPubSize
+
 	// IdentityPrivateSize is the size of an identity private key.
 	IdentityPrivateSize = ed25519.PrivateKeySize
 
@@ -56,7 +66,8 @@ type SChannel struct {
 
 	// rctr and sctr store message sequence numbers. rctr stores the
 	// last received message number, and sctr stores the last sent
-	// message number.
+	// message number. The counters and data totals are updated
+	// atomically, as events may report them from other goroutines.
 	rctr uint32
 	sctr uint32
 
@@ -65,35 +76,130 @@ type SChannel struct {
 	rkey [KeySize]byte
 	skey [KeySize]byte
 
-	// buf stores the internal buffer used for incoming messages.
-	buf [BufSize + Overhead]byte
+	// rhdr holds the length prefix of an incoming frame.
+	rhdr [frameHeaderSize]byte
+
+	// rbuf buffers data read from the insecure channel once the
+	// secure channel has been established.
+	rbuf frameReader
+
+	// maxSize is the largest message that may be sent or received
+	// over the channel.
+	maxSize int
+
+	// maxReassembly is the largest message that ReceiveLarge will
+	// reassemble from fragments.
+	maxReassembly int
 
 	// Channel is the insecure channel the SChannel is built on.
 	Channel Channel
 
 	// ready is set to true when the SChannel is established and
-	// fully set up.
-	ready bool
-
-	// kexip is used to track when a key exchange is in progress.
-	kexip bool
+	// fully set up, and zeroed is set atomically once it has been
+	// zeroised.
+	ready  bool
+	zeroed int32
+
+	// rekey is set while a key rotation started with Rekey is in
+	// progress, and stale once one has failed; both are guarded by
+	// the send lock.
+	rekey *rekey
+	stale bool
+
+	// dialer is true if the channel was set up with Dial.
+	dialer bool
+
+	// smu serialises sending, so that messages may be sent from
+	// several goroutines while another receives.
+	smu sync.Mutex
+
+	// rmu serialises receiving; held holds the messages that Rekey
+	// received while waiting for the peer's answer, which are
+	// returned by the next calls to Receive. The receive key, the
+	// read buffer and held are guarded by rmu.
+	rmu  sync.Mutex
+	held []*envelope
+
+	// psk and pskID hold the pre-shared key and its identity hint
+	// when the channel was set up in PSK mode; usePSK indicates
+	// that they are present.
+	psk    [PSKSize]byte
+	pskID  []byte
+	usePSK bool
+
+	// ka holds the keepalive state, and err records why the channel
+	// was torn down; err is guarded by emu.
+	ka  keepalive
+	emu sync.Mutex
+	err error
+
+	// pad, if not nil, chooses the padding added to each message.
+	pad PaddingPolicy
+
+	// coverStop is closed to stop sending cover traffic.
+	coverStop chan struct{}
+
+	// inflating is true if compressed messages are accepted, and
+	// deflating is true if the peer said in the key exchange that it
+	// accepts them too. fw is only used while holding the send lock, and fr
+	// is only used by the receiver.
+	inflating bool
+	deflating bool
+	fw        *flate.Writer
+	fr        io.ReadCloser
+
+	// shutdown is set once a shutdown message has been sent; it is
+	// guarded by the send lock.
+	shutdown bool
+
+	// resumed is true if the session was resumed with a ticket, and
+	// ticket holds the ticket issued to a dialer.
+	resumed bool
+	ticket  *Ticket
+
+	// datagram is true if each frame is sent in its own datagram. In
+	// datagram mode, window filters replayed messages, and hsReq and
+	// hsResp hold the listener's side of the key exchange so that it
+	// can be answered again if the dialer retransmits it.
+	datagram bool
+	window   replayWindow
+	hsReq    []byte
+	hsResp   []byte
+
+	// events, if not nil, reports events in the life of the
+	// channel; addr and peer describe the peer in them.
+	events func(Event)
+	addr   net.Addr
+	peer   *Fingerprint
+
+	// active is 1 while the channel is counted as an active session
+	// in the metrics, and is changed atomically; verifyFailed is set
+	// if the peer's signature was rejected during the key exchange.
+	active       int32
+	verifyFailed bool
 }
 
 // RCtr returns the last received message counter.
 func (sch *SChannel) RCtr() uint32 {
-	return sch.rctr
+	return atomic.LoadUint32(&sch.rctr)
 }
 
 // SCtr returns the last sent message counter.
 func (sch *SChannel) SCtr() uint32 {
-	return sch.sctr
+	return atomic.LoadUint32(&sch.sctr)
+}
+
+// MaxMessageSize returns the size of the largest message that may be
+// sent or received over the secure channel.
+func (sch *SChannel) MaxMessageSize() int {
+	return sch.maxSize
 }
 
 // Ready returns true if the secure channel is ready to send or receive
 // messages. If it returns false, the secure channel should be zeroised
 // and discarded.
 func (sch *SChannel) Ready() bool {
-	return sch.ready
+	return sch.ready && atomic.LoadInt32(&sch.zeroed) == 0
 }
 
 func (sch *SChannel) resetCounters() {
@@ -101,10 +207,10 @@ func (sch *SChannel) resetCounters() {
 		return
 	}
 
-	sch.RData = 0
-	sch.SData = 0
-	sch.rctr = 0
-	sch.sctr = 0
+	atomic.StoreUint64(&sch.RData, 0)
+	atomic.StoreUint64(&sch.SData, 0)
+	atomic.StoreUint32(&sch.rctr, 0)
+	atomic.StoreUint32(&sch.sctr, 0)
 }
 
 func (sch *SChannel) reset() {
@@ -112,13 +218,57 @@ func (sch *SChannel) reset() {
 		return
 	}
 
-	sch.resetCounters()
+	sch.maxSize = BufSize
+	sch.maxReassembly = DefaultMaxReassemblySize
 	sch.ready = false
-	sch.kexip = false
 	sch.Channel = nil
-	zero(sch.buf[:], 0)
-	zero(sch.rkey[:], 0)
+	sch.inflating = false
+	sch.resumed = false
+	sch.datagram = false
+	sch.events = nil
+	sch.addr = nil
+	sch.peer = nil
+	sch.verifyFailed = false
+	sch.resetSend()
+	sch.resetReceive()
+}
+
+// resetSend wipes the state used to send messages; the caller must
+// hold the send lock.
+func (sch *SChannel) resetSend() {
+	atomic.StoreUint64(&sch.SData, 0)
+	atomic.StoreUint32(&sch.sctr, 0)
+	sch.stale = false
 	zero(sch.skey[:], 0)
+	zero(sch.psk[:], 0)
+	sch.pskID = nil
+	sch.usePSK = false
+	sch.pad = nil
+	sch.deflating = false
+	sch.fw = nil
+	sch.shutdown = false
+	if sch.coverStop != nil {
+		close(sch.coverStop)
+		sch.coverStop = nil
+	}
+}
+
+// resetReceive wipes the state used to receive messages, and returns
+// the read buffer to the pool; the caller must hold the receive lock.
+func (sch *SChannel) resetReceive() {
+	atomic.StoreUint64(&sch.RData, 0)
+	atomic.StoreUint32(&sch.rctr, 0)
+	zero(sch.rkey[:], 0)
+	sch.rbuf.release()
+	for _, e := range sch.held {
+		zero(e.Payload, 0)
+	}
+	sch.held = nil
+	sch.fr = nil
+	sch.ticket = nil
+	sch.window = replayWindow{}
+	sch.hsReq = nil
+	sch.hsResp = nil
 }
 
 func generateKeypair(sk *[kexPrvSize]byte, pk *[kexPubSize]byte) bool {
@@ -220,11 +370,13 @@ func (sch *SChannel) doKEX(sk []byte, pk []byte, dialer bool) bool {
 		keyExchange(&sch.skey, sk[32:], pk[32:])
 	}
 
+	sch.mixPSK(&sch.skey)
+	sch.mixPSK(&sch.rkey)
 	return true
 }
 
 // dialKEX handles the initial dialing key exchange.
-func (sch *SChannel) dialKEX(ch Channel, signer *[IdentityPrivateSize]byte, peer *[IdentityPublicSize]byte) bool {
+func (sch *SChannel) dialKEX(ch Channel, signer *[IdentityPrivateSize]byte, peer *[IdentityPublicSize]byte, psk *PSK) bool {
 	var sk [kexPrvSize]byte
 	var pk [kexPubSize]byte
 
@@ -234,6 +386,7 @@ func (sch *SChannel) dialKEX(ch Channel, signer *[IdentityPrivateSize]byte, peer
 
 	var kex [kexPubSize + SignatureSize]byte
 	copy(kex[:], pk[:])
+	sch.markFeatures(kex[:kexPubSize])
 
 	if !signKEX(&kex, signer) {
 		return false
@@ -244,6 +397,16 @@ func (sch *SChannel) dialKEX(ch Channel, signer *[IdentityPrivateSize]byte, peer
 		return false
 	}
 
+	if psk != nil {
+		if !sch.setPSK(psk.Identity, psk.Key) {
+			return false
+		}
+
+		if !writePSKIdentity(ch, psk.Identity) {
+			return false
+		}
+	}
+
 	zero(kex[:], 0)
 	_, err = io.ReadFull(ch, kex[:])
 	if err != nil {
@@ -251,9 +414,13 @@ func (sch *SChannel) dialKEX(ch Channel, signer *[IdentityPrivateSize]byte, peer
 	}
 
 	if !verifyKEX(&kex, peer) {
+		sch.event(EventVerifyFailed, nil)
 		return false
+	} else if peer != nil {
+		sch.event(EventVerified, nil)
 	}
 
+	sch.takeFeatures(kex[:kexPubSize])
 	if !sch.doKEX(sk[:], kex[:kexPubSize], true) {
 		return false
 	}
@@ -267,23 +434,74 @@ func (sch *SChannel) dialKEX(ch Channel, signer *[IdentityPrivateSize]byte, peer
 // signed with the key it contains. If peer is not nil, the key exchange
 // will be verified using the public key it contains.
 func Dial(ch Channel, signer *[IdentityPrivateSize]byte, peer *[IdentityPublicSize]byte) (*SChannel, bool) {
-	var sch = &SChannel{}
-	sch.reset()
+	return DialPSK(ch, signer, peer, nil)
+}
+
+// DialPSK is like Dial, but additionally mixes the pre-shared key
+// into the session keys if psk is not nil. The PSK's identity hint is
+// sent to the listener so that it may select the same key. This may
+// be used alone or in combination with signed key exchanges.
+func DialPSK(ch Channel, signer *[IdentityPrivateSize]byte, peer *[IdentityPublicSize]byte, psk *PSK) (*SChannel, bool) {
+	sch, err := DialConfig(ch, &Config{
+		Signer: signer,
+		Peer:   peer,
+		PSK:    psk,
+	})
+	return sch, err == nil
+}
+
+// DialConfig initialises the SChannel and initiates a key exchange over
+// the Channel using the settings in cfg. A nil cfg is the same as an
+// empty Config, which sets up an unauthenticated secure channel.
+func DialConfig(ch Channel, cfg *Config) (*SChannel, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 
 	if ch == nil {
-		return nil, false
+		return nil, ErrNoChannel
 	}
 
-	if !sch.dialKEX(ch, signer, peer) {
-		return nil, false
+	var sch = &SChannel{}
+	sch.reset()
+	sch.maxSize = cfg.maxMessageSize()
+	sch.maxReassembly = cfg.maxReassemblySize()
+	sch.dialer = true
+	sch.inflating = cfg.Compression
+	sch.setEvents(cfg, ch, nil)
+	sch.event(EventHandshakeStart, nil)
+
+	resumption := cfg.Resumption || cfg.Ticket != nil
+	if resumption {
+		resumed, ok := sch.dialResume(ch, cfg.Ticket, cfg.Peer)
+		if !ok {
+			return nil, sch.abort(ErrKeyExchange)
+		}
+		sch.resumed = resumed
+	}
+
+	if !sch.resumed && !sch.dialKEX(ch, cfg.Signer, cfg.Peer, cfg.PSK) {
+		return nil, sch.abort(ErrKeyExchange)
 	}
 
 	sch.Channel = ch
+	if resumption && !sch.receiveTicket(cfg.Peer) {
+		return nil, sch.abort(ErrKeyExchange)
+	}
+
 	sch.ready = true
-	return sch, true
+	sch.pad = cfg.Padding
+	sch.startKeepalive(cfg.KeepaliveInterval, cfg.keepaliveTimeout())
+	sch.startCover(cfg.CoverInterval, sch.maxSize)
+	sch.event(EventHandshakeComplete, nil)
+	return sch, nil
 }
 
-func (sch *SChannel) listenKEX(ch Channel, signer *[IdentityPrivateSize]byte, peer *[IdentityPublicSize]byte) bool {
+func (sch *SChannel) listenKEX(ch Channel, signer *[IdentityPrivateSize]byte, peer *[IdentityPublicSize]byte, lookup PSKLookup) bool {
 	var sk [kexPrvSize]byte
 	var pk [kexPubSize]byte
 
@@ -298,14 +516,30 @@ func (sch *SChannel) listenKEX(ch Channel, signer *[IdentityPrivateSize]byte, pe
 	}
 
 	if !verifyKEX(&kex, peer) {
+		sch.event(EventVerifyFailed, nil)
 		return false
+	} else if peer != nil {
+		sch.event(EventVerified, nil)
+	}
+
+	if lookup != nil {
+		id, ok := readPSKIdentity(ch)
+		if !ok {
+			return false
+		}
+
+		if !sch.setPSK(id, lookup(id)) {
+			return false
+		}
 	}
 
+	sch.takeFeatures(kex[:kexPubSize])
 	if !sch.doKEX(sk[:], kex[:kexPubSize], false) {
 		return false
 	}
 
 	copy(kex[:], pk[:])
+	sch.markFeatures(kex[:kexPubSize])
 	if !signKEX(&kex, signer) {
 		return false
 	}
@@ -325,252 +559,594 @@ func (sch *SChannel) listenKEX(ch Channel, signer *[IdentityPrivateSize]byte, pe
 // signed with the key it contains. If peer is not nil, the key exchange
 // will be verified using the public key it contains.
 func Listen(ch Channel, signer *[IdentityPrivateSize]byte, peer *[IdentityPublicSize]byte) (*SChannel, bool) {
-	var sch = &SChannel{}
-	sch.reset()
+	return ListenPSK(ch, signer, peer, nil)
+}
+
+// ListenPSK is like Listen, but expects the dialer to use a pre-shared
+// key if lookup is not nil. The identity hint sent by the dialer is
+// passed to lookup, which should return the matching key or nil if
+// the identity is unknown.
+func ListenPSK(ch Channel, signer *[IdentityPrivateSize]byte, peer *[IdentityPublicSize]byte, lookup PSKLookup) (*SChannel, bool) {
+	sch, err := ListenConfig(ch, &Config{
+		Signer:    signer,
+		Peer:      peer,
+		PSKLookup: lookup,
+	})
+	return sch, err == nil
+}
+
+// ListenConfig initialises the SChannel and completes a key exchange
+// over the Channel using the settings in cfg. A nil cfg is the same as
+// an empty Config, which sets up an unauthenticated secure channel.
+func ListenConfig(ch Channel, cfg *Config) (*SChannel, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 
 	if ch == nil {
-		return nil, false
+		return nil, ErrNoChannel
 	}
 
-	if !sch.listenKEX(ch, signer, peer) {
-		return nil, false
+	var sch = &SChannel{}
+	sch.reset()
+	sch.maxSize = cfg.maxMessageSize()
+	sch.maxReassembly = cfg.maxReassemblySize()
+	sch.inflating = cfg.Compression
+	sch.setEvents(cfg, ch, nil)
+	sch.event(EventHandshakeStart, nil)
+
+	if cfg.TicketKeys != nil {
+		resumed, ok := sch.listenResume(ch, cfg.TicketKeys, cfg.ticketLifetime(), cfg.Peer)
+		if !ok {
+			return nil, sch.abort(ErrKeyExchange)
+		}
+		sch.resumed = resumed
+	}
+
+	if !sch.resumed && !sch.listenKEX(ch, cfg.Signer, cfg.Peer, cfg.pskLookup()) {
+		return nil, sch.abort(ErrKeyExchange)
 	}
 
 	sch.Channel = ch
 	sch.ready = true
-	return sch, true
+	if cfg.TicketKeys != nil && !sch.issueTicket(cfg.TicketKeys, cfg.ticketLifetime(), cfg.Peer) {
+		return nil, sch.abort(ErrKeyExchange)
+	}
+	sch.pad = cfg.Padding
+	sch.startKeepalive(cfg.KeepaliveInterval, cfg.keepaliveTimeout())
+	sch.startCover(cfg.CoverInterval, sch.maxSize)
+	sch.event(EventHandshakeComplete, nil)
+	return sch, nil
 }
 
-func (sch *SChannel) encrypt(m []byte) ([]byte, bool) {
-	out := make([]byte, nonceSize, nonceSize+len(m))
-	var nonce [nonceSize]byte
-	_, err := io.ReadFull(prng, nonce[:])
+// frameHeaderSize is the size of the length prefix on each frame.
+const frameHeaderSize = 4
+
+// seal packs and encrypts a message with the given envelope flags and
+// pad bytes of padding into
+// buf, growing it if it is too small to hold both the frame and the
+// packed message. It returns the buffer, so that it may be reused, and
+// the frame to be sent.
+func (sch *SChannel) seal(buf []byte, t MessageType, m []byte, pad int, flags uint16) ([]byte, []byte, bool) {
+	if len(m)+pad > sch.maxSize {
+		return buf, nil, false
+	}
+
+	frameSize := frameHeaderSize + nonceSize + secretbox.Overhead + messageOverhead + len(m) + pad
+	need := frameSize + messageOverhead + len(m) + pad
+	if cap(buf) < need {
+		buf = make([]byte, need)
+	}
+	buf = buf[:need]
+
+	// The frame and packed message must not overlap, so the packed
+	// message is stored after the frame.
+	frame := buf[: frameHeaderSize+nonceSize : frameSize]
+	out := buf[frameSize:frameSize]
+
+	sctr := atomic.AddUint32(&sch.sctr, 1)
+	out, ok := appendMessage(out, sctr, t, m, pad, flags)
+	if !ok {
+		return buf, nil, false
+	}
+
+	_, err := io.ReadFull(prng, frame[frameHeaderSize:])
 	if err != nil {
-		return nil, false
+		zero(out, 0)
+		return buf, nil, false
 	}
 
-	copy(out, nonce[:])
-	return secretbox.Seal(out, m, &nonce, &sch.skey), true
+	var nonce [nonceSize]byte
+	copy(nonce[:], frame[frameHeaderSize:])
+	frame = secretbox.Seal(frame, out, &nonce, &sch.skey)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-frameHeaderSize))
+
+	atomic.AddUint64(&sch.SData, uint64(len(out)))
+	countSent(len(out))
+	zero(out, 0)
+	return buf, frame, true
+}
+
+// writeFrame sends one or more sealed frames over the insecure channel.
+// The length prefix and body of each frame are written together, so
+// that a frame costs a single write (and, over TCP, is not split into
+// separate packets).
+func (sch *SChannel) writeFrame(frame []byte) bool {
+	if sch.datagram {
+		return sch.writeDatagrams(frame)
+	}
+
+	n, err := sch.Channel.Write(frame)
+	if err != nil || n != len(frame) {
+		return false
+	}
+
+	return true
 }
 
+// send seals and sends a message. It may be called concurrently with
+// other sends and with a goroutine receiving messages.
 func (sch *SChannel) send(t MessageType, m []byte) bool {
-	sch.sctr++
-	out, ok := packMessage(sch.sctr, t, m)
-	if !ok {
+	if !sch.lockSend() {
 		return false
 	}
+	defer sch.smu.Unlock()
+	return sch.sendLocked(t, m)
+}
 
-	enc, ok := sch.encrypt(out)
-	zero(out, 0)
-	if !ok {
+// sendLocked is like send, but the caller must hold the send lock.
+// Normal and application messages are compressed if the peer accepts
+// them.
+func (sch *SChannel) sendLocked(t MessageType, m []byte) bool {
+	if !sch.Ready() {
 		return false
 	}
-	sch.SData += uint64(len(out))
 
-	err := binary.Write(sch.Channel, binary.BigEndian, uint32(len(enc)))
-	if err != nil {
+	if t.compressible() {
+		if z, ok := sch.deflate(m); ok {
+			defer putBuffer(z)
+			return sch.sendFlagged(t, *z, flagCompressed)
+		}
+	}
+
+	return sch.sendFlagged(t, m, 0)
+}
+
+// sendFlagged seals and sends a message with the given envelope flags;
+// the caller must hold the send lock.
+func (sch *SChannel) sendFlagged(t MessageType, m []byte, flags uint16) bool {
+	if !sch.Ready() {
 		return false
 	}
 
-	_, err = sch.Channel.Write(enc)
-	if err != nil {
+	buf := getBuffer(0)
+	defer putBuffer(buf)
+
+	var frame []byte
+	var ok bool
+	*buf, frame, ok = sch.seal(*buf, t, m, sch.padding(len(m)), flags)
+	if !ok {
 		return false
 	}
 
-	return true
+	return sch.writeFrame(frame)
 }
 
-// Send seals the message and sends it over the secure channel.
+// Send seals the message and sends it over the secure channel. Send
+// may be called from several goroutines at once, and while another
+// goroutine is receiving messages. During a key rotation, Send waits
+// for the new keys to be in place.
 func (sch *SChannel) Send(m []byte) bool {
-	if !sch.ready {
+	if !sch.Ready() {
 		return false
 	}
 	return sch.send(NormalMessage, m)
 }
 
+// SendBuffer is like Send, but seals the message in buf rather than
+// in memory taken from the package's buffer pool. If buf is too small,
+// a larger buffer is allocated. The buffer is returned so that it can
+// be passed to the next call; once it has grown large enough for the
+// largest message being sent, SendBuffer does not allocate. The buffer
+// should not be shared with another goroutine while it is in use. As
+// with Send, the message is compressed if the peer accepts it.
+func (sch *SChannel) SendBuffer(buf, m []byte) ([]byte, bool) {
+	if !sch.lockSend() {
+		return buf, false
+	}
+	defer sch.smu.Unlock()
+	if !sch.Ready() {
+		return buf, false
+	}
+
+	var flags uint16
+	if z, ok := sch.deflate(m); ok {
+		defer putBuffer(z)
+		m, flags = *z, flagCompressed
+	}
+
+	buf, frame, ok := sch.seal(buf, NormalMessage, m, sch.padding(len(m)), flags)
+	if !ok {
+		return buf, false
+	}
+
+	return buf, sch.writeFrame(frame)
+}
+
+// SendBatch seals each of the messages and sends them over the secure
+// channel with a single write; this is useful for sending a number of
+// queued messages at once. If any message is empty or larger than the
+// maximum message size, nothing is sent. As with Send, each message is
+// compressed if the peer accepts it.
+func (sch *SChannel) SendBatch(ms [][]byte) bool {
+	if !sch.lockSend() {
+		return false
+	}
+	defer sch.smu.Unlock()
+	if !sch.Ready() {
+		return false
+	}
+
+	// The padding for each message is chosen up front, as it may
+	// be random.
+	var pads []int
+	if sch.pad != nil {
+		pads = make([]int, len(ms))
+	}
+
+	// Each message is compressed up front, as its size is needed to
+	// size the buffer.
+	ms = append([][]byte(nil), ms...)
+	flags := make([]uint16, len(ms))
+
+	var size, largest int
+	for i, m := range ms {
+		if len(m) == 0 || len(m) > sch.maxSize {
+			return false
+		}
+
+		if z, ok := sch.deflate(m); ok {
+			defer putBuffer(z)
+			ms[i], flags[i] = *z, flagCompressed
+		}
+
+		n := len(ms[i])
+		if pads != nil {
+			pads[i] = sch.padding(n)
+			n += pads[i]
+		}
+
+		size += frameHeaderSize + nonceSize + secretbox.Overhead + messageOverhead + n
+		if n > largest {
+			largest = n
+		}
+	}
+
+	// Each message is sealed directly after the previous frame, so
+	// that the frames are contiguous. The space following the last
+	// frame is needed to hold the packed message while sealing it.
+	buf := getBuffer(size + messageOverhead + largest)
+	defer putBuffer(buf)
+
+	var off int
+	for i, m := range ms {
+		var pad int
+		if pads != nil {
+			pad = pads[i]
+		}
+
+		_, frame, ok := sch.seal((*buf)[off:off], NormalMessage, m, pad, flags[i])
+		if !ok {
+			return false
+		}
+		off += len(frame)
+	}
+
+	return sch.writeFrame((*buf)[:off])
+}
+
 // Message pairs a message type with contents.
 type Message struct {
 	Type     MessageType
 	Contents []byte
-}
 
-func (sch *SChannel) decrypt(in []byte) ([]byte, bool) {
-	if len(in) <= nonceSize {
-		return nil, false
-	}
+	// more and total are copied from a fragment's header.
+	more  bool
+	total uint32
 
-	var nonce [nonceSize]byte
-	copy(nonce[:], in[:nonceSize])
-	return secretbox.Open(nil, in[nonceSize:], &nonce, &sch.rkey)
+	// reason and text are copied from a shutdown message.
+	reason ShutdownReason
+	text   string
 }
 
-func (sch *SChannel) getMessage() ([]byte, bool) {
-	var mlen uint32
-	err := binary.Read(sch.Channel, binary.BigEndian, &mlen)
+// open reads the next frame from the insecure channel and decrypts it
+// into buf, growing it if needed. It returns the packed message.
+func (sch *SChannel) open(buf []byte) ([]byte, bool) {
+	if sch.datagram {
+		return sch.openDatagram(buf)
+	}
+
+	err := sch.rbuf.readFull(sch.Channel, sch.rhdr[:])
 	if err != nil {
 		return nil, false
 	}
 
-	if mlen > BufSize+Overhead {
+	mlen := binary.BigEndian.Uint32(sch.rhdr[:])
+	if int64(mlen) > int64(sch.maxSize)+Overhead {
+		return nil, false
+	} else if mlen <= nonceSize {
 		return nil, false
 	}
 
-	_, err = io.ReadFull(sch.Channel, sch.buf[:int(mlen)])
+	box := getBuffer(int(mlen))
+	defer putBuffer(box)
+
+	err = sch.rbuf.readFull(sch.Channel, *box)
 	if err != nil {
 		return nil, false
 	}
 
-	out, ok := sch.decrypt(sch.buf[:int(mlen)])
+	var nonce [nonceSize]byte
+	copy(nonce[:], *box)
+	out, ok := secretbox.Open(buf[:0], (*box)[nonceSize:], &nonce, &sch.rkey)
 	if !ok {
+		sch.event(EventDecryptFailed, nil)
 		return nil, false
 	}
 
-	zero(sch.buf[:], int(mlen))
-	sch.RData += uint64(len(out))
+	atomic.AddUint64(&sch.RData, uint64(len(out)))
+	countReceived(len(out))
 	return out, true
 }
 
-func (sch *SChannel) extractMessage(in []byte) (*Message, bool) {
-	e, ok := unpackMessage(in)
-	if !ok {
-		return nil, false
-	}
+// receive reads the next message from the secure channel into e,
+// using buf to hold the decrypted message. The envelope's payload
+// refers to the buffer, and is only valid until the buffer is reused.
+// Key exchanges initiated by the peer are completed here.
+func (sch *SChannel) receive(buf *[]byte, e *envelope) bool {
+	for {
+		out, ok := sch.open(*buf)
+		if !ok {
+			return false
+		}
+		*buf = out
 
-	if e.Sequence <= sch.rctr {
-		return nil, false
-	}
-	sch.rctr = e.Sequence
+		if !parseMessage(out, e) {
+			return false
+		}
 
-	switch e.Type {
-	case NormalMessage:
-		// Do nothing
-	case KEXMessage:
-		if sch.kexip {
-			break
+		if sch.datagram {
+			// Datagrams may arrive out of order, but
+			// replayed messages are dropped.
+			if !sch.window.accept(e.Sequence) {
+				zero(out, 0)
+				sch.event(EventReplay, nil)
+				continue
+			}
+			atomic.StoreUint32(&sch.rctr, sch.window.top)
+		} else if e.Sequence <= sch.rctr {
+			sch.event(EventReplay, nil)
+			return false
+		} else {
+			atomic.StoreUint32(&sch.rctr, e.Sequence)
 		}
 
-		if !(sch.receiveKEX(e)) {
-			return nil, false
+		if sch.ka.enabled() {
+			sch.ka.received()
+			if sch.Err() != nil {
+				return false
+			}
 		}
 
-		return &Message{Type: KEXMessage}, true
-	case ShutdownMessage:
-		// The contents of this message are irrelevant.
-		return &Message{Type: ShutdownMessage}, true
-	default:
-		return nil, false
+		switch e.Type {
+		case KEXMessage:
+			if sch.datagram {
+				// A lost key exchange would leave the
+				// peers with different keys.
+				return false
+			}
+
+			answered, ok := sch.receiveKEX(e)
+			if !ok {
+				return false
+			} else if answered {
+				sch.event(EventRekeyStart, nil)
+				sch.event(EventRekeyComplete, nil)
+			}
+
+			// The peer's key exchange has been consumed.
+			e.Payload = nil
+		case PingMessage:
+			if !sch.reply(PongMessage, e.Payload) {
+				return false
+			}
+			zero(out, 0)
+			continue
+		case PongMessage:
+			sch.ka.pong(e.Payload)
+			zero(out, 0)
+			continue
+		case CoverMessage:
+			zero(out, 0)
+			continue
+		case ShutdownMessage:
+			sch.receiveShutdown(e.Payload)
+		}
+
+		return true
+	}
+}
+
+// next returns the next message held by Rekey, or else receives one;
+// the caller must hold the receive lock. A key rotation waiting for
+// the peer's answer fails if receiving does.
+func (sch *SChannel) next(buf *[]byte, e *envelope) bool {
+	if len(sch.held) > 0 && atomic.LoadInt32(&sch.zeroed) == 0 {
+		*e = *sch.held[0]
+		sch.held = sch.held[1:]
+		return true
 	}
 
-	m := &Message{
-		Type: e.Type,
+	if !sch.receiveLocked(buf, e) {
+		sch.failRekey()
+		return false
 	}
-	m.Contents = make([]byte, int(e.PayloadLength))
-	copy(m.Contents, e.Payload[:])
-	zero(e.Payload[:], int(e.PayloadLength))
-	return m, true
+	return true
+}
+
+// receiveLocked is like receive, but the caller must hold the receive
+// lock. If the channel is zeroised while it is reading, the receive
+// state that Zero left behind is wiped, and it fails.
+func (sch *SChannel) receiveLocked(buf *[]byte, e *envelope) bool {
+	if sch.ka.enabled() {
+		sch.ka.waiting(true)
+		defer sch.ka.waiting(false)
+	}
+
+	ok := atomic.LoadInt32(&sch.zeroed) == 0 && sch.receive(buf, e)
+	if atomic.LoadInt32(&sch.zeroed) != 0 {
+		sch.resetReceive()
+		return false
+	}
+	return ok
 }
 
 // Receive reads a new message from the secure channel.
 func (sch *SChannel) Receive() (*Message, bool) {
-	if !sch.ready {
+	if !sch.Ready() {
 		return nil, false
 	}
 
-	out, ok := sch.getMessage()
-	if !ok {
+	sch.rmu.Lock()
+	defer sch.rmu.Unlock()
+
+	buf := getBuffer(0)
+	defer putBuffer(buf)
+
+	var e envelope
+	if !sch.next(buf, &e) {
 		return nil, false
 	}
 
-	return sch.extractMessage(out)
-}
+	m := &Message{Type: e.Type}
+	switch e.Type {
+	case ShutdownMessage:
+		// The reason is returned instead of the contents.
+		m.reason = ShutdownReason(e.Payload[0])
+		m.text = string(e.Payload[1:])
+		return m, true
+	case FragmentMessage:
+		m.more = e.Flags&fragmentMore != 0
+		m.total = e.Total
+	}
 
-func (sch *SChannel) receiveKEX(e *envelope) bool {
-	if e == nil || sch.kexip || !sch.ready {
-		return false
+	if e.Pad&flagCompressed != 0 {
+		p := getBuffer(sch.maxSize)
+		defer putBuffer(p)
+
+		n, ok := sch.inflate(*p, e.Payload)
+		if !ok {
+			return nil, false
+		}
+		e.Payload = (*p)[:n]
 	}
 
-	if kexPubSize != int(e.PayloadLength) {
-		return false
+	if len(e.Payload) > 0 {
+		m.Contents = make([]byte, len(e.Payload))
+		copy(m.Contents, e.Payload)
 	}
+	return m, true
+}
 
-	var sk [kexPrvSize]byte
-	var pk [kexPubSize]byte
+// ReceiveInto reads a new message from the secure channel, copying its
+// contents into p rather than allocating memory for them. It returns
+// the message type and the number of bytes copied into p. If p is too
+// small for the message, ReceiveInto fails and the message is lost;
+// a buffer of MaxMessageSize bytes is always large enough. Fragments
+// are copied into p as they arrive and are not reassembled.
+func (sch *SChannel) ReceiveInto(p []byte) (MessageType, int, bool) {
+	if !sch.Ready() {
+		return InvalidMessage, 0, false
+	}
 
-	if !generateKeypair(&sk, &pk) {
-		return false
+	sch.rmu.Lock()
+	defer sch.rmu.Unlock()
+
+	buf := getBuffer(0)
+	defer putBuffer(buf)
+
+	var e envelope
+	if !sch.next(buf, &e) {
+		return InvalidMessage, 0, false
 	}
 
-	if !sch.send(KEXMessage, pk[:]) {
-		return false
+	if e.Type == ShutdownMessage {
+		return e.Type, 0, true
 	}
 
-	if !sch.doKEX(sk[:], e.Payload[:kexPubSize], false) {
-		return false
+	if e.Pad&flagCompressed != 0 {
+		if len(p) > sch.maxSize {
+			p = p[:sch.maxSize]
+		}
+
+		n, ok := sch.inflate(p, e.Payload)
+		if !ok {
+			return InvalidMessage, 0, false
+		}
+		return e.Type, n, true
 	}
 
-	return true
+	if len(e.Payload) > len(p) {
+		return InvalidMessage, 0, false
+	}
+
+	return e.Type, copy(p, e.Payload), true
 }
 
 // Close signals the other end of the secure channel that the channel
 // is being closed, and calls Zero to zeroise the secure channel. After
 // this, the caller should close the underlying channel as appropriate.
+// Close does not wait for the peer to acknowledge the shutdown; see
+// Shutdown.
 func (sch *SChannel) Close() bool {
-	if sch == nil {
-		return false
-	} else if !sch.ready {
-		return false
-	}
-
-	defer sch.Zero()
-	return sch.send(ShutdownMessage, []byte{0})
+	return sch.CloseReason(ShutdownNormal, "")
 }
 
 // Zero zeroises the channel, wiping the shared keys from memory and resetting
 // the channel. After this is called, the secure channel cannot be used for
-// anything else.
+// anything else. If another goroutine is blocked receiving, the receive key
+// and any buffered data are wiped once its read returns; closing the insecure
+// channel makes it return at once.
 func (sch *SChannel) Zero() {
 	if sch == nil {
 		return
 	}
 
-	zero(sch.skey[:], 0)
-	zero(sch.rkey[:], 0)
-	sch.reset()
-}
-
-// Rekey initiates a key rotation with the other side. Both sides will
-// generate new session private keys, and exchange their public
-// halves. These session keys will not be signed, as the channel is
-// assumed to be authenticated and secure at this point. Generally,
-// key rotation will not be an issue. However, peers may elect to
-// rekey after a certain time period, a certain number of messages
-// have been sent, or a certain amount of data will be sent.
-func (sch *SChannel) Rekey() bool {
-	if !sch.ready {
-		return false
-	}
-
-	var sk [kexPrvSize]byte
-	var pk [kexPubSize]byte
-
-	if !generateKeypair(&sk, &pk) {
-		return false
-	}
-
-	if !sch.send(KEXMessage, pk[:]) {
-		return false
-	}
-
-	sch.kexip = true
-	m, ok := sch.Receive()
-	if !ok || m.Type != KEXMessage {
-		return false
+	// Only the first call reports the event.
+	if !atomic.CompareAndSwapInt32(&sch.zeroed, 0, 1) {
+		return
 	}
-	sch.kexip = false
-
-	if !sch.doKEX(sk[:], m.Contents, true) {
-		return false
+	sch.event(EventZeroise, nil)
+
+	// Stop pinging the peer, and wait for any message being sent
+	// before wiping the send key.
+	sch.ka.halt()
+	sch.smu.Lock()
+
+	// Wake anything waiting for a key rotation to finish.
+	sch.abandonRekey()
+	sch.resetSend()
+	sch.smu.Unlock()
+
+	// A goroutine blocked receiving is still reading into the read
+	// buffer, and wipes the receive state itself once its read
+	// returns.
+	if sch.rmu.TryLock() {
+		sch.resetReceive()
+		sch.rmu.Unlock()
 	}
-
-	return true
 }
@@ -78,3 +78,38 @@ func TestDoKEXFail(t *testing.T) {
 		t.Fatal("doKEX should fail with bad key size")
 	}
 }
+
+func TestRekey(t *testing.T) {
+	dialer, listener := testHandshake(func(ch Channel) (*SChannel, bool) {
+		return Dial(ch, nil, nil)
+	}, func(ch Channel) (*SChannel, bool) {
+		return Listen(ch, nil, nil)
+	})
+	if !dialer.ok || !listener.ok {
+		t.Fatal("failed to set up secure channel")
+	}
+	alice, bob := dialer.sch, listener.sch
+
+	received := make(chan *Message, 1)
+	go func() {
+		m, _ := bob.Receive()
+		received <- m
+	}()
+
+	if !alice.Rekey() {
+		t.Fatal("alice failed to rekey")
+	}
+
+	if m := <-received; m == nil || m.Type != KEXMessage {
+		t.Fatal("bob expected a key exchange message")
+	}
+
+	if !bytes.Equal(alice.skey[:], bob.rkey[:]) || !bytes.Equal(alice.rkey[:], bob.skey[:]) {
+		t.Fatal("alice and bob have mismatched keys after rekeying")
+	}
+
+	go alice.Send(message)
+	if m, ok := bob.Receive(); !ok || !bytes.Equal(m.Contents, message) {
+		t.Fatal("bob didn't get the message alice sent after rekeying")
+	}
+}
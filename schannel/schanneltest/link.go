@@ -0,0 +1,305 @@
+package schanneltest
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// frameHeaderSize is the size of the length prefix on each frame.
+const frameHeaderSize = 4
+
+// Faults describes how a Link mistreats the frames written to it. Each
+// probability is between 0 and 1, and is checked independently for
+// every frame.
+type Faults struct {
+	// Drop is the probability that a frame is lost.
+	Drop float64
+
+	// Corrupt is the probability that a bit is flipped in a frame's
+	// ciphertext.
+	Corrupt float64
+
+	// Truncate is the probability that a frame loses the end of its
+	// ciphertext. The length prefix is adjusted, so the receiver
+	// sees a short frame rather than losing its framing.
+	Truncate float64
+
+	// Reorder is the probability that a frame is held back and
+	// delivered after the frame that follows it.
+	Reorder float64
+
+	// Delay is how long each frame takes to arrive.
+	Delay time.Duration
+
+	// Filter, if not nil, is called with each frame, including its
+	// length prefix, before any of the other faults are applied. It
+	// returns the frame to deliver, which may be modified, or nil to
+	// drop it.
+	Filter func(frame []byte) []byte
+
+	// Seed seeds the random choices, so that a failing test can be
+	// repeated.
+	Seed int64
+}
+
+// Stats counts the frames that have passed through a Link.
+type Stats struct {
+	Frames    int
+	Dropped   int
+	Corrupted int
+	Truncated int
+	Reordered int
+}
+
+// A frame is a frame waiting to be read.
+type frame struct {
+	data []byte
+	at   time.Time
+}
+
+// A Link carries frames in one direction between the two ends of a
+// Pipe. Writes never block; frames are queued until they are read.
+// The key exchange is not framed, so bytes are passed through
+// untouched until faults are first set.
+type Link struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	framed  bool
+	partial []byte
+	queue   []frame
+	held    *frame
+	closed  bool
+
+	faults Faults
+	rand   *rand.Rand
+	stats  Stats
+
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newLink() *Link {
+	l := &Link{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// SetFaults changes the faults applied to frames written from now on.
+// It must not be called until the secure channel has been set up.
+func (l *Link) SetFaults(f Faults) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.framed = true
+	l.faults = f
+	l.rand = rand.New(rand.NewSource(f.Seed))
+}
+
+// Stats returns the counts of frames written to the link and of the
+// faults applied to them.
+func (l *Link) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+func (l *Link) chance(p float64) bool {
+	return p > 0 && l.rand.Float64() < p
+}
+
+func (l *Link) write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if !l.framed {
+		l.queue = append(l.queue, frame{data: append([]byte(nil), p...)})
+		l.cond.Broadcast()
+		return len(p), nil
+	}
+
+	l.partial = append(l.partial, p...)
+	for len(l.partial) >= frameHeaderSize {
+		size := frameHeaderSize + int(binary.BigEndian.Uint32(l.partial))
+		if len(l.partial) < size {
+			break
+		}
+
+		f := make([]byte, size)
+		copy(f, l.partial)
+		l.partial = l.partial[size:]
+		l.deliver(f)
+	}
+
+	if len(l.partial) == 0 {
+		l.partial = nil
+	}
+
+	l.cond.Broadcast()
+	return len(p), nil
+}
+
+// deliver applies the faults to a frame and queues it.
+func (l *Link) deliver(f []byte) {
+	l.stats.Frames++
+	if l.faults.Filter != nil {
+		if f = l.faults.Filter(f); f == nil {
+			l.stats.Dropped++
+			return
+		}
+	}
+
+	if l.rand == nil {
+		l.rand = rand.New(rand.NewSource(l.faults.Seed))
+	}
+
+	if l.chance(l.faults.Drop) {
+		l.stats.Dropped++
+		return
+	}
+
+	if len(f) > frameHeaderSize && l.chance(l.faults.Corrupt) {
+		i := frameHeaderSize + l.rand.Intn(len(f)-frameHeaderSize)
+		f[i] ^= 1 << uint(l.rand.Intn(8))
+		l.stats.Corrupted++
+	}
+
+	if len(f) > frameHeaderSize+1 && l.chance(l.faults.Truncate) {
+		f = f[:frameHeaderSize+1+l.rand.Intn(len(f)-frameHeaderSize-1)]
+		binary.BigEndian.PutUint32(f, uint32(len(f)-frameHeaderSize))
+		l.stats.Truncated++
+	}
+
+	next := frame{data: f, at: time.Now().Add(l.faults.Delay)}
+	if l.held == nil && l.chance(l.faults.Reorder) {
+		l.held = &next
+		l.stats.Reordered++
+		return
+	}
+
+	l.queue = append(l.queue, next)
+	if l.held != nil {
+		l.held.at = next.at
+		l.queue = append(l.queue, *l.held)
+		l.held = nil
+	}
+
+	if l.faults.Delay > 0 {
+		time.AfterFunc(l.faults.Delay, l.cond.Broadcast)
+	}
+}
+
+func (l *Link) read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		if !l.deadline.IsZero() && !time.Now().Before(l.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if len(l.queue) > 0 && !time.Now().Before(l.queue[0].at) {
+			break
+		}
+
+		if l.closed {
+			return 0, io.EOF
+		}
+		l.cond.Wait()
+	}
+
+	f := &l.queue[0]
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	if len(f.data) == 0 {
+		l.queue = l.queue[1:]
+	}
+	return n, nil
+}
+
+func (l *Link) setDeadline(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.deadline = t
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+
+	if !t.IsZero() {
+		l.timer = time.AfterFunc(time.Until(t), l.cond.Broadcast)
+	}
+	l.cond.Broadcast()
+}
+
+// close stops the link. Frames already queued, apart from one held
+// back for reordering, may still be read.
+func (l *Link) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// pipeAddr is the address of both ends of a Pipe.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "schanneltest" }
+func (pipeAddr) String() string  { return "schanneltest" }
+
+// A Conn is one end of a Pipe. It implements net.Conn.
+type Conn struct {
+	// In carries frames to this end, and Out carries frames from
+	// it.
+	In, Out *Link
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// Read reads frames sent by the other end.
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.In.read(p)
+}
+
+// Write sends frames to the other end, applying the faults configured
+// on Out.
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.Out.write(p)
+}
+
+// Close closes both directions of the connection.
+func (c *Conn) Close() error {
+	c.In.close()
+	c.Out.close()
+	return nil
+}
+
+// LocalAddr returns a placeholder address.
+func (c *Conn) LocalAddr() net.Addr { return pipeAddr{} }
+
+// RemoteAddr returns a placeholder address.
+func (c *Conn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+// SetDeadline sets the read deadline; writes never block.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for reads.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.In.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes never block.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,145 @@
+// Package schanneltest provides connected secure channels for testing
+// code that uses the schannel package, with links that can be made to
+// drop, corrupt, reorder, delay or truncate frames.
+package schanneltest
+
+import (
+	"crypto/rand"
+
+	"github.com/agl/ed25519"
+	"github.com/kisom/go-schannel/schannel"
+)
+
+// Options control how NewPair sets up its secure channels.
+type Options struct {
+	// Identity generates signature keys for both sides, and each
+	// side verifies the other's key during the key exchange.
+	Identity bool
+
+	// Dial and Listen, if not nil, are used as the configurations
+	// for each side. They are copied; with Identity, the copies'
+	// Signer and Peer are replaced.
+	Dial, Listen *schannel.Config
+
+	// Faults are applied to the links in both directions once the
+	// secure channels are established.
+	Faults Faults
+}
+
+// A Pair holds two connected secure channels.
+type Pair struct {
+	// Dialer and Listener are the two secure channels.
+	Dialer, Listener *schannel.SChannel
+
+	// DialerConn and ListenerConn are the connections they run
+	// over. DialerConn.Out carries frames to the listener, and
+	// ListenerConn.Out carries frames to the dialer.
+	DialerConn, ListenerConn *Conn
+
+	// DialerKey and ListenerKey are the public identity keys of
+	// each side when Identity is set.
+	DialerKey, ListenerKey *[schannel.IdentityPublicSize]byte
+}
+
+// Close zeroises both secure channels and closes their connections.
+func (p *Pair) Close() {
+	p.Dialer.Zero()
+	p.Listener.Zero()
+	p.DialerConn.Close()
+	p.ListenerConn.Close()
+}
+
+// NewConns returns the two ends of an in-memory connection. Writes do
+// not block, so both ends may send before either reads.
+func NewConns() (*Conn, *Conn) {
+	a, b := newLink(), newLink()
+	return &Conn{In: b, Out: a}, &Conn{In: a, Out: b}
+}
+
+// Pipe returns two connected secure channels without identity keys.
+func Pipe() (*schannel.SChannel, *schannel.SChannel, error) {
+	p, err := NewPair(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Dialer, p.Listener, nil
+}
+
+// NewPair returns two connected secure channels set up with the given
+// options, which may be nil.
+func NewPair(opts *Options) (*Pair, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	dcfg, lcfg := copyConfig(opts.Dial), copyConfig(opts.Listen)
+	p := &Pair{}
+	if opts.Identity {
+		dpub, dpriv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		lpub, lpriv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		dcfg.Signer, dcfg.Peer = dpriv, lpub
+		lcfg.Signer, lcfg.Peer = lpriv, dpub
+		p.DialerKey, p.ListenerKey = dpub, lpub
+	}
+
+	p.DialerConn, p.ListenerConn = NewConns()
+
+	type result struct {
+		sch *schannel.SChannel
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		sch, err := schannel.ListenConfig(p.ListenerConn, lcfg)
+		if err != nil {
+			// Unblock the dialer if it is still waiting.
+			p.ListenerConn.Close()
+		}
+		results <- result{sch, err}
+	}()
+
+	var err error
+	p.Dialer, err = schannel.DialConfig(p.DialerConn, dcfg)
+	if err != nil {
+		// Unblock the listener if it is still waiting.
+		p.DialerConn.Close()
+	}
+
+	r := <-results
+	if err == nil {
+		err = r.err
+	}
+
+	if err != nil {
+		p.DialerConn.Close()
+		if p.Dialer != nil {
+			p.Dialer.Zero()
+		}
+		if r.sch != nil {
+			r.sch.Zero()
+		}
+		return nil, err
+	}
+
+	p.Listener = r.sch
+	p.DialerConn.Out.SetFaults(opts.Faults)
+	p.ListenerConn.Out.SetFaults(opts.Faults)
+	return p, nil
+}
+
+func copyConfig(cfg *schannel.Config) *schannel.Config {
+	if cfg == nil {
+		return &schannel.Config{}
+	}
+
+	c := *cfg
+	return &c
+}
@@ -0,0 +1,164 @@
+package schanneltest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/kisom/go-schannel/schannel"
+)
+
+var message = []byte("do not go gentle into that good night")
+
+func testExchange(t *testing.T, a, b *schannel.SChannel) {
+	if !a.Send(message) {
+		t.Fatal("failed to send a message")
+	}
+
+	m, ok := b.Receive()
+	if !ok {
+		t.Fatal("failed to receive a message")
+	} else if !bytes.Equal(m.Contents, message) {
+		t.Fatalf("expected %q, have %q", message, m.Contents)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	dialer, listener, err := Pipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	testExchange(t, dialer, listener)
+	testExchange(t, listener, dialer)
+
+	// Both sides may send before either reads.
+	if !dialer.Send(message) || !listener.Send(message) {
+		t.Fatal("failed to send a message")
+	}
+	dialer.Zero()
+	listener.Zero()
+}
+
+func TestPairIdentity(t *testing.T) {
+	p, err := NewPair(&Options{Identity: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer p.Close()
+
+	if p.DialerKey == nil || p.ListenerKey == nil {
+		t.Fatal("identity keys were not generated")
+	}
+	testExchange(t, p.Dialer, p.Listener)
+
+	// The listener expects a signature that the dialer cannot
+	// provide; the handshake fails instead of hanging.
+	peer, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err = NewPair(&Options{Listen: &schannel.Config{Peer: peer}}); err == nil {
+		t.Fatal("handshake should fail without the expected signature")
+	}
+}
+
+func TestFaultsDrop(t *testing.T) {
+	var n int
+	p, err := NewPair(&Options{Faults: Faults{
+		Filter: func(frame []byte) []byte {
+			n++
+			if n == 1 {
+				return nil
+			}
+			return frame
+		},
+	}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer p.Close()
+
+	p.Dialer.Send([]byte("lost"))
+	testExchange(t, p.Dialer, p.Listener)
+
+	if stats := p.DialerConn.Out.Stats(); stats.Dropped != 1 {
+		t.Fatalf("expected one dropped frame, have %d", stats.Dropped)
+	}
+}
+
+func TestFaultsDamage(t *testing.T) {
+	var tests = []Faults{
+		{Corrupt: 1},
+		{Truncate: 1},
+	}
+
+	for i, f := range tests {
+		p, err := NewPair(&Options{Faults: f})
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+
+		p.Dialer.Send(message)
+		p.Dialer.Send(message)
+		if _, ok := p.Listener.Receive(); ok {
+			t.Fatalf("test %d: receive should fail", i)
+		}
+
+		stats := p.DialerConn.Out.Stats()
+		if stats.Frames != 2 || stats.Corrupted+stats.Truncated+stats.Reordered == 0 {
+			t.Fatalf("test %d: unexpected stats %+v", i, stats)
+		}
+		p.Close()
+	}
+}
+
+func TestFaultsReorder(t *testing.T) {
+	p, err := NewPair(&Options{Faults: Faults{Reorder: 1}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer p.Close()
+
+	p.Dialer.Send([]byte("first"))
+	p.Dialer.Send([]byte("second"))
+
+	// The second message arrives first, and the first is then
+	// rejected as a replay.
+	m, ok := p.Listener.Receive()
+	if !ok || string(m.Contents) != "second" {
+		t.Fatal("expected the second message to arrive first")
+	}
+
+	if _, ok = p.Listener.Receive(); ok {
+		t.Fatal("receive should fail for the late message")
+	}
+}
+
+func TestFaultsDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	p, err := NewPair(&Options{Faults: Faults{Delay: delay}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer p.Close()
+
+	start := time.Now()
+	testExchange(t, p.Dialer, p.Listener)
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("message arrived after %v, expected at least %v", elapsed, delay)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	a, _ := NewConns()
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+	if _, err := a.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read should fail after the deadline")
+	}
+}
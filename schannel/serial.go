@@ -0,0 +1,195 @@
+package schannel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// serialDelimiter ends each frame on a serial link; COBS
+	// encoding ensures it does not appear inside a frame.
+	serialDelimiter = 0
+
+	// serialCRCSize is the size of the checksum on each frame.
+	serialCRCSize = 4
+
+	// maxSerialFrame is the largest encoded frame that will be
+	// read; longer runs of data are discarded up to the next
+	// delimiter.
+	maxSerialFrame = frameHeaderSize + BufSize + Overhead + serialCRCSize + (BufSize+Overhead)/254 + 16
+)
+
+var serialCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A SerialChannel is a Channel for links such as UART serial lines
+// that may drop or corrupt bytes. Each Write is sent as one frame,
+// protected by a CRC and encoded with COBS so that frame boundaries
+// can always be found again. Frames that are corrupted are dropped,
+// and the reader resynchronises at the next frame; a secure channel
+// tolerates the lost messages, as it sends each frame with a single
+// write. The key exchange, however, fails if any of its frames are
+// lost.
+type SerialChannel struct {
+	rw io.ReadWriter
+	r  *bufio.Reader
+
+	// pending holds the rest of the last frame read.
+	pending []byte
+
+	wmu     sync.Mutex
+	dropped uint64
+}
+
+// NewSerialChannel returns a SerialChannel that frames data sent
+// over rw.
+func NewSerialChannel(rw io.ReadWriter) *SerialChannel {
+	return &SerialChannel{rw: rw, r: bufio.NewReader(rw)}
+}
+
+// Write sends p as a single frame.
+func (sc *SerialChannel) Write(p []byte) (int, error) {
+	frame := make([]byte, len(p)+serialCRCSize)
+	copy(frame, p)
+	binary.BigEndian.PutUint32(frame[len(p):], crc32.Checksum(p, serialCRCTable))
+
+	out := cobsEncode(make([]byte, 0, len(frame)+len(frame)/254+2), frame)
+	out = append(out, serialDelimiter)
+	zero(frame, 0)
+
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if _, err := sc.rw.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read reads data from the next intact frame.
+func (sc *SerialChannel) Read(p []byte) (int, error) {
+	for len(sc.pending) == 0 {
+		frame, err := sc.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		sc.pending = frame
+	}
+
+	n := copy(p, sc.pending)
+	sc.pending = sc.pending[n:]
+	return n, nil
+}
+
+// readFrame returns the payload of the next frame that decodes and
+// passes its CRC check, dropping any that do not.
+func (sc *SerialChannel) readFrame() ([]byte, error) {
+	var frame []byte
+	var overlong bool
+	for {
+		b, err := sc.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if b != serialDelimiter {
+			if len(frame) < maxSerialFrame {
+				frame = append(frame, b)
+			} else {
+				overlong = true
+			}
+			continue
+		}
+
+		if len(frame) == 0 {
+			// Delimiters may be repeated to resynchronise.
+			continue
+		}
+
+		payload, ok := decodeSerialFrame(frame)
+		if ok && !overlong {
+			return payload, nil
+		}
+
+		atomic.AddUint64(&sc.dropped, 1)
+		frame, overlong = frame[:0], false
+	}
+}
+
+func decodeSerialFrame(frame []byte) ([]byte, bool) {
+	data, ok := cobsDecode(make([]byte, 0, len(frame)), frame)
+	if !ok || len(data) <= serialCRCSize {
+		return nil, false
+	}
+
+	payload := data[:len(data)-serialCRCSize]
+	if crc32.Checksum(payload, serialCRCTable) != binary.BigEndian.Uint32(data[len(payload):]) {
+		return nil, false
+	}
+	return payload, true
+}
+
+// Dropped returns the number of corrupted frames that have been
+// dropped.
+func (sc *SerialChannel) Dropped() uint64 {
+	return atomic.LoadUint64(&sc.dropped)
+}
+
+// Close closes the underlying link if it implements io.Closer.
+func (sc *SerialChannel) Close() error {
+	if c, ok := sc.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// cobsEncode appends the COBS encoding of p to out. The encoding
+// contains no zero bytes.
+func cobsEncode(out, p []byte) []byte {
+	code := len(out)
+	out = append(out, 0)
+	run := byte(1)
+
+	for _, b := range p {
+		if b != 0 {
+			out = append(out, b)
+			run++
+		}
+
+		if b == 0 || run == 0xff {
+			out[code] = run
+			code = len(out)
+			out = append(out, 0)
+			run = 1
+		}
+	}
+
+	out[code] = run
+	return out
+}
+
+// cobsDecode appends the data encoded in p to out. It returns false if
+// p is not a valid COBS encoding.
+func cobsDecode(out, p []byte) ([]byte, bool) {
+	for i := 0; i < len(p); {
+		run := int(p[i])
+		if run == 0 || i+run > len(p) {
+			return nil, false
+		}
+
+		for _, b := range p[i+1 : i+run] {
+			if b == 0 {
+				return nil, false
+			}
+		}
+		out = append(out, p[i+1:i+run]...)
+
+		i += run
+		if run < 0xff && i < len(p) {
+			out = append(out, 0)
+		}
+	}
+	return out, true
+}
@@ -0,0 +1,136 @@
+package schannel
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestCOBS(t *testing.T) {
+	var tests = [][]byte{
+		{0},
+		{0, 0},
+		{1, 2, 0, 3},
+		bytes.Repeat([]byte{1}, 254),
+		bytes.Repeat([]byte{1}, 255),
+		append(bytes.Repeat([]byte{1}, 254), 0),
+		message,
+	}
+
+	for i, p := range tests {
+		enc := cobsEncode(nil, p)
+		if bytes.IndexByte(enc, 0) != -1 {
+			t.Fatalf("test %d: encoding contains a zero byte", i)
+		}
+
+		dec, ok := cobsDecode(nil, enc)
+		if !ok {
+			t.Fatalf("test %d: failed to decode", i)
+		} else if !bytes.Equal(dec, p) {
+			t.Fatalf("test %d: expected %x, have %x", i, p, dec)
+		}
+	}
+
+	if _, ok := cobsDecode(nil, []byte{5, 1}); ok {
+		t.Fatal("cobsDecode should fail with a truncated block")
+	}
+}
+
+// faultyLink is one direction of a serial link; mangle may alter each
+// write before it is delivered.
+type faultyLink struct {
+	w      *io.PipeWriter
+	mu     sync.Mutex
+	writes int
+	mangle func(n int, p []byte) []byte
+}
+
+func (l *faultyLink) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	l.writes++
+	if l.mangle != nil {
+		p = l.mangle(l.writes, append([]byte(nil), p...))
+	}
+	l.mu.Unlock()
+
+	if _, err := l.w.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// testSerialPair returns the two ends of an in-memory serial link;
+// writes from the first end pass through the returned faultyLink.
+func testSerialPair(t *testing.T) (*SerialChannel, *SerialChannel, *faultyLink) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	t.Cleanup(func() {
+		aw.Close()
+		bw.Close()
+	})
+
+	link := &faultyLink{w: aw}
+	a := NewSerialChannel(struct {
+		io.Reader
+		io.Writer
+	}{ar, link})
+	b := NewSerialChannel(struct {
+		io.Reader
+		io.Writer
+	}{br, bw})
+	return a, b, link
+}
+
+func TestSerialChannel(t *testing.T) {
+	a, b, link := testSerialPair(t)
+
+	dialer, listener := testHandshake(func(Channel) (*SChannel, bool) {
+		return Dial(a, nil, nil)
+	}, func(Channel) (*SChannel, bool) {
+		return Listen(b, nil, nil)
+	})
+	if !dialer.ok || !listener.ok {
+		t.Fatal("failed to set up secure channel over a serial link")
+	}
+
+	link.mu.Lock()
+	start := link.writes
+	link.mangle = func(n int, p []byte) []byte {
+		switch n - start {
+		case 1:
+			// Noise on the line before the frame.
+			return append([]byte{0x55, 0xaa, 0x00}, p...)
+		case 2:
+			// A byte is changed, but not into a delimiter,
+			// which would split the frame in two.
+			p[len(p)/2] = p[len(p)/2]%255 + 1
+		case 3:
+			// A byte is lost.
+			return append(p[:5], p[6:]...)
+		}
+		return p
+	}
+	link.mu.Unlock()
+
+	go func() {
+		for i := 0; i < 4; i++ {
+			dialer.sch.Send(message[i*8 : (i+1)*8])
+		}
+	}()
+
+	for _, want := range [][]byte{message[:8], message[24:32]} {
+		m, ok := listener.sch.Receive()
+		if !ok {
+			t.Fatal("listener failed to receive a message")
+		} else if !bytes.Equal(m.Contents, want) {
+			t.Fatalf("expected %q, have %q", want, m.Contents)
+		}
+	}
+
+	// The noise, the corrupted frame and the short frame were
+	// dropped.
+	if b.Dropped() != 3 {
+		t.Fatalf("expected 3 dropped frames, have %d", b.Dropped())
+	}
+}
@@ -0,0 +1,334 @@
+package schannel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by a Server's Serve and ListenAndServe
+// methods after Shutdown or Close has been called.
+var ErrServerClosed = errors.New("schannel: server closed")
+
+// A Handler serves a secure channel accepted by a Server. The secure
+// channel is zeroised and its connection closed when ServeSChannel
+// returns.
+type Handler interface {
+	ServeSChannel(sch *SChannel)
+}
+
+// A ServeFunc adapts a function to a Handler.
+type ServeFunc func(sch *SChannel)
+
+// ServeSChannel calls f(sch).
+func (f ServeFunc) ServeSChannel(sch *SChannel) {
+	f(sch)
+}
+
+// A Server accepts connections and sets up a secure channel over each
+// of them, in the manner of net/http's Server. The zero value, with a
+// Handler, is ready to use.
+type Server struct {
+	// Addr is the TCP address used by ListenAndServe.
+	Addr string
+
+	// Handler serves each secure channel once the key exchange has
+	// completed.
+	Handler Handler
+
+	// Config holds the settings for the key exchanges; it is
+	// shared by every connection and must not be changed while the
+	// server is running.
+	Config *Config
+
+	// MaxConns, if not zero, limits the number of connections that
+	// are being set up or served at once. Connections beyond the
+	// limit are closed as soon as they are accepted.
+	MaxConns int
+
+	// HandshakeTimeout, if not zero, limits how long the key
+	// exchange may take.
+	HandshakeTimeout time.Duration
+
+	// HandshakeRate, if not zero, limits how many key exchanges
+	// per second each remote IP address may start; HandshakeBurst
+	// is how many may be started at once, and is at least one.
+	// Connections over the limit are closed without a key
+	// exchange.
+	HandshakeRate  float64
+	HandshakeBurst int
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]*SChannel
+	limits    map[string]*handshakeBucket
+	closing   bool
+	handlers  sync.WaitGroup
+}
+
+// A handshakeBucket is a token bucket limiting key exchanges from one
+// address.
+type handshakeBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets is the number of addresses tracked before buckets that
+// have refilled are discarded.
+const maxBuckets = 1024
+
+func (srv *Server) burst() float64 {
+	if srv.HandshakeBurst < 1 {
+		return 1
+	}
+	return float64(srv.HandshakeBurst)
+}
+
+// allow returns true if a key exchange may be started with addr. The
+// caller must hold the server's lock.
+func (srv *Server) allow(addr net.Addr) bool {
+	if srv.HandshakeRate <= 0 {
+		return true
+	}
+
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	now := time.Now()
+	if srv.limits == nil {
+		srv.limits = map[string]*handshakeBucket{}
+	}
+
+	b, ok := srv.limits[host]
+	if !ok {
+		if len(srv.limits) >= maxBuckets {
+			srv.pruneBuckets(now)
+		}
+		b = &handshakeBucket{tokens: srv.burst(), last: now}
+		srv.limits[host] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * srv.HandshakeRate
+	if b.tokens > srv.burst() {
+		b.tokens = srv.burst()
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// pruneBuckets discards buckets that have refilled, as they no longer
+// hold anything back.
+func (srv *Server) pruneBuckets(now time.Time) {
+	for host, b := range srv.limits {
+		if b.tokens+now.Sub(b.last).Seconds()*srv.HandshakeRate >= srv.burst() {
+			delete(srv.limits, host)
+		}
+	}
+}
+
+// ListenAndServe listens on the TCP address srv.Addr and serves the
+// connections it accepts.
+func (srv *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// Serve accepts connections on ln and serves each of them in a new
+// goroutine. It always returns an error, which is ErrServerClosed
+// once the server has been shut down. ln is closed when Serve
+// returns.
+func (srv *Server) Serve(ln net.Listener) error {
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+
+	if srv.listeners == nil {
+		srv.listeners = map[net.Listener]struct{}{}
+	}
+	srv.listeners[ln] = struct{}{}
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, ln)
+		srv.mu.Unlock()
+		ln.Close()
+	}()
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			// Temporary errors, such as running out of file
+			// descriptors, are retried with a backoff, as
+			// net/http does.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+
+		if !srv.track(conn) {
+			conn.Close()
+			continue
+		}
+
+		go srv.serve(conn)
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+// track registers a new connection, returning false if the server is
+// closing or the connection is over one of the limits.
+func (srv *Server) track(conn net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closing {
+		return false
+	}
+
+	if srv.MaxConns > 0 && len(srv.conns) >= srv.MaxConns {
+		return false
+	}
+
+	if !srv.allow(conn.RemoteAddr()) {
+		return false
+	}
+
+	if srv.conns == nil {
+		srv.conns = map[net.Conn]*SChannel{}
+	}
+	srv.conns[conn] = nil
+	srv.handlers.Add(1)
+	return true
+}
+
+func (srv *Server) serve(conn net.Conn) {
+	defer srv.handlers.Done()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		conn.Close()
+	}()
+
+	if srv.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(srv.HandshakeTimeout))
+	}
+
+	sch, err := ListenConfig(conn, srv.Config)
+	if err != nil {
+		return
+	}
+	defer sch.Zero()
+
+	if srv.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+
+	srv.mu.Lock()
+	closing := srv.closing
+	srv.conns[conn] = sch
+	srv.mu.Unlock()
+
+	// The server began shutting down during the key exchange.
+	if closing {
+		sch.sendShutdown(ShutdownGoingAway, "")
+		return
+	}
+
+	if srv.Handler != nil {
+		srv.Handler.ServeSChannel(sch)
+	}
+}
+
+// stop closes the listeners and marks the server as closing, so that
+// no more connections are accepted.
+func (srv *Server) stop() {
+	srv.closing = true
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+}
+
+// Shutdown stops the server gracefully. It closes the listeners and
+// any connections that are still in the key exchange, sends a
+// ShutdownMessage with ShutdownGoingAway to every live secure channel,
+// and waits for the handlers to return. If ctx expires first, its
+// error is returned and the handlers are left running; Close may then
+// be used to end them.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	var live []*SChannel
+	srv.mu.Lock()
+	srv.stop()
+	for conn, sch := range srv.conns {
+		if sch == nil {
+			conn.Close()
+		} else {
+			live = append(live, sch)
+		}
+	}
+	srv.mu.Unlock()
+
+	for _, sch := range live {
+		sch.sendShutdown(ShutdownGoingAway, "")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the server immediately, closing the listeners and every
+// connection. It does not wait for the handlers to return.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.stop()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	return nil
+}
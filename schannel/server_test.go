@@ -0,0 +1,240 @@
+package schannel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoHandler echoes normal messages until the channel is shut down.
+var echoHandler = ServeFunc(func(sch *SChannel) {
+	for {
+		m, ok := sch.Receive()
+		if !ok || m.Type != NormalMessage {
+			return
+		}
+		sch.Send(m.Contents)
+	}
+})
+
+// testServer starts srv on a loopback listener, returning its address
+// and a channel that receives Serve's result.
+func testServer(t *testing.T, srv *Server) (string, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String(), served
+}
+
+func testServerDial(t *testing.T, addr string) (*SChannel, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	sch, err := DialConfig(conn, nil)
+	conn.SetDeadline(time.Time{})
+	return sch, err
+}
+
+func TestServer(t *testing.T) {
+	srv := &Server{Handler: echoHandler}
+	addr, served := testServer(t, srv)
+
+	var clients []*SChannel
+	for i := 0; i < 3; i++ {
+		sch, err := testServerDial(t, addr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if !sch.Send(message) {
+			t.Fatal("failed to send a message")
+		}
+		if m, ok := sch.Receive(); !ok || string(m.Contents) != string(message) {
+			t.Fatal("failed to receive the echoed message")
+		}
+		clients = append(clients, sch)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	// Every client is told that the server is going away; receiving
+	// it acknowledges it, which ends the handler.
+	for _, sch := range clients {
+		m, ok := sch.Receive()
+		if !ok || m.Type != ShutdownMessage {
+			t.Fatal("expected a shutdown message")
+		}
+
+		if reason, _ := m.Reason(); reason != ShutdownGoingAway {
+			t.Fatalf("expected reason %v, have %v", ShutdownGoingAway, reason)
+		}
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("expected %v, have %v", ErrServerClosed, err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err = srv.Serve(ln); err != ErrServerClosed {
+		t.Fatalf("expected %v after shutdown, have %v", ErrServerClosed, err)
+	}
+}
+
+// temporaryError is an accept error that should be retried.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary accept error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails its first few calls to Accept with a temporary
+// error, as a listener that has run out of file descriptors does.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (ln *flakyListener) Accept() (net.Conn, error) {
+	if ln.failures > 0 {
+		ln.failures--
+		return nil, temporaryError{}
+	}
+	return ln.Listener.Accept()
+}
+
+func TestServerTemporaryError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	srv := &Server{Handler: echoHandler}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(&flakyListener{Listener: ln, failures: 3})
+	}()
+	t.Cleanup(func() { srv.Close() })
+
+	sch, err := testServerDial(t, ln.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if !sch.Send(message) {
+		t.Fatal("failed to send a message")
+	} else if m, ok := sch.Receive(); !ok || string(m.Contents) != string(message) {
+		t.Fatal("failed to receive the echoed message")
+	}
+
+	srv.Close()
+	if err = <-served; err != ErrServerClosed {
+		t.Fatalf("expected %v, have %v", ErrServerClosed, err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := &Server{Handler: ServeFunc(func(sch *SChannel) {
+		<-release
+	})}
+	addr, _ := testServer(t, srv)
+
+	if _, err := testServerDial(t, addr); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, have %v", context.DeadlineExceeded, err)
+	}
+	close(release)
+}
+
+func TestServerMaxConns(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	srv := &Server{
+		MaxConns: 1,
+		Handler: ServeFunc(func(sch *SChannel) {
+			<-release
+		}),
+	}
+	addr, _ := testServer(t, srv)
+
+	if _, err := testServerDial(t, addr); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if _, err := testServerDial(t, addr); err == nil {
+		t.Fatal("a connection over the limit should be refused")
+	}
+}
+
+func TestServerHandshakeRate(t *testing.T) {
+	srv := &Server{
+		Handler:        echoHandler,
+		HandshakeRate:  0.001,
+		HandshakeBurst: 2,
+	}
+	addr, _ := testServer(t, srv)
+
+	for i := 0; i < 2; i++ {
+		if _, err := testServerDial(t, addr); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	if _, err := testServerDial(t, addr); err == nil {
+		t.Fatal("a key exchange over the rate limit should be refused")
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	srv := &Server{
+		Handler:          echoHandler,
+		HandshakeTimeout: 50 * time.Millisecond,
+	}
+	addr, _ := testServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	// The client never starts the key exchange, so the server
+	// gives up on it.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the server to close the connection")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("the server did not enforce the handshake timeout")
+	}
+}
@@ -0,0 +1,198 @@
+package schannel
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// A ShutdownReason is carried by a ShutdownMessage to tell the peer
+// why the secure channel is being closed. Reasons from 128 to 255 are
+// reserved for applications.
+type ShutdownReason uint8
+
+const (
+	// ShutdownNormal indicates that the channel is no longer needed.
+	ShutdownNormal ShutdownReason = iota
+
+	// ShutdownAcknowledge is sent in reply to the peer's shutdown.
+	ShutdownAcknowledge
+
+	// ShutdownGoingAway indicates that the sender is going away,
+	// for example because a server is restarting.
+	ShutdownGoingAway
+
+	// ShutdownProtocolError indicates that the peer sent something
+	// the sender did not understand.
+	ShutdownProtocolError
+
+	// ShutdownTimeout indicates that the peer took too long.
+	ShutdownTimeout
+)
+
+// MaxShutdownTextSize is the length of the longest text that may
+// accompany a shutdown reason.
+const MaxShutdownTextSize = 255
+
+var shutdownReasons = map[ShutdownReason]string{
+	ShutdownNormal:        "normal",
+	ShutdownAcknowledge:   "acknowledged",
+	ShutdownGoingAway:     "going away",
+	ShutdownProtocolError: "protocol error",
+	ShutdownTimeout:       "timeout",
+}
+
+func (r ShutdownReason) String() string {
+	if s, ok := shutdownReasons[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("reason %d", uint8(r))
+}
+
+// A ShutdownError is returned by Err once the peer has shut the
+// channel down, and records the reason it gave.
+type ShutdownError struct {
+	Reason ShutdownReason
+	Text   string
+}
+
+func (err *ShutdownError) Error() string {
+	if err.Text == "" {
+		return "schannel: peer shut down the channel: " + err.Reason.String()
+	}
+	return "schannel: peer shut down the channel: " + err.Reason.String() + ": " + err.Text
+}
+
+// Reason returns the reason and text carried by a ShutdownMessage. For
+// other messages, it returns ShutdownNormal and an empty string.
+func (m *Message) Reason() (ShutdownReason, string) {
+	return m.reason, m.text
+}
+
+// sendShutdown sends a shutdown message, unless one has already been
+// sent.
+func (sch *SChannel) sendShutdown(reason ShutdownReason, text string) bool {
+	if len(text) > MaxShutdownTextSize {
+		return false
+	}
+
+	if !sch.lockSend() {
+		return false
+	}
+	defer sch.smu.Unlock()
+
+	p := make([]byte, 1+len(text))
+	p[0] = uint8(reason)
+	copy(p[1:], text)
+	return sch.sendShutdownLocked(p)
+}
+
+// sendShutdownLocked sends a packed shutdown message, unless one has
+// already been sent; the caller must hold the send lock.
+func (sch *SChannel) sendShutdownLocked(p []byte) bool {
+	if sch.shutdown {
+		return true
+	}
+
+	if !sch.sendLocked(ShutdownMessage, p) {
+		return false
+	}
+
+	sch.shutdown = true
+	return true
+}
+
+// receiveShutdown records the reason the peer gave for shutting down,
+// and acknowledges the shutdown if the channel wasn't already closing.
+func (sch *SChannel) receiveShutdown(p []byte) {
+	reason := ShutdownReason(p[0])
+	err := &ShutdownError{Reason: reason, Text: string(p[1:])}
+	sch.setErr(err)
+	sch.event(EventShutdown, err)
+
+	if reason != ShutdownAcknowledge {
+		// The peer may already be gone, in which case the
+		// acknowledgement is lost.
+		sch.reply(ShutdownMessage, []byte{uint8(ShutdownAcknowledge)})
+	}
+}
+
+// CloseReason is like Close, but tells the peer why the channel is
+// being closed. The text must be no longer than MaxShutdownTextSize;
+// if it is too long, the channel is left open.
+func (sch *SChannel) CloseReason(reason ShutdownReason, text string) bool {
+	if sch == nil {
+		return false
+	} else if !sch.Ready() {
+		return false
+	} else if len(text) > MaxShutdownTextSize {
+		return false
+	}
+
+	defer sch.Zero()
+	return sch.sendShutdown(reason, text)
+}
+
+// Shutdown closes the secure channel gracefully. It sends a shutdown
+// with the given reason, then receives until the peer acknowledges it,
+// returning any messages that were in flight. The secure channel is
+// zeroised before Shutdown returns. Shutdown returns true if the peer
+// acknowledged the shutdown.
+//
+// If timeout is not zero, Shutdown waits at most that long. The wait
+// is bounded with a read deadline if the channel supports one, and
+// otherwise by closing the channel if it implements io.Closer. No other
+// goroutine may be receiving from the channel.
+func (sch *SChannel) Shutdown(reason ShutdownReason, text string, timeout time.Duration) ([]*Message, bool) {
+	if sch == nil {
+		return nil, false
+	} else if !sch.Ready() {
+		return nil, false
+	} else if len(text) > MaxShutdownTextSize {
+		return nil, false
+	}
+
+	defer sch.Zero()
+	if !sch.sendShutdown(reason, text) {
+		return nil, false
+	}
+
+	if timeout > 0 {
+		stop := sch.bound(timeout)
+		defer stop()
+	}
+
+	var pending []*Message
+	for {
+		m, ok := sch.Receive()
+		if !ok {
+			return pending, false
+		}
+
+		switch m.Type {
+		case ShutdownMessage:
+			return pending, true
+		case KEXMessage:
+			continue
+		}
+		pending = append(pending, m)
+	}
+}
+
+// bound limits how long receiving from the channel may block. It
+// returns a function that removes the limit.
+func (sch *SChannel) bound(timeout time.Duration) func() {
+	ch := sch.Channel
+	if d, ok := ch.(readDeadliner); ok {
+		if d.SetReadDeadline(time.Now().Add(timeout)) == nil {
+			return func() { d.SetReadDeadline(time.Time{}) }
+		}
+	}
+
+	if c, ok := ch.(io.Closer); ok {
+		timer := time.AfterFunc(timeout, func() { c.Close() })
+		return func() { timer.Stop() }
+	}
+
+	return func() {}
+}
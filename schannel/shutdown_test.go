@@ -0,0 +1,96 @@
+package schannel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownReason(t *testing.T) {
+	alice, bob := testBufferPair(t, nil, nil)
+
+	if alice.CloseReason(ShutdownGoingAway, strings.Repeat("x", MaxShutdownTextSize+1)) {
+		t.Fatal("CloseReason should fail with an oversized text")
+	}
+
+	if !alice.CloseReason(ShutdownGoingAway, "restarting") {
+		t.Fatal("alice failed to shut down the channel")
+	}
+
+	m, ok := bob.Receive()
+	if !ok {
+		t.Fatal("bob failed to receive the shutdown message")
+	} else if m.Type != ShutdownMessage {
+		t.Fatal("bob expected a shutdown message")
+	}
+
+	if reason, text := m.Reason(); reason != ShutdownGoingAway || text != "restarting" {
+		t.Fatalf("bob received the wrong reason: %v: %s", reason, text)
+	}
+
+	err, ok := bob.Err().(*ShutdownError)
+	if !ok {
+		t.Fatalf("expected a shutdown error, have %v", bob.Err())
+	} else if err.Reason != ShutdownGoingAway || err.Text != "restarting" {
+		t.Fatalf("invalid shutdown error: %v", err)
+	}
+
+	// Bob acknowledged the shutdown.
+	if bob.Channel.(*bytes.Buffer).Len() == 0 {
+		t.Fatal("bob should acknowledge the shutdown")
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	dialer, listener := testTCPPair(t)
+
+	// The listener's message is in flight when the dialer shuts
+	// the channel down.
+	if !listener.Send(message) {
+		t.Fatal("listener failed to send a message")
+	}
+
+	reason := make(chan ShutdownReason, 1)
+	go func() {
+		for {
+			m, ok := listener.Receive()
+			if !ok {
+				return
+			} else if m.Type == ShutdownMessage {
+				r, _ := m.Reason()
+				reason <- r
+				return
+			}
+		}
+	}()
+
+	pending, ok := dialer.Shutdown(ShutdownNormal, "done", time.Second)
+	if !ok {
+		t.Fatal("the shutdown should have been acknowledged")
+	} else if len(pending) != 1 || !bytes.Equal(pending[0].Contents, message) {
+		t.Fatal("the in-flight message should be returned")
+	}
+
+	if r := <-reason; r != ShutdownNormal {
+		t.Fatalf("expected %v, have %v", ShutdownNormal, r)
+	}
+
+	if err, ok := dialer.Err().(*ShutdownError); !ok || err.Reason != ShutdownAcknowledge {
+		t.Fatalf("expected an acknowledgement, have %v", dialer.Err())
+	} else if dialer.Ready() {
+		t.Fatal("the channel should be zeroised after shutting down")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	dialer, _ := testTCPPair(t)
+
+	// The listener never receives, so it can't acknowledge.
+	start := time.Now()
+	if _, ok := dialer.Shutdown(ShutdownNormal, "", 20*time.Millisecond); ok {
+		t.Fatal("the shutdown should not have been acknowledged")
+	} else if time.Since(start) > time.Second {
+		t.Fatal("Shutdown should give up after the timeout")
+	}
+}
@@ -1,5 +1,34 @@
 package schannel
 
+import "sync"
+
+// bufPool holds buffers for incoming messages, so that idle channels
+// do not each hold a buffer large enough for the largest message.
+var bufPool sync.Pool
+
+// getBuffer returns a buffer of length n, reusing a pooled buffer if
+// one is available. A pointer is used so that returning the buffer to
+// the pool does not allocate.
+func getBuffer(n int) *[]byte {
+	p, ok := bufPool.Get().(*[]byte)
+	if !ok {
+		p = new([]byte)
+	}
+
+	if cap(*p) < n {
+		*p = make([]byte, n)
+	}
+	*p = (*p)[:n]
+	return p
+}
+
+// putBuffer zeroises the used part of a buffer and returns it to the
+// pool.
+func putBuffer(p *[]byte) {
+	zero(*p, 0)
+	bufPool.Put(p)
+}
+
 func zero(in []byte, n int) {
 	if in == nil {
 		return
@@ -0,0 +1,577 @@
+package schannel
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrWebSocketHandshake is returned when a WebSocket connection could
+// not be set up, either because the peer is not a WebSocket endpoint
+// or because an HTTP proxy refused the connection.
+var ErrWebSocketHandshake = errors.New("schannel: websocket handshake failed")
+
+// ErrProxyScheme is returned when a WebSocketDialer is given a proxy
+// that is neither an http nor an https URL.
+var ErrProxyScheme = errors.New("schannel: unsupported proxy scheme")
+
+// errWebSocketProtocol is returned when the peer sends a frame that
+// violates the WebSocket protocol.
+var errWebSocketProtocol = errors.New("schannel: websocket protocol error")
+
+// websocketGUID is used to compute the Sec-WebSocket-Accept header.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsFinal = 0x80
+	wsMask  = 0x80
+
+	// maxWebSocketMessage is the largest message that will be read;
+	// it is large enough for any frame a secure channel sends.
+	maxWebSocketMessage = frameHeaderSize + BufSize + Overhead
+
+	// maxControlPayload is the largest payload of a control frame.
+	maxControlPayload = 125
+)
+
+// A WebSocketChannel is a Channel that carries each write as a binary
+// WebSocket message. This lets secure channels cross networks that
+// only allow HTTP, including through HTTP proxies.
+type WebSocketChannel struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// client is true for the dialing side, which must mask the
+	// frames it sends.
+	client bool
+
+	// pending holds the rest of the last message read.
+	pending []byte
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains returns true if the comma-separated header contains
+// the token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpgradeWebSocket upgrades an HTTP request to a WebSocket connection
+// for a listener. If the request is not a valid WebSocket handshake,
+// an error response is written and ErrWebSocketHandshake is returned.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketChannel, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "websocket handshake required", http.StatusBadRequest)
+		return nil, ErrWebSocketHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return nil, ErrWebSocketHandshake
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err = conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &WebSocketChannel{conn: conn, br: brw.Reader}, nil
+}
+
+// A WebSocketDialer connects to WebSocket endpoints for a dialer.
+type WebSocketDialer struct {
+	// TLSConfig is used for wss URLs and https proxies. If nil,
+	// the default configuration is used.
+	TLSConfig *tls.Config
+
+	// Proxy, if not nil, returns the HTTP proxy to tunnel through
+	// for a request, as http.Transport's Proxy does. The proxy is
+	// asked to CONNECT to the endpoint. Only http and https proxies
+	// are supported.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Header holds additional headers for the handshake request.
+	Header http.Header
+
+	// Timeout, if not zero, limits how long connecting and the
+	// handshake may take.
+	Timeout time.Duration
+}
+
+// DialWebSocket connects to a ws or wss URL, using the proxy given by
+// the environment, as http.ProxyFromEnvironment does.
+func DialWebSocket(rawurl string) (*WebSocketChannel, error) {
+	d := &WebSocketDialer{Proxy: http.ProxyFromEnvironment}
+	return d.Dial(rawurl)
+}
+
+// Dial connects to a ws or wss URL and completes the WebSocket
+// handshake.
+func (d *WebSocketDialer) Dial(rawurl string) (*WebSocketChannel, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	var secure bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, ErrWebSocketHandshake
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var deadline time.Time
+	if d.Timeout > 0 {
+		deadline = time.Now().Add(d.Timeout)
+	}
+
+	conn, err := d.connect(u, addr, secure, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := d.handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// connect opens a connection to addr, through a proxy if one is
+// configured, and starts TLS if needed.
+func (d *WebSocketDialer) connect(u *url.URL, addr string, secure bool, deadline time.Time) (net.Conn, error) {
+	var proxy *url.URL
+	if d.Proxy != nil {
+		// The proxy is chosen as it would be for the equivalent
+		// HTTP request.
+		hu := *u
+		hu.Scheme = "http"
+		if secure {
+			hu.Scheme = "https"
+		}
+
+		var err error
+		proxy, err = d.Proxy(&http.Request{URL: &hu, Header: http.Header{}})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := &net.Dialer{Deadline: deadline}
+	target := addr
+	if proxy != nil {
+		var port string
+		switch proxy.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			return nil, ErrProxyScheme
+		}
+
+		target = proxy.Host
+		if proxy.Port() == "" {
+			target = net.JoinHostPort(proxy.Hostname(), port)
+		}
+	}
+
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+
+	if proxy != nil {
+		if proxy.Scheme == "https" {
+			if conn, err = d.tlsClient(conn, proxy.Hostname()); err != nil {
+				return nil, err
+			}
+		}
+
+		if err = proxyConnect(conn, proxy, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if secure {
+		if conn, err = d.tlsClient(conn, u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// tlsClient runs a TLS handshake over conn with the named server,
+// closing conn if it fails.
+func (d *WebSocketDialer) tlsClient(conn net.Conn, host string) (net.Conn, error) {
+	cfg := &tls.Config{}
+	if d.TLSConfig != nil {
+		cfg = d.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+
+	tconn := tls.Client(conn, cfg)
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// proxyConnect asks an HTTP proxy to open a tunnel to addr.
+func proxyConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// The proxy sends nothing after its response until the tunnel
+	// is used, so the response may be read a byte at a time
+	// without losing data.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(conn, 1), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ErrWebSocketHandshake
+	}
+	return nil
+}
+
+func (d *WebSocketDialer) handshake(conn net.Conn, u *url.URL) (*WebSocketChannel, error) {
+	var nonce [16]byte
+	if _, err := io.ReadFull(prng, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	header := http.Header{}
+	for k, v := range d.Header {
+		header[k] = v
+	}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Key", key)
+	header.Set("Sec-WebSocket-Version", "13")
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: header,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		resp.Body.Close()
+		return nil, ErrWebSocketHandshake
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &WebSocketChannel{conn: conn, br: br, client: true}, nil
+}
+
+// Write sends p as a single binary message.
+func (ws *WebSocketChannel) Write(p []byte) (int, error) {
+	if err := ws.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *WebSocketChannel) writeFrame(op byte, p []byte) error {
+	hdr := make([]byte, 2, 14+len(p))
+	hdr[0] = wsFinal | op
+
+	switch {
+	case len(p) <= 125:
+		hdr[1] = byte(len(p))
+	case len(p) <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(p)))
+	default:
+		hdr[1] = 127
+		hdr = append(hdr, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(len(p)))
+	}
+
+	frame := hdr
+	if ws.client {
+		var key [4]byte
+		if _, err := io.ReadFull(prng, key[:]); err != nil {
+			return err
+		}
+
+		frame[1] |= wsMask
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, p...)
+		for i := range frame[start:] {
+			frame[start+i] ^= key[i%4]
+		}
+	} else {
+		frame = append(frame, p...)
+	}
+
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closed {
+		return io.ErrClosedPipe
+	}
+
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// Read reads data from the next binary message. Pings are answered
+// while reading, and a close message from the peer ends the stream.
+func (ws *WebSocketChannel) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		m, err := ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		ws.pending = m
+	}
+
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+// readMessage reads frames until a complete data message has arrived,
+// handling control frames along the way.
+func (ws *WebSocketChannel) readMessage() ([]byte, error) {
+	var message []byte
+	var started bool
+	for {
+		final, op, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err = ws.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			ws.writeClose()
+			return nil, io.EOF
+		case wsBinary:
+			if started {
+				return nil, errWebSocketProtocol
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, errWebSocketProtocol
+			}
+		default:
+			return nil, errWebSocketProtocol
+		}
+
+		if len(message)+len(payload) > maxWebSocketMessage {
+			return nil, errWebSocketProtocol
+		}
+		message = append(message, payload...)
+
+		if final {
+			return message, nil
+		}
+	}
+}
+
+func (ws *WebSocketChannel) readFrame() (bool, byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(ws.br, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	final := hdr[0]&wsFinal != 0
+	op := hdr[0] & 0x0f
+	if hdr[0]&0x70 != 0 {
+		// No extensions are negotiated.
+		return false, 0, nil, errWebSocketProtocol
+	}
+
+	// Frames from a client must be masked, and frames from a
+	// server must not be.
+	masked := hdr[1]&wsMask != 0
+	if masked == ws.client {
+		return false, 0, nil, errWebSocketProtocol
+	}
+
+	length := uint64(hdr[1] &^ wsMask)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if op >= wsClose && (length > maxControlPayload || !final) {
+		return false, 0, nil, errWebSocketProtocol
+	} else if length > maxWebSocketMessage {
+		return false, 0, nil, errWebSocketProtocol
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.br, key[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, int(length))
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return final, op, payload, nil
+}
+
+// writeClose sends a close message with a normal status, unless one
+// has already been sent.
+func (ws *WebSocketChannel) writeClose() {
+	ws.wmu.Lock()
+	closed := ws.closed
+	ws.wmu.Unlock()
+	if closed {
+		return
+	}
+
+	// 1000 is the normal closure status.
+	ws.writeFrame(wsClose, []byte{0x03, 0xe8})
+	ws.wmu.Lock()
+	ws.closed = true
+	ws.wmu.Unlock()
+}
+
+// Close sends a close message to the peer and closes the connection.
+func (ws *WebSocketChannel) Close() error {
+	ws.writeClose()
+	return ws.conn.Close()
+}
+
+// SetReadDeadline sets the deadline for reading from the connection.
+func (ws *WebSocketChannel) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+// LocalAddr returns the local network address.
+func (ws *WebSocketChannel) LocalAddr() net.Addr {
+	return ws.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (ws *WebSocketChannel) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
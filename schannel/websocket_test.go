@@ -0,0 +1,307 @@
+package schannel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testWebSocketServer starts an HTTP server that sets up a secure
+// channel over each WebSocket connection and echoes the messages it
+// receives.
+func testWebSocketServer(t *testing.T, secure bool) *httptest.Server {
+	var wg sync.WaitGroup
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+
+		wg.Add(1)
+		defer wg.Done()
+		defer ws.Close()
+
+		sch, err := ListenConfig(ws, nil)
+		if err != nil {
+			return
+		}
+
+		for {
+			m, ok := sch.Receive()
+			if !ok || m.Type != NormalMessage {
+				return
+			}
+			sch.Send(m.Contents)
+		}
+	})
+
+	var srv *httptest.Server
+	if secure {
+		srv = httptest.NewTLSServer(handler)
+	} else {
+		srv = httptest.NewServer(handler)
+	}
+	t.Cleanup(func() {
+		srv.Close()
+		wg.Wait()
+	})
+	return srv
+}
+
+func testWebSocketURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func testWebSocketEcho(t *testing.T, ws *WebSocketChannel) {
+	defer ws.Close()
+
+	sch, err := DialConfig(ws, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The second message needs a 64-bit WebSocket length.
+	for _, p := range [][]byte{message, bytes.Repeat(message, 2048)} {
+		if !sch.Send(p) {
+			t.Fatal("failed to send a message")
+		}
+
+		m, ok := sch.Receive()
+		if !ok {
+			t.Fatal("failed to receive a message")
+		} else if !bytes.Equal(m.Contents, p) {
+			t.Fatal("echoed message does not match")
+		}
+	}
+
+	if !sch.Close() {
+		t.Fatal("failed to close the secure channel")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := testWebSocketServer(t, false)
+
+	ws, err := DialWebSocket(testWebSocketURL(srv))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	testWebSocketEcho(t, ws)
+}
+
+// testConnectProxy returns an HTTP proxy that only supports CONNECT,
+// and a counter of the tunnels it has opened. If secure is true, the
+// proxy is reached over TLS.
+func testConnectProxy(t *testing.T, secure bool) (*httptest.Server, *int) {
+	var mu sync.Mutex
+	var tunnels int
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		mu.Lock()
+		tunnels++
+		mu.Unlock()
+
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}))
+
+	if secure {
+		proxy.StartTLS()
+	} else {
+		proxy.Start()
+	}
+	t.Cleanup(proxy.Close)
+
+	return proxy, &tunnels
+}
+
+func TestWebSocketTLSProxy(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		testWebSocketTLSProxy(t, secure)
+	}
+}
+
+func testWebSocketTLSProxy(t *testing.T, secure bool) {
+	srv := testWebSocketServer(t, true)
+	proxy, tunnels := testConnectProxy(t, secure)
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	d := &WebSocketDialer{
+		TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+		Proxy:     http.ProxyURL(proxyURL),
+	}
+
+	ws, err := d.Dial("wss" + strings.TrimPrefix(srv.URL, "https"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	testWebSocketEcho(t, ws)
+
+	proxy.Close()
+	if *tunnels != 1 {
+		t.Fatalf("expected one tunnel through the proxy, have %d", *tunnels)
+	}
+}
+
+func TestWebSocketProxyScheme(t *testing.T) {
+	srv := testWebSocketServer(t, false)
+
+	d := &WebSocketDialer{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "socks5", Host: "127.0.0.1:1080"}),
+	}
+	if _, err := d.Dial(testWebSocketURL(srv)); err != ErrProxyScheme {
+		t.Fatalf("expected %v, have %v", ErrProxyScheme, err)
+	}
+}
+
+func TestWebSocketHandshakeRejected(t *testing.T) {
+	srv := testWebSocketServer(t, false)
+
+	// A plain HTTP request is refused by the server.
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, have %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// A server that does not speak WebSocket is refused by the
+	// dialer.
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+
+	if _, err = DialWebSocket(testWebSocketURL(plain)); err != ErrWebSocketHandshake {
+		t.Fatalf("expected %v, have %v", ErrWebSocketHandshake, err)
+	}
+
+	if _, err = DialWebSocket(srv.URL); err != ErrWebSocketHandshake {
+		t.Fatalf("expected %v for an http URL, have %v", ErrWebSocketHandshake, err)
+	}
+}
+
+// testClientFrame builds a masked frame as a client would send it.
+func testClientFrame(final bool, op byte, p []byte) []byte {
+	frame := []byte{op, wsMask | byte(len(p))}
+	if final {
+		frame[0] |= wsFinal
+	}
+
+	key := []byte{1, 2, 3, 4}
+	frame = append(frame, key...)
+	for i := range p {
+		frame = append(frame, p[i]^key[i%4])
+	}
+	return frame
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	ws := &WebSocketChannel{conn: server, br: bufio.NewReader(server)}
+	defer ws.Close()
+
+	go func() {
+		client.Write(testClientFrame(false, wsBinary, []byte("ab")))
+		client.Write(testClientFrame(true, wsPing, []byte("hi")))
+		client.Write(testClientFrame(true, wsContinuation, []byte("cd")))
+		client.Write(testClientFrame(true, wsClose, []byte{0x03, 0xe8}))
+	}()
+
+	// The ping is answered in the middle of the message.
+	pongs := make(chan []byte, 2)
+	go func() {
+		for {
+			var hdr [2]byte
+			if _, err := io.ReadFull(client, hdr[:]); err != nil {
+				close(pongs)
+				return
+			}
+
+			p := make([]byte, hdr[1])
+			io.ReadFull(client, p)
+			if hdr[0] == wsFinal|wsPong {
+				pongs <- p
+			}
+		}
+	}()
+
+	p, err := io.ReadAll(ws)
+	if err != nil {
+		t.Fatalf("%v", err)
+	} else if string(p) != "abcd" {
+		t.Fatalf("expected %q, have %q", "abcd", p)
+	}
+
+	if pong := <-pongs; string(pong) != "hi" {
+		t.Fatalf("expected pong %q, have %q", "hi", pong)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	var long [8]byte
+	binary.BigEndian.PutUint64(long[:], maxWebSocketMessage+1)
+
+	var tests = [][]byte{
+		// Unmasked frame from a client.
+		{wsFinal | wsBinary, 1, 'a'},
+		// Reserved bits set.
+		append([]byte{0x40}, testClientFrame(true, wsBinary, []byte("a"))[1:]...),
+		// Continuation without a message.
+		testClientFrame(true, wsContinuation, []byte("a")),
+		// Fragmented control frame.
+		testClientFrame(false, wsPing, []byte("a")),
+		// Text messages are not used.
+		testClientFrame(true, 0x1, []byte("a")),
+		// Oversized message.
+		append([]byte{wsFinal | wsBinary, wsMask | 127}, long[:]...),
+	}
+
+	for i, frame := range tests {
+		client, server := net.Pipe()
+		ws := &WebSocketChannel{conn: server, br: bufio.NewReader(server)}
+
+		go func() {
+			client.Write(frame)
+			io.Copy(io.Discard, client)
+		}()
+
+		if _, err := ws.Read(make([]byte, 16)); err != errWebSocketProtocol {
+			t.Fatalf("test %d: expected %v, have %v", i, errWebSocketProtocol, err)
+		}
+		ws.Close()
+		client.Close()
+	}
+}